@@ -174,7 +174,11 @@ func processModuleProperty(module *parser.Module, moduleName string,
 		// remove-property is used solely, so return here.
 		return parent.RemoveProperty(prop.Name), nil
 	} else if *moveProperty {
-		return parent.MovePropertyContents(prop.Name, newLocation), nil
+		moved, err := parent.MovePropertyContents(prop.Name, newLocation)
+		if err != nil {
+			return false, []error{err}
+		}
+		return moved, nil
 	}
 	m, errs := processParameter(prop.Value, property.String(), moduleName, file)
 	modified = modified || m
@@ -16,6 +16,8 @@ package parser
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 	"text/scanner"
 )
@@ -44,6 +46,23 @@ type Assignment struct {
 	EqualsPos  scanner.Position
 	Assigner   string
 	Referenced bool
+	// BlankLinesBefore is the number of blank lines between the previous definition and this one
+	// in the source, not counting lines taken up by comments.
+	BlankLinesBefore int
+}
+
+// copy returns a copy of the assignment with its own copies of the values.
+func (a *Assignment) copy() *Assignment {
+	ret := *a
+	if a.OrigValue != nil {
+		ret.OrigValue = a.OrigValue.Copy()
+	}
+	if a.Value == a.OrigValue {
+		ret.Value = ret.OrigValue
+	} else if a.Value != nil {
+		ret.Value = a.Value.Copy()
+	}
+	return &ret
 }
 
 func (a *Assignment) String() string {
@@ -62,10 +81,18 @@ type Module struct {
 	Map
 	//TODO(delmerico) make this a private field once ag/21588220 lands
 	Name__internal_only *string
+	// SourceFiles lists the files that the module's content came from when it was assembled by
+	// MergeFiles: the file that defines it and the files that assign the variables it references.
+	// It is empty for a module parsed from a single file.
+	SourceFiles []string
+	// BlankLinesBefore is the number of blank lines between the previous definition and this one
+	// in the source, not counting lines taken up by comments.
+	BlankLinesBefore int
 }
 
 func (m *Module) Copy() *Module {
 	ret := *m
+	ret.SourceFiles = append([]string(nil), m.SourceFiles...)
 	ret.Properties = make([]*Property, len(m.Properties))
 	for i := range m.Properties {
 		ret.Properties[i] = m.Properties[i].Copy()
@@ -73,6 +100,18 @@ func (m *Module) Copy() *Module {
 	return &ret
 }
 
+// Provenance returns the names of the files that the module's content came from, see SourceFiles.
+// For a module parsed from a single file it returns that file, or nil if the file has no name.
+func (m *Module) Provenance() []string {
+	if len(m.SourceFiles) > 0 {
+		return append([]string(nil), m.SourceFiles...)
+	}
+	if m.TypePos.Filename != "" {
+		return []string{m.TypePos.Filename}
+	}
+	return nil
+}
+
 func (m *Module) String() string {
 	propertyStrings := make([]string, len(m.Properties))
 	for i, property := range m.Properties {
@@ -116,6 +155,10 @@ type Property struct {
 	NamePos  scanner.Position
 	ColonPos scanner.Position
 	Value    Expression
+	// Comments holds the comments on their own lines between the previous property, or the
+	// opening brace, and the property.  They are printed with the property, so they move with it
+	// when the properties are reordered, and are left out when the property is removed.
+	Comments []*CommentGroup
 }
 
 func (p *Property) Copy() *Property {
@@ -146,38 +189,27 @@ type Expression interface {
 	Eval() Expression
 }
 
+// TypeStableUnderEval returns true if the type reported by e.Type() is the same as the type of
+// e.Eval().  Tools can use it to check that Type() can be trusted for an expression before
+// evaluating it.
+func TypeStableUnderEval(e Expression) bool {
+	return e.Type() == e.Eval().Type()
+}
+
 // ExpressionsAreSame tells whether the two values are the same Expression.
 // This includes the symbolic representation of each Expression but not their positions in the original source tree.
 // This does not apply any simplification to the expressions before comparing them
 // (for example, "!!a" wouldn't be deemed equal to "a")
 func ExpressionsAreSame(a Expression, b Expression) (equal bool, err error) {
-	return hackyExpressionsAreSame(a, b)
-}
-
-// TODO(jeffrygaston) once positions are removed from Expression structs,
-// remove this function and have callers use reflect.DeepEqual(a, b)
-func hackyExpressionsAreSame(a Expression, b Expression) (equal bool, err error) {
-	if a.Type() != b.Type() {
-		return false, nil
-	}
-	left, err := hackyFingerprint(a)
+	left, err := Fingerprint(a)
 	if err != nil {
-		return false, nil
+		return false, err
 	}
-	right, err := hackyFingerprint(b)
+	right, err := Fingerprint(b)
 	if err != nil {
-		return false, nil
+		return false, err
 	}
-	areEqual := string(left) == string(right)
-	return areEqual, nil
-}
-
-func hackyFingerprint(expression Expression) (fingerprint []byte, err error) {
-	assignment := &Assignment{"a", noPos, expression, expression, noPos, "=", false}
-	module := &File{}
-	module.Defs = append(module.Defs, assignment)
-	p := newPrinter(module)
-	return p.Print()
+	return left == right, nil
 }
 
 type Type int
@@ -190,6 +222,7 @@ const (
 	MapType
 	NotEvaluatedType
 	UnsetType
+	Float64Type
 )
 
 func (t Type) String() string {
@@ -200,6 +233,8 @@ func (t Type) String() string {
 		return "string"
 	case Int64Type:
 		return "int64"
+	case Float64Type:
+		return "float64"
 	case ListType:
 		return "list"
 	case MapType:
@@ -218,6 +253,10 @@ type Operator struct {
 	Operator    rune
 	OperatorPos scanner.Position
 	Value       Expression
+	// Comments holds the comments between the operator and its right operand, like /* debug */
+	// in ["-a"] + /* debug */ ["-b"].  They are also in the Comments of the File, and are only
+	// printed with the operator when it is printed without them, like by PrintExpression.
+	Comments []*CommentGroup
 }
 
 func (x *Operator) Copy() Expression {
@@ -243,10 +282,131 @@ func (x *Operator) String() string {
 		x.Value, x.OperatorPos)
 }
 
+// A Comparison compares two int64 or two string values with ==, !=, <, >, <= or >=.  It binds
+// less tightly than + and -.
+type Comparison struct {
+	Args        [2]Expression
+	Operator    string
+	OperatorPos scanner.Position
+	// Value is the Bool result of the comparison when the expression is evaluated while parsing,
+	// or NotEvaluated otherwise.
+	Value Expression
+}
+
+func (x *Comparison) Copy() Expression {
+	ret := *x
+	ret.Args[0] = x.Args[0].Copy()
+	ret.Args[1] = x.Args[1].Copy()
+	return &ret
+}
+
+func (x *Comparison) Eval() Expression {
+	return x.Value.Eval()
+}
+
+func (x *Comparison) Type() Type { return BoolType }
+
+func (x *Comparison) Pos() scanner.Position { return x.Args[0].Pos() }
+func (x *Comparison) End() scanner.Position { return x.Args[1].End() }
+
+func (x *Comparison) String() string {
+	return fmt.Sprintf("(%s %s %s = %s)@%s", x.Args[0].String(), x.Operator, x.Args[1].String(),
+		x.Value, x.OperatorPos)
+}
+
+// A BoolOp combines two bool values with && or ||, or negates one with a unary !.  The unary !
+// binds more tightly than any other operator.  && and || bind less tightly than comparisons, and
+// && binds more tightly than ||.
+type BoolOp struct {
+	// Args holds the operands of && and ||.  The operand of ! is in Args[1], and Args[0] is nil.
+	Args        [2]Expression
+	Operator    string
+	OperatorPos scanner.Position
+	// Value is the Bool result when the expression is evaluated while parsing, or NotEvaluated
+	// otherwise.  The second operand of && and || does not affect it if the first operand
+	// decides the result, but both operands are always checked to be bools.
+	Value Expression
+}
+
+func (x *BoolOp) Copy() Expression {
+	ret := *x
+	if x.Args[0] != nil {
+		ret.Args[0] = x.Args[0].Copy()
+	}
+	ret.Args[1] = x.Args[1].Copy()
+	return &ret
+}
+
+func (x *BoolOp) Eval() Expression {
+	return x.Value.Eval()
+}
+
+func (x *BoolOp) Type() Type { return BoolType }
+
+func (x *BoolOp) Pos() scanner.Position {
+	if x.Args[0] == nil {
+		return x.OperatorPos
+	}
+	return x.Args[0].Pos()
+}
+
+func (x *BoolOp) End() scanner.Position { return x.Args[1].End() }
+
+func (x *BoolOp) String() string {
+	if x.Args[0] == nil {
+		return fmt.Sprintf("(%s%s = %s)@%s", x.Operator, x.Args[1].String(), x.Value, x.OperatorPos)
+	}
+	return fmt.Sprintf("(%s %s %s = %s)@%s", x.Args[0].String(), x.Operator, x.Args[1].String(),
+		x.Value, x.OperatorPos)
+}
+
+// A Conditional picks between two values based on a bool condition, like cond ? a : b.  It binds
+// less tightly than any other operator, and nested conditionals group to the right.
+type Conditional struct {
+	Cond        Expression
+	QuestionPos scanner.Position
+	True        Expression
+	ColonPos    scanner.Position
+	False       Expression
+	// Value is the selected branch when the expression is evaluated while parsing, or
+	// NotEvaluated otherwise.
+	Value Expression
+}
+
+func (x *Conditional) Copy() Expression {
+	ret := *x
+	ret.Cond = x.Cond.Copy()
+	ret.True = x.True.Copy()
+	ret.False = x.False.Copy()
+	return &ret
+}
+
+func (x *Conditional) Eval() Expression {
+	return x.Value.Eval()
+}
+
+// Type returns the type of the branches, which the parser requires to be the same.
+func (x *Conditional) Type() Type {
+	if t := x.True.Type(); t != NotEvaluatedType {
+		return t
+	}
+	return x.False.Type()
+}
+
+func (x *Conditional) Pos() scanner.Position { return x.Cond.Pos() }
+func (x *Conditional) End() scanner.Position { return x.False.End() }
+
+func (x *Conditional) String() string {
+	return fmt.Sprintf("(%s ? %s : %s = %s)@%s", x.Cond, x.True, x.False, x.Value, x.QuestionPos)
+}
+
 type Variable struct {
 	Name    string
 	NamePos scanner.Position
 	Value   Expression
+
+	// assignment is the assignment the variable referred to when it was parsed, if any.
+	assignment *Assignment
 }
 
 func (x *Variable) Pos() scanner.Position { return x.NamePos }
@@ -267,10 +427,161 @@ func (x *Variable) String() string {
 
 func (x *Variable) Type() Type { return x.Value.Type() }
 
+// Root follows a chain of variables set to other variables, as in a = b, and returns the
+// assignment at the end of the chain and its value, which is not a Variable.  The assignment is
+// nil for a Variable that was not parsed with the assignment in scope, in which case the value is
+// the one in the Variable.  The value of an assignment that was appended to with += includes the
+// appended values.  Root returns nil for both if the chain is a cycle.
+func (x *Variable) Root() (*Assignment, Expression) {
+	var assignment *Assignment
+	var value Expression = x
+	seen := make(map[*Variable]bool)
+	for {
+		v, ok := value.(*Variable)
+		if !ok {
+			return assignment, value
+		}
+		if seen[v] {
+			return nil, nil
+		}
+		seen[v] = true
+		assignment = v.assignment
+		if assignment != nil {
+			value = assignment.Value
+		} else {
+			value = v.Value
+		}
+	}
+}
+
+// An InterpolatedString is a string literal that references variables with $(name), parsed when
+// ParseOptions.InterpolateStrings is set.
+type InterpolatedString struct {
+	LiteralPos scanner.Position
+	// Parts holds the literal text of the string, as *String, and the referenced variables, as
+	// *Variable, in order.
+	Parts []Expression
+	// Raw is true if the string was written as a backquoted raw string.
+	Raw bool
+	// Value is the String with the values of the variables substituted when the expression is
+	// evaluated while parsing, or NotEvaluated otherwise.
+	Value Expression
+}
+
+func (x *InterpolatedString) Pos() scanner.Position { return x.LiteralPos }
+func (x *InterpolatedString) End() scanner.Position {
+	return advancePos(x.LiteralPos, x.literal())
+}
+
+func (x *InterpolatedString) Copy() Expression {
+	ret := *x
+	ret.Parts = make([]Expression, len(x.Parts))
+	for i, part := range x.Parts {
+		ret.Parts[i] = part.Copy()
+	}
+	return &ret
+}
+
+func (x *InterpolatedString) Eval() Expression {
+	return x.Value.Eval()
+}
+
+func (x *InterpolatedString) String() string {
+	return x.literal() + " = " + x.Value.String()
+}
+
+func (x *InterpolatedString) Type() Type { return StringType }
+
+// literal returns the string literal as it would be written in a Blueprints file.
+func (x *InterpolatedString) literal() string {
+	var b strings.Builder
+	for _, part := range x.Parts {
+		switch part := part.(type) {
+		case *String:
+			if x.Raw {
+				b.WriteString(part.Value)
+			} else {
+				quoted := strconv.Quote(part.Value)
+				b.WriteString(quoted[1 : len(quoted)-1])
+			}
+		case *Variable:
+			b.WriteString("$(" + part.Name + ")")
+		}
+	}
+	if x.Raw {
+		return "`" + b.String() + "`"
+	}
+	return `"` + b.String() + `"`
+}
+
+// A MemberAccess is a reference to a single property of a map, like mymap.field.
+type MemberAccess struct {
+	Base    Expression
+	DotPos  scanner.Position
+	Name    string
+	NamePos scanner.Position
+	// Value is the value of the property when the expression is evaluated while parsing, or
+	// NotEvaluated otherwise.
+	Value Expression
+}
+
+func (x *MemberAccess) Pos() scanner.Position { return x.Base.Pos() }
+func (x *MemberAccess) End() scanner.Position { return endPos(x.NamePos, len(x.Name)) }
+
+func (x *MemberAccess) Copy() Expression {
+	ret := *x
+	ret.Base = x.Base.Copy()
+	return &ret
+}
+
+func (x *MemberAccess) Eval() Expression {
+	return x.Value.Eval()
+}
+
+func (x *MemberAccess) String() string {
+	return fmt.Sprintf("%s.%s = %s", x.Base, x.Name, x.Value)
+}
+
+func (x *MemberAccess) Type() Type { return x.Value.Type() }
+
+// An IndexAccess is a reference to a single element of a list, like mylist[0].
+type IndexAccess struct {
+	Base        Expression
+	LBracketPos scanner.Position
+	Index       Expression
+	RBracketPos scanner.Position
+	// Value is the element of the list when the expression is evaluated while parsing, or
+	// NotEvaluated otherwise.
+	Value Expression
+}
+
+func (x *IndexAccess) Pos() scanner.Position { return x.Base.Pos() }
+func (x *IndexAccess) End() scanner.Position { return endPos(x.RBracketPos, 1) }
+
+func (x *IndexAccess) Copy() Expression {
+	ret := *x
+	ret.Base = x.Base.Copy()
+	ret.Index = x.Index.Copy()
+	return &ret
+}
+
+func (x *IndexAccess) Eval() Expression {
+	return x.Value.Eval()
+}
+
+func (x *IndexAccess) String() string {
+	return fmt.Sprintf("%s[%s] = %s", x.Base, x.Index, x.Value)
+}
+
+func (x *IndexAccess) Type() Type { return x.Value.Type() }
+
 type Map struct {
 	LBracePos  scanner.Position
 	RBracePos  scanner.Position
 	Properties []*Property
+	// TrailingComments holds the comments on their own lines after the last property, which are
+	// printed before the closing brace.
+	TrailingComments []*CommentGroup
 }
 
 func (x *Map) Pos() scanner.Position { return x.LBracePos }
@@ -304,7 +615,27 @@ func (x *Map) Type() Type { return MapType }
 // It resembles the bracket operator of a built-in Golang map.
 func (x *Map) GetProperty(name string) (Property *Property, found bool) {
 	prop, found, _ := x.getPropertyImpl(name)
-	return prop, found // we don't currently expose the index to callers
+	return prop, found
+}
+
+// Keys returns the names of the properties of the map in their current order.
+func (x *Map) Keys() []string {
+	keys := make([]string, len(x.Properties))
+	for i, prop := range x.Properties {
+		keys[i] = prop.Name
+	}
+	return keys
+}
+
+// Len returns the number of properties in the map.
+func (x *Map) Len() int {
+	return len(x.Properties)
+}
+
+// PropertyIndex returns the index in Properties of the property with the given name.
+func (x *Map) PropertyIndex(name string) (index int, found bool) {
+	_, found, index = x.getPropertyImpl(name)
+	return index, found
 }
 
 func (x *Map) getPropertyImpl(name string) (Property *Property, found bool, index int) {
@@ -316,6 +647,24 @@ func (x *Map) getPropertyImpl(name string) (Property *Property, found bool, inde
 	return nil, false, -1
 }
 
+// SetProperty sets the value of the property with the given name.  If the property already
+// exists its value is replaced and SetProperty returns false, otherwise a new property is
+// appended at the end of the map and SetProperty returns true.
+func (x *Map) SetProperty(name string, value Expression) (added bool) {
+	if prop, found := x.GetProperty(name); found {
+		prop.Value = value
+		return false
+	}
+
+	x.Properties = append(x.Properties, &Property{
+		Name:     name,
+		NamePos:  x.RBracePos,
+		ColonPos: x.RBracePos,
+		Value:    value,
+	})
+	return true
+}
+
 // RemoveProperty removes the property with the given name, if it exists.
 func (x *Map) RemoveProperty(propertyName string) (removed bool) {
 	_, found, index := x.getPropertyImpl(propertyName)
@@ -325,46 +674,143 @@ func (x *Map) RemoveProperty(propertyName string) (removed bool) {
 	return found
 }
 
+// RenameProperty changes the name of the property oldName to newName, keeping its value and
+// position.  It returns false without changing the map if there is no property oldName, or if
+// there is already a property newName.
+func (x *Map) RenameProperty(oldName, newName string) (renamed bool) {
+	prop, found := x.GetProperty(oldName)
+	if !found {
+		return false
+	}
+	if _, exists := x.GetProperty(newName); exists && newName != oldName {
+		return false
+	}
+	prop.Name = newName
+	return true
+}
+
+// TakeProperty removes the property with the given name and returns it, so that it can be
+// transformed and added back with SetProperty.
+func (x *Map) TakeProperty(name string) (*Property, bool) {
+	prop, found, index := x.getPropertyImpl(name)
+	if found {
+		x.Properties = append(x.Properties[:index], x.Properties[index+1:]...)
+	}
+	return prop, found
+}
+
 // MovePropertyContents moves the contents of propertyName into property newLocation
 // If property newLocation doesn't exist, MovePropertyContents renames propertyName as newLocation.
-// Otherwise, MovePropertyContents only supports moving contents that are a List of String.
-func (x *Map) MovePropertyContents(propertyName string, newLocation string) (removed bool) {
+// Otherwise, MovePropertyContents supports moving contents that are a List of String into a List
+// of String, and a Map into a Map.  The properties of a Map are added after the properties of
+// newLocation, and a property that is set in both maps is set to the value in newLocation + the
+// value in propertyName.  It returns an error without changing the map for any other types, or
+// if the values of a property in both maps can't be added.
+func (x *Map) MovePropertyContents(propertyName string, newLocation string) (removed bool, err error) {
 	oldProp, oldFound, _ := x.getPropertyImpl(propertyName)
 	newProp, newFound, _ := x.getPropertyImpl(newLocation)
 
 	// newLoc doesn't exist, simply renaming property
 	if oldFound && !newFound {
 		oldProp.Name = newLocation
-		return oldFound
+		return oldFound, nil
 	}
 
 	if oldFound {
-		old, oldOk := oldProp.Value.(*List)
-		new, newOk := newProp.Value.(*List)
-		if oldOk && newOk {
-			toBeMoved := make([]string, len(old.Values)) //
-			for i, p := range old.Values {
-				toBeMoved[i] = p.(*String).Value
+		switch old := oldProp.Value.(type) {
+		case *List:
+			if new, ok := newProp.Value.(*List); ok && isListOfStrings(old) && isListOfStrings(new) {
+				toBeMoved := make([]string, len(old.Values)) //
+				for i, p := range old.Values {
+					toBeMoved[i] = p.(*String).Value
+				}
+
+				for _, moved := range toBeMoved {
+					RemoveStringFromList(old, moved)
+					AddStringToList(new, moved)
+				}
+				// oldProp should now be empty and needs to be deleted
+				x.RemoveProperty(oldProp.Name)
+				return true, nil
 			}
+		case *Map:
+			if new, ok := newProp.Value.(*Map); ok {
+				if err := checkMapMerge(new.Properties, old.Properties); err != nil {
+					return false, fmt.Errorf("MovePropertyContents can't move %q into %q: %w",
+						propertyName, newLocation, err)
+				}
+				// Merge the maps the same way the + operator does, without evaluating the values.
+				new.Properties, _ = mergeProperties(new.Properties, old.Properties,
+					func(value1, value2 Expression) (Expression, error) {
+						return &Operator{
+							Args:        [2]Expression{value1, value2},
+							Operator:    '+',
+							OperatorPos: newProp.ColonPos,
+							Value:       value1,
+						}, nil
+					})
+				x.RemoveProperty(oldProp.Name)
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("MovePropertyContents can't move %s %q into %s %q, it only supports a "+
+			"list of strings into a list of strings and a map into a map",
+			oldProp.Value.Type(), propertyName, newProp.Value.Type(), newLocation)
+	}
+	return oldFound, nil
+}
 
-			for _, moved := range toBeMoved {
-				RemoveStringFromList(old, moved)
-				AddStringToList(new, moved)
+// checkMapMerge returns the error that the + operator returns for the values of properties in both
+// maps, recursing into nested maps.  Values that are not evaluated are not checked.
+func checkMapMerge(map1, map2 []*Property) error {
+	for _, prop2 := range map2 {
+		for _, prop1 := range map1 {
+			if prop1.Name != prop2.Name {
+				continue
 			}
-			// oldProp should now be empty and needs to be deleted
-			x.RemoveProperty(oldProp.Name)
-		} else {
-			print(`MovePropertyContents currently only supports moving PropertyName
-					with List of Strings into an existing newLocation with List of Strings\n`)
+			e1, e2 := prop1.Value.Eval(), prop2.Value.Eval()
+			if e1.Type() == NotEvaluatedType || e2.Type() == NotEvaluatedType {
+				continue
+			}
+			if m1, ok := e1.(*Map); ok {
+				if m2, ok := e2.(*Map); ok {
+					if err := checkMapMerge(m1.Properties, m2.Properties); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if _, err := operatorValue(e1, e2, '+', noPos); err != nil {
+				return fmt.Errorf("property %q: %w", prop1.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isListOfStrings(list *List) bool {
+	for _, v := range list.Values {
+		if _, ok := v.(*String); !ok {
+			return false
 		}
 	}
-	return oldFound
+	return true
 }
 
 type List struct {
 	LBracePos scanner.Position
 	RBracePos scanner.Position
 	Values    []Expression
+	// ValueComments holds, at the index of each value, the comments on their own lines between
+	// the previous value, or the opening bracket, and that value.  They are printed before the
+	// value at the same index, and may be shorter than Values if the values at the end have no
+	// comments.  The functions in this package that remove values from a list remove their
+	// comments too, while SortList leaves the comments in place, so that a comment above a sorted
+	// run of values stays above it.
+	ValueComments [][]*CommentGroup
+	// TrailingComments holds the comments on their own lines after the last value, which are
+	// printed before the closing bracket.
+	TrailingComments []*CommentGroup
 }
 
 func (x *List) Pos() scanner.Position { return x.LBracePos }
@@ -376,9 +822,48 @@ func (x *List) Copy() Expression {
 	for i := range ret.Values {
 		ret.Values[i] = x.Values[i].Copy()
 	}
+	ret.ValueComments = slices.Clone(x.ValueComments)
 	return &ret
 }
 
+// valueComments returns the comments attached to the value at index i.
+func (x *List) valueComments(i int) []*CommentGroup {
+	if i < len(x.ValueComments) {
+		return x.ValueComments[i]
+	}
+	return nil
+}
+
+// removeValue removes the value at index i and the comments attached to it.
+func (x *List) removeValue(i int) {
+	x.Values = slices.Delete(x.Values, i, i+1)
+	if i < len(x.ValueComments) {
+		x.ValueComments = slices.Delete(x.ValueComments, i, i+1)
+	}
+}
+
+// deleteValuesFunc removes the values for which del returns true and the comments attached to
+// them, keeping the order of the others.  del is called with the values in order.
+func (x *List) deleteValuesFunc(del func(Expression) bool) {
+	j := 0
+	for i, value := range x.Values {
+		if del(value) {
+			continue
+		}
+		x.Values[j] = value
+		if j < len(x.ValueComments) {
+			x.ValueComments[j] = x.valueComments(i)
+		}
+		j++
+	}
+	clear(x.Values[j:])
+	x.Values = x.Values[:j]
+	if j < len(x.ValueComments) {
+		clear(x.ValueComments[j:])
+		x.ValueComments = x.ValueComments[:j]
+	}
+}
+
 func (x *List) Eval() Expression {
 	return x
 }
@@ -397,10 +882,21 @@ func (x *List) Type() Type { return ListType }
 type String struct {
 	LiteralPos scanner.Position
 	Value      string
+
+	// Raw is true if the string was written as a backquoted raw string.  Value then holds the
+	// contents exactly as written, including any leading or trailing whitespace, tabs, newlines
+	// and carriage returns, and the printer writes it back as a raw string.
+	Raw bool
 }
 
 func (x *String) Pos() scanner.Position { return x.LiteralPos }
-func (x *String) End() scanner.Position { return endPos(x.LiteralPos, len(x.Value)+2) }
+func (x *String) End() scanner.Position {
+	if x.Raw {
+		// A raw string is written verbatim, so it ends on the last line of its value.
+		return advancePos(x.LiteralPos, "`"+x.Value+"`")
+	}
+	return endPos(x.LiteralPos, len(x.Value)+2)
+}
 
 func (x *String) Copy() Expression {
 	ret := *x
@@ -438,13 +934,39 @@ func (x *Int64) Eval() Expression {
 }
 
 func (x *Int64) String() string {
-	return fmt.Sprintf("%q@%s", x.Value, x.LiteralPos)
+	return fmt.Sprintf("%d@%s", x.Value, x.LiteralPos)
 }
 
 func (x *Int64) Type() Type {
 	return Int64Type
 }
 
+type Float64 struct {
+	LiteralPos scanner.Position
+	Value      float64
+	Token      string
+}
+
+func (x *Float64) Pos() scanner.Position { return x.LiteralPos }
+func (x *Float64) End() scanner.Position { return endPos(x.LiteralPos, len(x.Token)) }
+
+func (x *Float64) Copy() Expression {
+	ret := *x
+	return &ret
+}
+
+func (x *Float64) Eval() Expression {
+	return x
+}
+
+func (x *Float64) String() string {
+	return fmt.Sprintf("%v@%s", x.Value, x.LiteralPos)
+}
+
+func (x *Float64) Type() Type {
+	return Float64Type
+}
+
 type Bool struct {
 	LiteralPos scanner.Position
 	Value      bool
@@ -473,11 +995,65 @@ func (x *Bool) Type() Type {
 
 type CommentGroup struct {
 	Comments []*Comment
+
+	// attached is set for a group in the Comments of a Property or List, which is printed with
+	// that node rather than at its position among the comments of the File.
+	attached bool
 }
 
 func (x *CommentGroup) Pos() scanner.Position { return x.Comments[0].Pos() }
 func (x *CommentGroup) End() scanner.Position { return x.Comments[len(x.Comments)-1].End() }
 
+func (x *CommentGroup) String() string {
+	comments := make([]string, len(x.Comments))
+	for i, c := range x.Comments {
+		comments[i] = c.String()
+	}
+	return "[" + strings.Join(comments, ", ") + "]"
+}
+
+// AssociateComments returns the comment group that documents each definition and property in the
+// File, which is the group that ends on the line directly above it.  If more than one node starts
+// on that line the group is associated with the outermost one.  Comment groups that are separated
+// from the following node by a blank line are not included.  Comments at the end of a line with
+// code on it document that code rather than the following node, so they are left out of the
+// returned groups.
+func (f *File) AssociateComments() map[Node]*CommentGroup {
+	nodesByLine := make(map[int]Node)
+	codeLines := make(map[int]bool)
+	Walk(f, func(n Node) bool {
+		switch n.(type) {
+		case *Assignment, *Module, *Property:
+			line := n.Pos().Line
+			if _, exists := nodesByLine[line]; !exists {
+				nodesByLine[line] = n
+			}
+		}
+		codeLines[n.Pos().Line] = true
+		codeLines[n.End().Line] = true
+		return true
+	})
+
+	ret := make(map[Node]*CommentGroup)
+	for _, cg := range f.Comments {
+		n, ok := nodesByLine[cg.End().Line+1]
+		if !ok {
+			continue
+		}
+		i := 0
+		for i < len(cg.Comments) && codeLines[cg.Comments[i].Slash.Line] {
+			i++
+		}
+		if i == len(cg.Comments) {
+			continue
+		} else if i > 0 {
+			cg = &CommentGroup{Comments: cg.Comments[i:]}
+		}
+		ret[n] = cg
+	}
+	return ret
+}
+
 type Comment struct {
 	Comment []string
 	Slash   scanner.Position
@@ -565,6 +1141,33 @@ func (n NotEvaluated) Eval() Expression {
 func (n NotEvaluated) Pos() scanner.Position { return n.Position }
 func (n NotEvaluated) End() scanner.Position { return n.Position }
 
+// A Placeholder replaces the value of a module property that is not a literal when parsing with
+// ParseOptions.MetadataOnly.  It records the range and the type of the value it replaced, but not
+// its contents, so it cannot be printed or evaluated.
+type Placeholder struct {
+	StartPos  scanner.Position
+	EndPos    scanner.Position
+	ValueType Type
+}
+
+func (x *Placeholder) Pos() scanner.Position { return x.StartPos }
+func (x *Placeholder) End() scanner.Position { return x.EndPos }
+
+func (x *Placeholder) Copy() Expression {
+	ret := *x
+	return &ret
+}
+
+func (x *Placeholder) Eval() Expression {
+	return x
+}
+
+func (x *Placeholder) String() string {
+	return fmt.Sprintf("@%s-%s<%s placeholder>", x.StartPos, x.EndPos, x.ValueType)
+}
+
+func (x *Placeholder) Type() Type { return x.ValueType }
+
 func endPos(pos scanner.Position, n int) scanner.Position {
 	pos.Offset += n
 	pos.Column += n
@@ -575,10 +1178,13 @@ type ConfigurableCondition struct {
 	position     scanner.Position
 	FunctionName string
 	Args         []String
+	// Negated is true if the condition was written with a ! or not prefix, which inverts the
+	// value of a boolean condition.
+	Negated bool
 }
 
 func (c *ConfigurableCondition) Equals(other ConfigurableCondition) bool {
-	if c.FunctionName != other.FunctionName {
+	if c.FunctionName != other.FunctionName || c.Negated != other.Negated {
 		return false
 	}
 	if len(c.Args) != len(other.Args) {
@@ -594,6 +1200,9 @@ func (c *ConfigurableCondition) Equals(other ConfigurableCondition) bool {
 
 func (c *ConfigurableCondition) String() string {
 	var sb strings.Builder
+	if c.Negated {
+		sb.WriteRune('!')
+	}
 	sb.WriteString(c.FunctionName)
 	sb.WriteRune('(')
 	for i, arg := range c.Args {
@@ -623,6 +1232,11 @@ func (s *Select) End() scanner.Position { return endPos(s.RBracePos, 1) }
 
 func (s *Select) Copy() Expression {
 	ret := *s
+	ret.Conditions = make([]ConfigurableCondition, len(s.Conditions))
+	for i, c := range s.Conditions {
+		ret.Conditions[i] = c
+		ret.Conditions[i].Args = append([]String(nil), c.Args...)
+	}
 	ret.Cases = make([]*SelectCase, len(ret.Cases))
 	for i, selectCase := range s.Cases {
 		ret.Cases[i] = selectCase.Copy()
@@ -648,6 +1262,16 @@ func (s *Select) Type() Type {
 	return s.ExpressionType
 }
 
+// defaultCase returns the case whose patterns are all default, or nil if there isn't one.
+func (s *Select) defaultCase() *SelectCase {
+	for _, c := range s.Cases {
+		if c.isDefault() {
+			return c
+		}
+	}
+	return nil
+}
+
 type SelectCase struct {
 	Patterns []Expression
 	ColonPos scanner.Position
@@ -656,6 +1280,10 @@ type SelectCase struct {
 
 func (c *SelectCase) Copy() *SelectCase {
 	ret := *c
+	ret.Patterns = make([]Expression, len(c.Patterns))
+	for i, pattern := range c.Patterns {
+		ret.Patterns[i] = pattern.Copy()
+	}
 	ret.Value = c.Value.Copy()
 	return &ret
 }
@@ -664,6 +1292,16 @@ func (c *SelectCase) String() string {
 	return "<select case>"
 }
 
+// isDefault returns true if every pattern of the case is default.
+func (c *SelectCase) isDefault() bool {
+	for _, pattern := range c.Patterns {
+		if !isDefaultPattern(pattern) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *SelectCase) Pos() scanner.Position { return c.Patterns[0].Pos() }
 func (c *SelectCase) End() scanner.Position { return c.Value.End() }
 
@@ -0,0 +1,341 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapPropertyIndex(t *testing.T) {
+	m := parseForTest(t, `
+foo {
+    name: "foo",
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+}
+`).Defs[0].(*Module)
+
+	if index, found := m.PropertyIndex("cflags"); !found || index != 2 {
+		t.Errorf("expected cflags at index 2, got %d, %t", index, found)
+	}
+	if index, found := m.PropertyIndex("missing"); found || index != -1 {
+		t.Errorf("expected missing property not to be found, got %d, %t", index, found)
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	m := parseForTest(t, `
+foo {
+    name: "foo",
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+}
+`).Defs[0].(*Module)
+
+	if got, w := m.Keys(), []string{"name", "srcs", "cflags"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected keys %q, got %q", w, got)
+	}
+	m.RemoveProperty("srcs")
+	m.SetProperty("enabled", &Bool{Value: true})
+	if got, w := m.Keys(), []string{"name", "cflags", "enabled"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected keys %q, got %q", w, got)
+	}
+	if m.Len() != 3 {
+		t.Errorf("expected 3 properties, got %d", m.Len())
+	}
+	if empty := (&Map{}); empty.Len() != 0 || len(empty.Keys()) != 0 {
+		t.Errorf("expected an empty map to have no keys")
+	}
+}
+
+func TestTypeStableUnderEval(t *testing.T) {
+	// A select whose cases are all unset only has a type because of the value appended to it.
+	appended := &Select{
+		Cases: []*SelectCase{{
+			Patterns: []Expression{&String{Value: "arm"}},
+			Value:    UnsetProperty{},
+		}},
+		ExpressionType: UnsetType,
+		Append:         &List{Values: []Expression{&String{Value: "a"}}},
+	}
+	if g, w := appended.Type(), ListType; g != w {
+		t.Errorf("expected select type %s, got %s", w, g)
+	}
+	if !TypeStableUnderEval(appended) {
+		t.Errorf("expected select with an appended list to be type stable")
+	}
+
+	evaluated := parseForTest(t, `x = 1 + 2`).Defs[0].(*Assignment)
+	if !TypeStableUnderEval(evaluated.Value) {
+		t.Errorf("expected operator to be type stable")
+	}
+
+	inconsistent := &Operator{
+		Args:     [2]Expression{&String{Value: "a"}, &String{Value: "b"}},
+		Operator: '+',
+		Value:    &Int64{Value: 1},
+	}
+	if TypeStableUnderEval(inconsistent) {
+		t.Errorf("expected operator with a mismatched value not to be type stable")
+	}
+}
+
+func TestMapSetProperty(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    name: "foo",
+    // srcs comment
+    srcs: ["a.c"],
+}
+`)
+	m := file.Defs[0].(*Module)
+
+	if added := m.SetProperty("srcs", &List{Values: []Expression{&String{Value: "b.c"}}}); added {
+		t.Errorf("expected srcs to be replaced")
+	}
+	if added := m.SetProperty("enabled", &Bool{Value: true}); !added {
+		t.Errorf("expected enabled to be added")
+	}
+
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `foo {
+    name: "foo",
+    // srcs comment
+    srcs: ["b.c"],
+    enabled: true,
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestModuleProvenance(t *testing.T) {
+	file, errs := Parse("a/Android.bp", bytes.NewBufferString(`foo { name: "foo" }`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[0].(*Module)
+	if got, w := module.Provenance(), []string{"a/Android.bp"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+
+	merged := module.Copy()
+	merged.SourceFiles = []string{"a/Android.bp", "b/Android.bp"}
+	if got, w := merged.Provenance(), []string{"a/Android.bp", "b/Android.bp"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+	if got := module.Provenance(); len(got) != 1 {
+		t.Errorf("expected the original module to keep one source file, got %q", got)
+	}
+}
+
+func TestMapTakeProperty(t *testing.T) {
+	m := parseForTest(t, `
+foo {
+    name: "foo",
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+}
+`).Defs[0].(*Module)
+
+	prop, found := m.TakeProperty("srcs")
+	if !found || prop.Name != "srcs" {
+		t.Fatalf("expected to take srcs, got %v, %t", prop, found)
+	}
+	if _, found := m.GetProperty("srcs"); found || len(m.Properties) != 2 {
+		t.Errorf("expected srcs to be removed, got %s", m)
+	}
+
+	if prop, found := m.TakeProperty("missing"); found || prop != nil || len(m.Properties) != 2 {
+		t.Errorf("expected missing property not to be taken, got %v, %t", prop, found)
+	}
+
+	m.SetProperty(prop.Name, prop.Value)
+	if index, found := m.PropertyIndex("srcs"); !found || index != 2 {
+		t.Errorf("expected srcs to be added back at the end, got %d, %t", index, found)
+	}
+}
+
+func TestMapRenameProperty(t *testing.T) {
+	m := parseForTest(t, `
+foo {
+    name: "foo",
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+}
+`).Defs[0].(*Module)
+
+	if !m.RenameProperty("srcs", "arm_srcs") {
+		t.Fatalf("expected srcs to be renamed")
+	}
+	if index, found := m.PropertyIndex("arm_srcs"); !found || index != 1 {
+		t.Errorf("expected arm_srcs to stay in place, got %d, %t", index, found)
+	}
+	if _, found := m.GetProperty("srcs"); found {
+		t.Errorf("expected srcs to be gone, got %s", m)
+	}
+
+	if m.RenameProperty("missing", "other") {
+		t.Errorf("expected a missing property not to be renamed")
+	}
+	if m.RenameProperty("arm_srcs", "cflags") {
+		t.Errorf("expected renaming onto an existing property to fail")
+	}
+	if _, found := m.GetProperty("arm_srcs"); !found || len(m.Properties) != 3 {
+		t.Errorf("expected the map to be unchanged, got %s", m)
+	}
+}
+
+func TestAssociateComments(t *testing.T) {
+	file := parseForTest(t, `
+// The list of flags
+cflags = ["-Wall"]
+
+// A detached comment
+
+/* The foo library,
+   used by bar */
+cc_library {
+    name: "foo", // name
+    // The sources
+    // of foo
+    srcs: ["a.c"],
+    arch: {
+        // Only on arm
+        arm: {
+            enabled: true,
+        },
+    },
+    // Trailing comment
+}
+`)
+	comments := file.AssociateComments()
+
+	got := make(map[string]string)
+	for n, cg := range comments {
+		var name string
+		switch n := n.(type) {
+		case *Assignment:
+			name = n.Name
+		case *Module:
+			name = n.Type
+		case *Property:
+			name = n.Name
+		}
+		var text []string
+		for _, c := range cg.Comments {
+			text = append(text, c.Text())
+		}
+		got[name] = strings.Join(text, "|")
+	}
+
+	w := map[string]string{
+		"cflags":     " The list of flags\n",
+		"cc_library": " The foo library,\n   used by bar \n",
+		"srcs":       " The sources\n| of foo\n",
+		"arm":        " Only on arm\n",
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+}
+
+func TestMovePropertyContents(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    srcs: ["a.c"],
+    new_srcs: ["b.c"],
+    target: {
+        android: {
+            cflags: ["-DANDROID"],
+            enabled: true,
+        },
+        linux: {
+            cflags: ["-DLINUX"],
+            shared_libs: ["libc"],
+        },
+    },
+    mismatched: {
+        android: {
+            cflags: "-DMISMATCHED",
+        },
+    },
+    name: "foo",
+    stem: "bar",
+}
+`)
+	module := file.Defs[0].(*Module)
+
+	if moved, err := module.MovePropertyContents("srcs", "new_srcs"); !moved || err != nil {
+		t.Fatalf("expected srcs to move, got %t, %v", moved, err)
+	}
+
+	target, _ := module.GetProperty("target")
+	if moved, err := target.Value.(*Map).MovePropertyContents("linux", "android"); !moved || err != nil {
+		t.Fatalf("expected linux to move, got %t, %v", moved, err)
+	}
+
+	if moved, err := module.MovePropertyContents("name", "stem"); moved || err == nil ||
+		!strings.Contains(err.Error(), `can't move string "name" into string "stem"`) {
+		t.Errorf("expected an error moving a string, got %t, %v", moved, err)
+	}
+
+	if moved, err := module.MovePropertyContents("mismatched", "target"); moved || err == nil ||
+		!strings.Contains(err.Error(), "mismatched type in operator +: list != string") {
+		t.Errorf("expected an error moving a map with a mismatched type, got %t, %v", moved, err)
+	}
+
+	// The moved properties keep their original positions, so compare the structure rather than the
+	// printed output.
+	expected := parseForTest(t, `
+foo {
+    new_srcs: ["b.c", "a.c"],
+    target: {
+        android: {
+            cflags: ["-DANDROID"] + ["-DLINUX"],
+            enabled: true,
+            shared_libs: ["libc"],
+        },
+    },
+    mismatched: {
+        android: {
+            cflags: "-DMISMATCHED",
+        },
+    },
+    name: "foo",
+    stem: "bar",
+}
+`)
+	if equivalent, diff := FilesEquivalent(file, expected); !equivalent {
+		got, _ := Print(file)
+		t.Errorf("unexpected difference at %s, got:\n%s", diff, got)
+	}
+}
+
+func TestInt64String(t *testing.T) {
+	if got := (&Int64{Value: 42}).String(); !strings.HasPrefix(got, "42@") {
+		t.Errorf("expected the integer to print as 42, got %s", got)
+	}
+	if got := (&Int64{Value: -9223372036854775808}).String(); !strings.HasPrefix(got, "-9223372036854775808@") {
+		t.Errorf("expected the integer to print in decimal, got %s", got)
+	}
+}
@@ -0,0 +1,535 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/scanner"
+)
+
+// FilesEquivalent tells whether two Files contain the same definitions, ignoring positions and
+// comments.  If they differ, it returns the first node in a that has no equivalent in b, or nil if
+// a is a prefix of b.
+func FilesEquivalent(a, b *File) (equivalent bool, diff Node) {
+	for i, aDef := range a.Defs {
+		if i >= len(b.Defs) {
+			return false, aDef
+		}
+		if diff := definitionDifference(aDef, b.Defs[i]); diff != nil {
+			return false, diff
+		}
+	}
+	if len(b.Defs) > len(a.Defs) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func definitionDifference(a, b Definition) Node {
+	switch a := a.(type) {
+	case *Assignment:
+		b, ok := b.(*Assignment)
+		if !ok || a.Name != b.Name || a.Assigner != b.Assigner {
+			return a
+		}
+		if !Equal(a.OrigValue, b.OrigValue) {
+			return a
+		}
+	case *Module:
+		b, ok := b.(*Module)
+		if !ok || a.Type != b.Type || len(a.Properties) != len(b.Properties) {
+			return a
+		}
+		for i, prop := range a.Properties {
+			if prop.Name != b.Properties[i].Name {
+				return prop
+			}
+			if !Equal(prop.Value, b.Properties[i].Value) {
+				return prop
+			}
+		}
+	default:
+		panic(fmt.Errorf("unknown definition type %T", a))
+	}
+	return nil
+}
+
+// Equal tells whether two expressions are structurally the same, ignoring positions, comments and
+// the way literals were written.  Variables are compared by name, and evaluated values are not
+// compared, so it does not apply any simplification to the expressions before comparing them.
+func Equal(a, b Expression) bool {
+	switch a := a.(type) {
+	case *String:
+		b, ok := b.(*String)
+		return ok && a.Value == b.Value
+	case *Int64:
+		b, ok := b.(*Int64)
+		return ok && a.Value == b.Value
+	case *Float64:
+		b, ok := b.(*Float64)
+		return ok && a.Value == b.Value
+	case *Bool:
+		b, ok := b.(*Bool)
+		return ok && a.Value == b.Value
+	case *Variable:
+		b, ok := b.(*Variable)
+		return ok && a.Name == b.Name
+	case *Operator:
+		b, ok := b.(*Operator)
+		return ok && a.Operator == b.Operator && Equal(a.Args[0], b.Args[0]) && Equal(a.Args[1], b.Args[1])
+	case *InterpolatedString:
+		b, ok := b.(*InterpolatedString)
+		if !ok || len(a.Parts) != len(b.Parts) {
+			return false
+		}
+		for i := range a.Parts {
+			if !Equal(a.Parts[i], b.Parts[i]) {
+				return false
+			}
+		}
+		return true
+	case *Comparison:
+		b, ok := b.(*Comparison)
+		return ok && a.Operator == b.Operator && Equal(a.Args[0], b.Args[0]) && Equal(a.Args[1], b.Args[1])
+	case *BoolOp:
+		// The operand of a unary ! is in Args[1], so the operators match if Args[0] is nil in either.
+		b, ok := b.(*BoolOp)
+		return ok && a.Operator == b.Operator && (a.Args[0] == nil || Equal(a.Args[0], b.Args[0])) &&
+			Equal(a.Args[1], b.Args[1])
+	case *Conditional:
+		b, ok := b.(*Conditional)
+		return ok && Equal(a.Cond, b.Cond) && Equal(a.True, b.True) && Equal(a.False, b.False)
+	case *MemberAccess:
+		b, ok := b.(*MemberAccess)
+		return ok && a.Name == b.Name && Equal(a.Base, b.Base)
+	case *IndexAccess:
+		b, ok := b.(*IndexAccess)
+		return ok && Equal(a.Base, b.Base) && Equal(a.Index, b.Index)
+	case *List:
+		b, ok := b.(*List)
+		if !ok || len(a.Values) != len(b.Values) {
+			return false
+		}
+		for i := range a.Values {
+			if !Equal(a.Values[i], b.Values[i]) {
+				return false
+			}
+		}
+		return true
+	case *Map:
+		b, ok := b.(*Map)
+		return ok && propertiesEqual(a.Properties, b.Properties)
+	case *Select:
+		b, ok := b.(*Select)
+		if !ok || len(a.Conditions) != len(b.Conditions) || len(a.Cases) != len(b.Cases) {
+			return false
+		}
+		for i := range a.Conditions {
+			if !conditionsEqual(a.Conditions[i], b.Conditions[i]) {
+				return false
+			}
+		}
+		for i, c := range a.Cases {
+			d := b.Cases[i]
+			if len(c.Patterns) != len(d.Patterns) || !Equal(c.Value, d.Value) {
+				return false
+			}
+			for j := range c.Patterns {
+				if !Equal(c.Patterns[j], d.Patterns[j]) {
+					return false
+				}
+			}
+		}
+		if a.Append == nil || b.Append == nil {
+			return a.Append == nil && b.Append == nil
+		}
+		return Equal(a.Append, b.Append)
+	case *Placeholder:
+		// The replaced values are not known, so they can't be compared.
+		return false
+	case UnsetProperty:
+		_, ok := b.(UnsetProperty)
+		return ok
+	case *UnsetProperty:
+		_, ok := b.(*UnsetProperty)
+		return ok
+	case NotEvaluated:
+		_, ok := b.(NotEvaluated)
+		return ok
+	case *NotEvaluated:
+		_, ok := b.(*NotEvaluated)
+		return ok
+	default:
+		return false
+	}
+}
+
+// conditionsEqual is like ConfigurableCondition.Equals, but ignores the positions of the
+// arguments.
+func conditionsEqual(a, b ConfigurableCondition) bool {
+	if a.FunctionName != b.FunctionName || a.Negated != b.Negated || len(a.Args) != len(b.Args) {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i].Value != b.Args[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func propertiesEqual(a, b []*Property) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ChangeKind describes how a definition or property differs between two files.
+type ChangeKind int
+
+const (
+	// DefinitionAdded is a definition that is only in the new file.
+	DefinitionAdded ChangeKind = iota
+	// DefinitionRemoved is a definition that is only in the old file.
+	DefinitionRemoved
+	// DefinitionModified is an assignment whose value or assigner changed.
+	DefinitionModified
+	// PropertyAdded is a property that is only in the new version of a module.
+	PropertyAdded
+	// PropertyRemoved is a property that is only in the old version of a module.
+	PropertyRemoved
+	// PropertyChanged is a property that is in both versions of a module with different values.
+	PropertyChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case DefinitionAdded:
+		return "definition added"
+	case DefinitionRemoved:
+		return "definition removed"
+	case DefinitionModified:
+		return "definition modified"
+	case PropertyAdded:
+		return "property added"
+	case PropertyRemoved:
+		return "property removed"
+	case PropertyChanged:
+		return "property changed"
+	default:
+		panic(fmt.Errorf("Unknown change kind %d", k))
+	}
+}
+
+// A Change is a definition or module property that differs between two files.  Old and New are
+// the Definitions, or the Properties for a property change, in the old and new files.  Old is nil
+// for an added node and New is nil for a removed node.  Module is the new version of the module,
+// or the old version if New is nil, for a property change.  Pos is the position of New, or of Old
+// if New is nil.
+type Change struct {
+	Kind   ChangeKind
+	Old    Node
+	New    Node
+	Module *Module
+	Pos    scanner.Position
+}
+
+// DiffFiles returns the semantic differences between two versions of a file, ignoring positions,
+// comments and formatting.  Modules are matched by type and name and assignments by name, with
+// definitions that share a key matched in order.  A module that is in both files is reported as
+// the changes to its top level properties, compared with Equal.  Removed definitions are reported
+// first in the order of the old file, followed by the other changes in the order of the new file.
+func DiffFiles(old, new *File) []Change {
+	oldKeys := definitionKeys(old.Defs)
+	newKeys := definitionKeys(new.Defs)
+
+	oldByKey := make(map[string]Definition)
+	for i, key := range oldKeys {
+		oldByKey[key] = old.Defs[i]
+	}
+	inNew := make(map[string]bool)
+	for _, key := range newKeys {
+		inNew[key] = true
+	}
+
+	var ret []Change
+	for i, key := range oldKeys {
+		if !inNew[key] {
+			ret = append(ret, Change{Kind: DefinitionRemoved, Old: old.Defs[i], Pos: old.Defs[i].Pos()})
+		}
+	}
+
+	for i, key := range newKeys {
+		newDef := new.Defs[i]
+		oldDef, found := oldByKey[key]
+		if !found {
+			ret = append(ret, Change{Kind: DefinitionAdded, New: newDef, Pos: newDef.Pos()})
+			continue
+		}
+		switch newDef := newDef.(type) {
+		case *Assignment:
+			oldDef := oldDef.(*Assignment)
+			if oldDef.Assigner != newDef.Assigner || !Equal(oldDef.OrigValue, newDef.OrigValue) {
+				ret = append(ret, Change{Kind: DefinitionModified, Old: oldDef, New: newDef, Pos: newDef.Pos()})
+			}
+		case *Module:
+			ret = append(ret, diffModules(oldDef.(*Module), newDef)...)
+		}
+	}
+	return ret
+}
+
+func diffModules(old, new *Module) []Change {
+	var ret []Change
+	for _, oldProp := range old.Properties {
+		if _, found := new.GetProperty(oldProp.Name); !found {
+			ret = append(ret, Change{Kind: PropertyRemoved, Old: oldProp, Module: old, Pos: oldProp.Pos()})
+		}
+	}
+	for _, newProp := range new.Properties {
+		oldProp, found := old.GetProperty(newProp.Name)
+		if !found {
+			ret = append(ret, Change{Kind: PropertyAdded, New: newProp, Module: new, Pos: newProp.Pos()})
+		} else if !Equal(oldProp.Value, newProp.Value) {
+			ret = append(ret, Change{Kind: PropertyChanged, Old: oldProp, New: newProp, Module: new,
+				Pos: newProp.Pos()})
+		}
+	}
+	return ret
+}
+
+// definitionKeys returns a key for each definition that identifies it across versions of a file.
+// Repeated keys, like multiple += assignments to a variable or unnamed modules of the same type,
+// are numbered in order.
+func definitionKeys(defs []Definition) []string {
+	keys := make([]string, len(defs))
+	seen := make(map[string]int)
+	for i, def := range defs {
+		var key string
+		switch def := def.(type) {
+		case *Assignment:
+			key = "variable " + def.Name
+		case *Module:
+			key = "module " + def.Type + " " + def.Name()
+		default:
+			panic(fmt.Errorf("unknown definition type %T", def))
+		}
+		keys[i] = fmt.Sprintf("%s #%d", key, seen[key])
+		seen[key]++
+	}
+	return keys
+}
+
+// UnifiedDiff prints a and b in canonical form and returns a unified diff from the printed a to
+// the printed b, with the names of the files in its header and three lines of context around each
+// change.  The diff is empty if both files print the same, so it ignores formatting differences.
+func UnifiedDiff(a, b *File) (string, error) {
+	printedA, err := Print(a)
+	if err != nil {
+		return "", err
+	}
+	printedB, err := Print(b)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(printedA, printedB) {
+		return "", nil
+	}
+	edits := diffLines(splitLines(string(printedA)), splitLines(string(printedB)))
+	return formatUnifiedDiff(a.Name, b.Name, edits), nil
+}
+
+const diffContext = 3
+
+// A lineEdit is a line of a diff, prefixed with ' ' if it is in both files, '-' if it was removed
+// or '+' if it was added.
+type lineEdit struct {
+	kind byte
+	line string
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the edits that turn a into b, keeping the longest common subsequence of lines.
+func diffLines(a, b []string) []lineEdit {
+	var prefix, suffix []lineEdit
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, lineEdit{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, lineEdit{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	edits := prefix
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, lineEdit{' ', a[i]})
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			edits = append(edits, lineEdit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, lineEdit{'+', b[j]})
+			j++
+		}
+	}
+	for k := len(suffix) - 1; k >= 0; k-- {
+		edits = append(edits, suffix[k])
+	}
+	return edits
+}
+
+// formatUnifiedDiff formats edits as a unified diff, grouping changes that are close together
+// into the same hunk.
+func formatUnifiedDiff(nameA, nameB string, edits []lineEdit) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// lineA and lineB are the number of lines of each file before edits[k].
+	lineA, lineB := 0, 0
+	for k := 0; k < len(edits); {
+		if edits[k].kind == ' ' {
+			lineA, lineB = lineA+1, lineB+1
+			k++
+			continue
+		}
+
+		// Extend the hunk while the next change is close enough to share context.
+		start := max(k-diffContext, 0)
+		end := k
+		for next := k; next < len(edits); next++ {
+			if edits[next].kind != ' ' {
+				end = next + 1
+			} else if next-end >= 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext, len(edits))
+
+		startA, startB := lineA-(k-start), lineB-(k-start)
+		var lenA, lenB int
+		for _, e := range edits[start:end] {
+			if e.kind != '+' {
+				lenA++
+			}
+			if e.kind != '-' {
+				lenB++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(startA, lenA), hunkRange(startB, lenB))
+		for _, e := range edits[start:end] {
+			buf.WriteByte(e.kind)
+			buf.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		for _, e := range edits[k:end] {
+			if e.kind != '+' {
+				lineA++
+			}
+			if e.kind != '-' {
+				lineB++
+			}
+		}
+		k = end
+	}
+	return buf.String()
+}
+
+// hunkRange formats the range of lines of a hunk that starts after line before, where an empty
+// range is identified by the line before it.
+func hunkRange(before, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, length)
+}
+
+// CheckRoundTrip parses src, prints it, parses the printed output and verifies that the two
+// Files are equivalent.  It returns an error describing the parse failure or the first
+// definition or property that did not survive the round trip.
+func CheckRoundTrip(filename string, src []byte) error {
+	file, errs := Parse(filename, bytes.NewReader(src), NewScope(nil))
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to parse %s: %s", filename, errs[0])
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		return fmt.Errorf("failed to print %s: %s", filename, err)
+	}
+
+	reparsed, errs := Parse(filename, bytes.NewReader(printed), NewScope(nil))
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to reparse printed %s: %s\n%s", filename, errs[0], printed)
+	}
+
+	if equivalent, diff := FilesEquivalent(file, reparsed); !equivalent {
+		if diff == nil {
+			return fmt.Errorf("%s: printed output has %d definitions, expected %d",
+				filename, len(reparsed.Defs), len(file.Defs))
+		}
+		return fmt.Errorf("%s: %s changed after round trip:\n%s", diff.Pos(), describeNode(diff), printed)
+	}
+	return nil
+}
+
+func describeNode(n Node) string {
+	switch n := n.(type) {
+	case *Assignment:
+		return fmt.Sprintf("assignment to %q", n.Name)
+	case *Module:
+		return fmt.Sprintf("module %s %q", n.Type, n.Name())
+	case *Property:
+		return fmt.Sprintf("property %q", n.Name)
+	default:
+		return fmt.Sprintf("%T", n)
+	}
+}
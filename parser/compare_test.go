@@ -0,0 +1,270 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseForTest(t *testing.T, input string) *File {
+	t.Helper()
+	file, errs := Parse("", bytes.NewBufferString(input), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	return file
+}
+
+func TestCheckRoundTrip(t *testing.T) {
+	input := `
+// a comment
+cflags = ["-Wall"]
+
+cc_library {
+    name: "libfoo",
+    srcs: ["a.c", "b.c"] + select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+    cflags: cflags,
+    arch: {
+        arm: {
+            enabled: true,
+        },
+    },
+}
+`
+	if err := CheckRoundTrip("Android.bp", []byte(input)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	err := CheckRoundTrip("Android.bp", []byte("foo {"))
+	if err == nil || !strings.Contains(err.Error(), "failed to parse Android.bp") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+}
+
+func TestFilesEquivalent(t *testing.T) {
+	a := parseForTest(t, `
+foo {
+    name: "abc",
+    srcs: ["a.c"],
+}
+`)
+	reformatted := parseForTest(t, `foo {name:"abc",
+srcs:["a.c"]}`)
+	if equivalent, diff := FilesEquivalent(a, reformatted); !equivalent {
+		t.Errorf("expected reformatted file to be equivalent, got difference at %s", diff)
+	}
+
+	changed := parseForTest(t, `
+foo {
+    name: "abc",
+    srcs: ["b.c"],
+}
+`)
+	equivalent, diff := FilesEquivalent(a, changed)
+	if equivalent {
+		t.Fatalf("expected files to differ")
+	}
+	if prop, ok := diff.(*Property); !ok || prop.Name != "srcs" {
+		t.Errorf("expected the srcs property to differ, got %s", diff)
+	}
+
+	if equivalent, diff := FilesEquivalent(a, &File{}); equivalent || diff != a.Defs[0] {
+		t.Errorf("expected the missing module to differ, got %v", diff)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	testCases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{a: `"a"`, b: `"a"`, equal: true},
+		{a: `"a"`, b: `"b"`},
+		{a: `0xFF`, b: `255`, equal: true},
+		{a: `1`, b: `1.0`},
+		{a: `["a", "b"]`, b: "[\n    \"a\",\n    \"b\",\n]", equal: true},
+		{a: `["a", "b"]`, b: `["b", "a"]`},
+		{a: `{a: 1, b: [true]}`, b: `{a: 1, b: [true]}`, equal: true},
+		{a: `{a: 1, b: 2}`, b: `{b: 2, a: 1}`},
+		{a: `x + ["a"]`, b: `x + ["a"]`, equal: true},
+		{a: `x + ["a"]`, b: `y + ["a"]`},
+		{a: `["a"] + ["b"]`, b: `["a"] - ["b"]`},
+		{a: `m.a[0]`, b: `m.a[0]`, equal: true},
+		{a: `m.a[0]`, b: `m.b[0]`},
+		{
+			a:     `select(arch(), {"arm": ["a"], default: unset,})`,
+			b:     `select(arch(), {"arm": ["a"], default: unset,})`,
+			equal: true,
+		},
+		{
+			a: `select(arch(), {"arm": ["a"], default: [],})`,
+			b: `select(os(), {"arm": ["a"], default: [],})`,
+		},
+		{
+			a: `select(arch(), {"arm": ["a"], default: [],})`,
+			b: `select(arch(), {"x86": ["a"], default: [],})`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, errs := ParseExpression(bytes.NewBufferString(tt.a))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			b, errs := ParseExpression(bytes.NewBufferString(tt.b))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if got := Equal(a, b); got != tt.equal {
+				t.Errorf("expected Equal to be %t, got %t", tt.equal, got)
+			}
+			if got, _ := ExpressionsAreSame(a, b); got != tt.equal {
+				t.Errorf("expected ExpressionsAreSame to be %t, got %t", tt.equal, got)
+			}
+		})
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	old := parseForTest(t, `
+cflags = ["-Wall"]
+version = "1"
+
+cc_library {
+    name: "libfoo",
+    srcs: ["a.c"],
+    shared_libs: ["libc"],
+    arch: {
+        arm: {
+            enabled: true,
+        },
+    },
+}
+
+cc_library {
+    name: "libold",
+}
+`)
+	new := parseForTest(t, `
+cflags = [
+    "-Wall",
+]
+version = "2"
+
+cc_library {
+    name: "libfoo",
+    arch: {arm: {enabled: false}},
+    srcs: ["a.c"],
+    static_libs: ["libz"],
+}
+
+cc_binary {
+    name: "bar",
+}
+`)
+
+	var got []string
+	for _, change := range DiffFiles(old, new) {
+		var desc string
+		switch n := change.New.(type) {
+		case nil:
+			desc = describeNode(change.Old)
+		default:
+			desc = describeNode(n)
+		}
+		got = append(got, fmt.Sprintf("%s: %s %s", change.Pos, change.Kind, desc))
+	}
+	want := []string{
+		`<input>:16:1: definition removed module cc_library "libold"`,
+		`<input>:5:1: definition modified assignment to "version"`,
+		`<input>:8:5: property removed property "shared_libs"`,
+		`<input>:9:5: property changed property "arch"`,
+		`<input>:11:5: property added property "static_libs"`,
+		`<input>:14:1: definition added module cc_binary "bar"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if changes := DiffFiles(old, old); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := parseForTest(t, `
+cc_library {
+    name: "libfoo",
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+    shared_libs: ["libc"],
+    static_libs: ["libz"],
+    host_supported: true,
+}
+
+cc_binary {name: "bar"}
+`)
+	a.Name = "a/Android.bp"
+	b := parseForTest(t, `
+cc_library {
+    name: "libfoo",
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+    shared_libs: ["libc"],
+    static_libs: ["libz"],
+    host_supported: true,
+    vendor_available: true,
+}
+
+cc_binary {
+    name: "bar",
+}
+`)
+	b.Name = "b/Android.bp"
+
+	got, err := UnifiedDiff(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `--- a/Android.bp
++++ b/Android.bp
+@@ -5,6 +5,7 @@
+     shared_libs: ["libc"],
+     static_libs: ["libz"],
+     host_supported: true,
++    vendor_available: true,
+ }
+ 
+ cc_binary {
+`
+	if got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	reformatted := parseForTest(t, `cc_library {name: "libfoo", srcs: ["a.c"], cflags: ["-Wall"],
+    shared_libs: ["libc"], static_libs: ["libz"], host_supported: true}
+cc_binary {name: "bar"}`)
+	if got, err := UnifiedDiff(a, reformatted); err != nil || got != "" {
+		t.Errorf("expected an empty diff for identical files, got %q, %v", got, err)
+	}
+}
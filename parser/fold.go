@@ -0,0 +1,146 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// FoldConstants replaces every operator in the File whose operands are literals with the literal
+// it evaluates to, for example "a" + "b" with "ab", 10 - 2 with 8 or true && !false with true.
+// Operators that reference a variable anywhere in their operands are left unchanged.  It works on
+// the unevaluated tree, so the File does not need to have been parsed with ParseAndEval.
+func (f *File) FoldConstants() {
+	for _, def := range f.Defs {
+		switch def := def.(type) {
+		case *Assignment:
+			folded := foldConstants(def.OrigValue)
+			if def.Value == def.OrigValue {
+				def.Value = folded
+			}
+			def.OrigValue = folded
+		case *Module:
+			foldProperties(def.Properties)
+		}
+	}
+}
+
+func foldProperties(props []*Property) {
+	for _, prop := range props {
+		prop.Value = foldConstants(prop.Value)
+	}
+}
+
+// foldConstants folds the constant operators in value and returns the result, which may be value
+// itself.
+func foldConstants(value Expression) Expression {
+	switch v := value.(type) {
+	case *Operator:
+		v.Args[0] = foldConstants(v.Args[0])
+		v.Args[1] = foldConstants(v.Args[1])
+		if folded := foldOperator(v); folded != nil {
+			return folded
+		}
+	case *Comparison:
+		v.Args[0] = foldConstants(v.Args[0])
+		v.Args[1] = foldConstants(v.Args[1])
+	case *BoolOp:
+		if v.Args[0] != nil {
+			v.Args[0] = foldConstants(v.Args[0])
+		}
+		v.Args[1] = foldConstants(v.Args[1])
+		if folded := foldBoolOp(v); folded != nil {
+			return folded
+		}
+	case *Conditional:
+		v.Cond = foldConstants(v.Cond)
+		v.True = foldConstants(v.True)
+		v.False = foldConstants(v.False)
+	case *List:
+		for i := range v.Values {
+			v.Values[i] = foldConstants(v.Values[i])
+		}
+	case *Map:
+		foldProperties(v.Properties)
+	case *Select:
+		for _, c := range v.Cases {
+			c.Value = foldConstants(c.Value)
+		}
+		if v.Append != nil {
+			v.Append = foldConstants(v.Append)
+		}
+	case *MemberAccess:
+		v.Base = foldConstants(v.Base)
+	case *IndexAccess:
+		v.Base = foldConstants(v.Base)
+		v.Index = foldConstants(v.Index)
+	}
+	return value
+}
+
+// foldOperator returns the literal that an operator on two literals evaluates to, or nil if the
+// operands are not literals of a type that can be folded.
+func foldOperator(op *Operator) Expression {
+	pos := op.Args[0].Pos()
+	switch a := op.Args[0].(type) {
+	case *String:
+		if b, ok := op.Args[1].(*String); ok && op.Operator == '+' {
+			return &String{LiteralPos: pos, Value: a.Value + b.Value}
+		}
+	case *Int64:
+		if b, ok := op.Args[1].(*Int64); ok {
+			// Leave operators that overflow for the parser to report.
+			switch op.Operator {
+			case '+':
+				if sum, ok := addInt64(a.Value, b.Value); ok {
+					return &Int64{LiteralPos: pos, Value: sum}
+				}
+			case '-':
+				if difference, ok := subtractInt64(a.Value, b.Value); ok {
+					return &Int64{LiteralPos: pos, Value: difference}
+				}
+			}
+		}
+	case *Float64:
+		if b, ok := op.Args[1].(*Float64); ok {
+			switch op.Operator {
+			case '+':
+				return &Float64{LiteralPos: pos, Value: a.Value + b.Value}
+			case '-':
+				return &Float64{LiteralPos: pos, Value: a.Value - b.Value}
+			}
+		}
+	}
+	return nil
+}
+
+// foldBoolOp returns the literal that a bool operator on bool literals evaluates to, or nil if the
+// operands are not all bool literals.
+func foldBoolOp(op *BoolOp) Expression {
+	b, ok := op.Args[1].(*Bool)
+	if !ok {
+		return nil
+	}
+	if op.Operator == "!" {
+		return &Bool{LiteralPos: op.OperatorPos, Value: !b.Value}
+	}
+	a, ok := op.Args[0].(*Bool)
+	if !ok {
+		return nil
+	}
+	switch op.Operator {
+	case "&&":
+		return &Bool{LiteralPos: a.LiteralPos, Value: a.Value && b.Value}
+	case "||":
+		return &Bool{LiteralPos: a.LiteralPos, Value: a.Value || b.Value}
+	}
+	return nil
+}
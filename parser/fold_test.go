@@ -0,0 +1,99 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+)
+
+func TestFoldConstants(t *testing.T) {
+	file := parseForTest(t, `
+prefix = "lib"
+count = 1 + 2 - 4
+foo {
+    name: "foo" + "_" + "bar",
+    stem: prefix + "foo",
+    ratio: 0.5 + 0.25,
+    sizes: [1 + 1, count + 1],
+    enabled: true && !false,
+    host: true || host_default,
+    arch: {
+        arm: {
+            suffix: "_" + "arm",
+        },
+    },
+}
+`)
+	file.FoldConstants()
+
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `prefix = "lib"
+count = -1
+foo {
+    name: "foo_bar",
+    stem: prefix + "foo",
+    ratio: 0.75,
+    sizes: [
+        2,
+        count + 1,
+    ],
+    enabled: true,
+    host: true || host_default,
+    arch: {
+        arm: {
+            suffix: "_arm",
+        },
+    },
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestFoldBoolOps(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "true && false", expected: "false"},
+		{input: "true && true", expected: "true"},
+		{input: "false || true", expected: "true"},
+		{input: "false || false", expected: "false"},
+		{input: "!false", expected: "true"},
+		{input: "!true", expected: "false"},
+		// Operators that reference a variable are not folded, even if the result is known.
+		{input: "false && x", expected: "false && x"},
+		{input: "true || x", expected: "true || x"},
+		{input: "!x", expected: "!x"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			file := parseForTest(t, "y = "+tt.input+"\n")
+			file.FoldConstants()
+			got, err := PrintExpression(file.Defs[0].(*Assignment).OrigValue)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != tt.expected+"\n" {
+				t.Errorf("expected %q, got %q", tt.expected+"\n", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+)
+
+// ContentHash returns a stable hash of the definitions in the File.  The hash is computed over the
+// canonical printed form of the File with all positions and comments removed, so reformatting does
+// not change the hash, but any change to a definition does.  Comments are ignored: adding, removing
+// or changing a comment never changes the hash.  Use ContentHashWithOptions to include them.
+func (f *File) ContentHash() (string, error) {
+	return f.ContentHashWithOptions(ContentHashOptions{})
+}
+
+// ContentHashOptions controls optional behaviors of ContentHashWithOptions.
+type ContentHashOptions struct {
+	// IncludeComments adds the text of every comment in the File, in order, to the hash, so
+	// that adding, removing or changing a comment changes the hash.  Moving a comment without
+	// changing its text or its order relative to the other comments does not.
+	IncludeComments bool
+}
+
+// ContentHashWithOptions returns a stable hash of the definitions in the File, the same as
+// ContentHash, with the behaviors selected by opts.
+func (f *File) ContentHashWithOptions(opts ContentHashOptions) (string, error) {
+	stripped := &File{
+		Name: f.Name,
+		Defs: make([]Definition, len(f.Defs)),
+	}
+	for i, def := range f.Defs {
+		stripped.Defs[i] = stripDefinitionPositions(def)
+	}
+
+	printed, err := Print(stripped)
+	if err != nil {
+		return "", err
+	}
+
+	h := fingerprinter{sha256.New()}
+	h.Write(printed)
+	if opts.IncludeComments {
+		for _, group := range f.Comments {
+			for _, comment := range group.Comments {
+				h.string(comment.Text())
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Fingerprint returns a stable hash of an expression, computed from the expression tree without
+// printing it.  Two expressions have the same fingerprint if Equal reports that they are the same,
+// so positions, comments and the way literals were written do not change it.  It can be used as a
+// map key to find identical values.  It returns an error for a Placeholder, whose value is not
+// known.
+func Fingerprint(e Expression) (string, error) {
+	f := fingerprinter{sha256.New()}
+	if err := f.expression(e); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(f.Sum(nil)), nil
+}
+
+// fingerprinter writes an encoding of an expression tree to a hash in which the type of every node
+// is written before its contents, and every string and slice is preceded by its length, so that
+// different trees can't have the same encoding.
+type fingerprinter struct {
+	hash.Hash
+}
+
+func (f fingerprinter) uint(v uint64) {
+	f.Write(binary.AppendUvarint(nil, v))
+}
+
+func (f fingerprinter) string(s string) {
+	f.uint(uint64(len(s)))
+	f.Write([]byte(s))
+}
+
+func (f fingerprinter) bool(b bool) {
+	if b {
+		f.uint(1)
+	} else {
+		f.uint(0)
+	}
+}
+
+func (f fingerprinter) expressions(values ...Expression) error {
+	for _, value := range values {
+		if err := f.expression(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f fingerprinter) expression(e Expression) error {
+	switch v := e.(type) {
+	case *String:
+		f.string("string")
+		f.string(v.Value)
+	case *Int64:
+		f.string("int64")
+		f.uint(uint64(v.Value))
+	case *Float64:
+		f.string("float64")
+		value := v.Value
+		if value == 0 {
+			// Equal treats -0 and 0 as the same.
+			value = 0
+		}
+		f.uint(math.Float64bits(value))
+	case *Bool:
+		f.string("bool")
+		f.bool(v.Value)
+	case *Variable:
+		f.string("variable")
+		f.string(v.Name)
+	case *InterpolatedString:
+		f.string("interpolated")
+		f.uint(uint64(len(v.Parts)))
+		return f.expressions(v.Parts...)
+	case *Operator:
+		f.string("operator")
+		f.uint(uint64(v.Operator))
+		return f.expressions(v.Args[0], v.Args[1])
+	case *Comparison:
+		f.string("comparison")
+		f.string(v.Operator)
+		return f.expressions(v.Args[0], v.Args[1])
+	case *BoolOp:
+		f.string("boolop")
+		f.string(v.Operator)
+		if v.Args[0] != nil {
+			if err := f.expression(v.Args[0]); err != nil {
+				return err
+			}
+		}
+		return f.expression(v.Args[1])
+	case *Conditional:
+		f.string("conditional")
+		return f.expressions(v.Cond, v.True, v.False)
+	case *MemberAccess:
+		f.string("member")
+		f.string(v.Name)
+		return f.expression(v.Base)
+	case *IndexAccess:
+		f.string("index")
+		return f.expressions(v.Base, v.Index)
+	case *List:
+		f.string("list")
+		f.uint(uint64(len(v.Values)))
+		return f.expressions(v.Values...)
+	case *Map:
+		f.string("map")
+		f.uint(uint64(len(v.Properties)))
+		for _, prop := range v.Properties {
+			f.string(prop.Name)
+			if err := f.expression(prop.Value); err != nil {
+				return err
+			}
+		}
+	case *Select:
+		f.string("select")
+		f.uint(uint64(len(v.Conditions)))
+		for _, c := range v.Conditions {
+			f.string(c.FunctionName)
+			f.bool(c.Negated)
+			f.uint(uint64(len(c.Args)))
+			for _, arg := range c.Args {
+				f.string(arg.Value)
+			}
+		}
+		f.uint(uint64(len(v.Cases)))
+		for _, c := range v.Cases {
+			f.uint(uint64(len(c.Patterns)))
+			if err := f.expressions(c.Patterns...); err != nil {
+				return err
+			}
+			if err := f.expression(c.Value); err != nil {
+				return err
+			}
+		}
+		f.bool(v.Append != nil)
+		if v.Append != nil {
+			return f.expression(v.Append)
+		}
+	case UnsetProperty, *UnsetProperty:
+		f.string("unset")
+	case NotEvaluated, *NotEvaluated:
+		f.string("notevaluated")
+	case *Placeholder:
+		return fmt.Errorf("cannot fingerprint a placeholder for a %s value", v.ValueType)
+	default:
+		return fmt.Errorf("cannot fingerprint expression type %T", e)
+	}
+	return nil
+}
+
+func stripDefinitionPositions(def Definition) Definition {
+	switch def := def.(type) {
+	case *Assignment:
+		value := stripPositions(def.OrigValue)
+		return &Assignment{
+			Name:      def.Name,
+			Value:     value,
+			OrigValue: value,
+			Assigner:  def.Assigner,
+		}
+	case *Module:
+		return &Module{
+			Type: def.Type,
+			Map:  *stripPositions(&def.Map).(*Map),
+		}
+	default:
+		panic(fmt.Errorf("unknown definition type %T", def))
+	}
+}
+
+// stripPositions returns a deep copy of an unevaluated expression with all positions cleared.
+func stripPositions(value Expression) Expression {
+	switch v := value.(type) {
+	case *Variable:
+		return &Variable{Name: v.Name, Value: v.Value}
+	case *InterpolatedString:
+		ret := &InterpolatedString{Parts: make([]Expression, len(v.Parts)), Raw: v.Raw, Value: v.Value}
+		for i, part := range v.Parts {
+			ret.Parts[i] = stripPositions(part)
+		}
+		return ret
+	case *MemberAccess:
+		return &MemberAccess{Base: stripPositions(v.Base), Name: v.Name, Value: v.Value}
+	case *IndexAccess:
+		return &IndexAccess{Base: stripPositions(v.Base), Index: stripPositions(v.Index), Value: v.Value}
+	case *Operator:
+		return &Operator{
+			Args:     [2]Expression{stripPositions(v.Args[0]), stripPositions(v.Args[1])},
+			Operator: v.Operator,
+			Value:    v.Value,
+		}
+	case *Comparison:
+		return &Comparison{
+			Args:     [2]Expression{stripPositions(v.Args[0]), stripPositions(v.Args[1])},
+			Operator: v.Operator,
+			Value:    v.Value,
+		}
+	case *BoolOp:
+		ret := &BoolOp{
+			Args:     [2]Expression{nil, stripPositions(v.Args[1])},
+			Operator: v.Operator,
+			Value:    v.Value,
+		}
+		if v.Args[0] != nil {
+			ret.Args[0] = stripPositions(v.Args[0])
+		}
+		return ret
+	case *Conditional:
+		return &Conditional{
+			Cond:  stripPositions(v.Cond),
+			True:  stripPositions(v.True),
+			False: stripPositions(v.False),
+			Value: v.Value,
+		}
+	case *Bool:
+		return &Bool{Value: v.Value}
+	case *Int64:
+		return &Int64{Value: v.Value}
+	case *Float64:
+		return &Float64{Value: v.Value}
+	case *String:
+		return &String{Value: v.Value}
+	case *List:
+		ret := &List{Values: make([]Expression, len(v.Values))}
+		for i, value := range v.Values {
+			ret.Values[i] = stripPositions(value)
+		}
+		return ret
+	case *Map:
+		ret := &Map{Properties: make([]*Property, len(v.Properties))}
+		for i, prop := range v.Properties {
+			ret.Properties[i] = &Property{
+				Name:  prop.Name,
+				Value: stripPositions(prop.Value),
+			}
+		}
+		return ret
+	case *Select:
+		ret := &Select{
+			Conditions:     make([]ConfigurableCondition, len(v.Conditions)),
+			Cases:          make([]*SelectCase, len(v.Cases)),
+			ExpressionType: v.ExpressionType,
+		}
+		for i, c := range v.Conditions {
+			ret.Conditions[i] = ConfigurableCondition{
+				FunctionName: c.FunctionName,
+				Args:         make([]String, len(c.Args)),
+				Negated:      c.Negated,
+			}
+			for j, arg := range c.Args {
+				ret.Conditions[i].Args[j] = String{Value: arg.Value}
+			}
+		}
+		for i, c := range v.Cases {
+			ret.Cases[i] = &SelectCase{
+				Patterns: make([]Expression, len(c.Patterns)),
+				Value:    stripPositions(c.Value),
+			}
+			for j, pattern := range c.Patterns {
+				ret.Cases[i].Patterns[j] = stripPositions(pattern)
+			}
+		}
+		if v.Append != nil {
+			ret.Append = stripPositions(v.Append)
+		}
+		return ret
+	case *Placeholder:
+		return &Placeholder{ValueType: v.ValueType}
+	case UnsetProperty:
+		return UnsetProperty{}
+	case NotEvaluated:
+		return NotEvaluated{}
+	default:
+		panic(fmt.Errorf("unknown expression type %T", value))
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileContentHash(t *testing.T) {
+	hash := func(input string) string {
+		t.Helper()
+		h, err := parseForTest(t, input).ContentHash()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return h
+	}
+
+	original := hash(`
+cflags = ["-Wall"]
+foo {
+    name: "abc",
+    srcs: ["a.c"],
+    cflags: cflags + select(arch(), {
+        "arm": ["-DARM"],
+        default: [],
+    }),
+}
+`)
+	reformatted := hash(`
+// A comment that doesn't affect the hash
+cflags = [
+    "-Wall",
+]
+
+foo { name: "abc", srcs: [
+        "a.c",
+    ],
+    cflags: cflags +
+        select(arch(), { "arm": ["-DARM"], default: [], }),
+}
+`)
+	changed := hash(`
+cflags = ["-Wall"]
+foo {
+    name: "abc",
+    srcs: ["b.c"],
+    cflags: cflags + select(arch(), {
+        "arm": ["-DARM"],
+        default: [],
+    }),
+}
+`)
+
+	if original != reformatted {
+		t.Errorf("expected reformatting not to change the hash")
+	}
+	if original == changed {
+		t.Errorf("expected changing a value to change the hash")
+	}
+}
+
+func TestFileContentHashComments(t *testing.T) {
+	hash := func(input string, opts ContentHashOptions) string {
+		t.Helper()
+		h, err := parseForTest(t, input).ContentHashWithOptions(opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return h
+	}
+
+	original := `
+// Build the foo module
+foo {
+    name: "abc", // the name
+}
+`
+	edited := `
+// Build the foo module
+foo {
+    name: "abc", // the new name
+}
+`
+	reformatted := `
+// Build the foo module
+foo { name: "abc", // the name
+}
+`
+
+	withoutComments := ContentHashOptions{}
+	if hash(original, withoutComments) != hash(edited, withoutComments) {
+		t.Errorf("expected editing a comment not to change the hash without IncludeComments")
+	}
+
+	withComments := ContentHashOptions{IncludeComments: true}
+	if hash(original, withComments) == hash(edited, withComments) {
+		t.Errorf("expected editing a comment to change the hash with IncludeComments")
+	}
+	if hash(original, withComments) != hash(reformatted, withComments) {
+		t.Errorf("expected reformatting not to change the hash with IncludeComments")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		same bool
+	}{
+		{a: `"a"`, b: `"a"`, same: true},
+		{a: `"a"`, b: `"b"`},
+		{a: `0xFF`, b: `255`, same: true},
+		{a: `1`, b: `1.0`},
+		{a: `["a", "b"]`, b: "[\n    // comment\n    \"a\",\n    \"b\",\n]", same: true},
+		{a: `["a", "b"]`, b: `["b", "a"]`},
+		{a: `["ab"]`, b: `["a", "b"]`},
+		{a: `{a: 1, b: [true]}`, b: `{a: 1, b: [true]}`, same: true},
+		{a: `{a: 1, b: 2}`, b: `{b: 2, a: 1}`},
+		{a: `x + ["a"]`, b: `x + ["a"]`, same: true},
+		{a: `x + ["a"]`, b: `y + ["a"]`},
+		{a: `!x && y`, b: `!x && y`, same: true},
+		{a: `!x && y`, b: `x && !y`},
+		{
+			a:    `select(arch(), {"arm": ["a"], default: unset,})`,
+			b:    `select(arch(), {"arm": ["a"], default: unset,})`,
+			same: true,
+		},
+		{
+			a: `select(arch(), {"arm": ["a"], default: [],})`,
+			b: `select(os(), {"arm": ["a"], default: [],})`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, errs := ParseExpression(bytes.NewBufferString(tt.a))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			b, errs := ParseExpression(bytes.NewBufferString(tt.b))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			fa, err := Fingerprint(a)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fb, err := Fingerprint(b)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := fa == fb; got != tt.same {
+				t.Errorf("expected fingerprints to be the same: %t, got %s and %s", tt.same, fa, fb)
+			}
+			if got := Equal(a, b); got != tt.same {
+				t.Errorf("expected Equal to be %t, got %t", tt.same, got)
+			}
+		})
+	}
+
+	if _, err := Fingerprint(&Placeholder{ValueType: StringType}); err == nil {
+		t.Errorf("expected an error for a placeholder")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// MarshalJSON returns the modules of an evaluated File as a JSON array with one object per module
+// in source order.  Each object has a single key, the module type, whose value is an object with
+// the evaluated properties of the module in source order.  Variables and operators are replaced
+// by their values.  A select is not resolved, it is written as an object with a single "$select"
+// key holding its conditions, its cases and any value appended to it, so a value added before a
+// select is written as a select with no conditions and one case.  In the cases a default pattern
+// is written as null, and so is an unset value.
+func MarshalJSON(file *File) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	first := true
+	for _, def := range file.Defs {
+		module, ok := def.(*Module)
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.WriteByte('{')
+		writeJSONString(&buf, module.Type)
+		buf.WriteByte(':')
+		if err := marshalJSONProperties(&buf, module.Properties); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+func marshalJSONProperties(buf *bytes.Buffer, props []*Property) error {
+	buf.WriteByte('{')
+	for i, prop := range props {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, prop.Name)
+		buf.WriteByte(':')
+		if err := marshalJSONValue(buf, prop.Value); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func marshalJSONValue(buf *bytes.Buffer, value Expression) error {
+	switch v := value.Eval().(type) {
+	case *String:
+		writeJSONString(buf, v.Value)
+	case *Bool:
+		buf.WriteString(strconv.FormatBool(v.Value))
+	case *Int64:
+		buf.WriteString(strconv.FormatInt(v.Value, 10))
+	case *Float64:
+		encoded, err := json.Marshal(v.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", v.Pos(), err)
+		}
+		buf.Write(encoded)
+	case *List:
+		buf.WriteByte('[')
+		for i, elem := range v.Values {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := marshalJSONValue(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case *Map:
+		return marshalJSONProperties(buf, v.Properties)
+	case *Select:
+		return marshalJSONSelect(buf, v)
+	case UnsetProperty:
+		buf.WriteString("null")
+	default:
+		return fmt.Errorf("%s: cannot marshal %s of type %s to JSON", value.Pos(), value, value.Type())
+	}
+	return nil
+}
+
+func marshalJSONSelect(buf *bytes.Buffer, s *Select) error {
+	buf.WriteString(`{"$select":{"conditions":[`)
+	for i, cond := range s.Conditions {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"function":`)
+		writeJSONString(buf, cond.FunctionName)
+		buf.WriteString(`,"args":[`)
+		for j, arg := range cond.Args {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, arg.Value)
+		}
+		buf.WriteByte(']')
+		if cond.Negated {
+			buf.WriteString(`,"negated":true`)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString(`],"cases":[`)
+	for i, c := range s.Cases {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"patterns":[`)
+		for j, pattern := range c.Patterns {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			if isDefaultPattern(pattern) {
+				buf.WriteString("null")
+			} else if err := marshalJSONValue(buf, pattern); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(`],"value":`)
+		if err := marshalJSONValue(buf, c.Value); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(']')
+	if s.Append != nil {
+		buf.WriteString(`,"append":`)
+		if err := marshalJSONValue(buf, s.Append); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("}}")
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	// Marshaling a string can't fail.
+	encoded, _ := json.Marshal(s)
+	buf.Write(encoded)
+}
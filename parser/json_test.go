@@ -0,0 +1,97 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	file, errs := ParseAndEval("", strings.NewReader(`
+common_cflags = ["-Wall"]
+version = 3
+
+cc_library {
+    name: "libfoo",
+    cflags: common_cflags + ["-O2"],
+    version: version + 1,
+    enabled: true,
+    arch: {
+        arm: {
+            srcs: ["arm.c"],
+        },
+    },
+    srcs: ["foo.c"] + select((arch(), !release_flag("RELEASE_FOO")), {
+        ("arm", true): ["arm.c"],
+        (default, default): unset,
+    }),
+}
+
+cc_defaults {
+    name: "defaults",
+}
+`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	got, err := MarshalJSON(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !json.Valid(got) {
+		t.Fatalf("invalid JSON: %s", got)
+	}
+	expected := `[
+  {
+    "cc_library": {
+      "name": "libfoo",
+      "cflags": ["-Wall", "-O2"],
+      "version": 4,
+      "enabled": true,
+      "arch": {"arm": {"srcs": ["arm.c"]}},
+      "srcs": {
+        "$select": {
+          "conditions": [],
+          "cases": [{"patterns": [], "value": ["foo.c"]}],
+          "append": {
+            "$select": {
+              "conditions": [
+                {"function": "arch", "args": []},
+                {"function": "release_flag", "args": ["RELEASE_FOO"], "negated": true}
+              ],
+              "cases": [
+                {"patterns": ["arm", true], "value": ["arm.c"]},
+                {"patterns": [null, null], "value": null}
+              ]
+            }
+          }
+        }
+      }
+    }
+  },
+  {"cc_defaults": {"name": "defaults"}}
+]`
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(expected)); err != nil {
+		t.Fatalf("invalid expected JSON: %s", err)
+	}
+	if string(got) != compacted.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", compacted.String(), got)
+	}
+}
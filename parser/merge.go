@@ -0,0 +1,223 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"text/scanner"
+)
+
+// MergeFiles combines the definitions and comments of files, in order, into a single File.  It
+// returns errors for a variable that is assigned with = more than once and for modules with the
+// same name, whether they are in the same file or in different files.
+//
+// The input files are not modified.  The positions in each file after the first are moved after
+// the end of the previous files so that the merged File prints in order, but keep the name of the
+// file they came from.  The SourceFiles of each named module are set to the file that defines it
+// followed by the other files that assign the variables it references, directly or indirectly.
+func MergeFiles(files ...*File) (*File, []error) {
+	var errs []error
+	assignments := make(map[string]*Assignment)
+	modules := make(map[string]*Module)
+	for _, file := range files {
+		for _, def := range file.Defs {
+			switch def := def.(type) {
+			case *Assignment:
+				if def.Assigner != "=" {
+					continue
+				}
+				if prev, exists := assignments[def.Name]; exists {
+					errs = append(errs, &ParseError{
+						Err: fmt.Errorf("variable %q is already assigned at %s", def.Name, prev.NamePos),
+						Pos: def.NamePos,
+					})
+					continue
+				}
+				assignments[def.Name] = def
+			case *Module:
+				name := def.Name()
+				if name == "" {
+					continue
+				}
+				if prev, exists := modules[name]; exists {
+					errs = append(errs, &ParseError{
+						Err: fmt.Errorf("module %q is already defined at %s", name, prev.TypePos),
+						Pos: def.TypePos,
+					})
+					continue
+				}
+				modules[name] = def
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	merged := &File{}
+	if len(files) > 0 {
+		merged.Name = files[0].Name
+	}
+	var endLine, endOffset int
+	for i, file := range files {
+		copied := copyFile(file)
+		if i > 0 {
+			// Leave a blank line between the definitions of each file.
+			lines, offset := endLine+1, endOffset+2
+			shift := func(pos scanner.Position) scanner.Position {
+				pos.Line += lines
+				pos.Offset += offset
+				return pos
+			}
+			remapPositions(copied, shift)
+			for _, cg := range copied.Comments {
+				for _, c := range cg.Comments {
+					c.Slash = shift(c.Slash)
+				}
+			}
+		}
+
+		for _, def := range copied.Defs {
+			if end := def.End(); end.Offset > endOffset {
+				endLine, endOffset = end.Line, end.Offset
+			}
+		}
+		for _, cg := range copied.Comments {
+			if end := cg.End(); end.Offset > endOffset {
+				endLine, endOffset = end.Line, end.Offset
+			}
+		}
+
+		merged.Defs = append(merged.Defs, copied.Defs...)
+		merged.Comments = append(merged.Comments, copied.Comments...)
+		merged.Warnings = append(merged.Warnings, copied.Warnings...)
+	}
+
+	for _, def := range merged.Defs {
+		module, ok := def.(*Module)
+		if !ok || module.Name() == "" {
+			continue
+		}
+		module.SourceFiles = []string{module.TypePos.Filename}
+		referenced := merged.referencedDefinitions([]*Module{module})
+		for _, other := range merged.Defs {
+			filename := other.Pos().Filename
+			if referenced[other] && !slices.Contains(module.SourceFiles, filename) {
+				module.SourceFiles = append(module.SourceFiles, filename)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// SplitByModule returns a File for each named module in f, keyed by the module name.  Each File
+// holds a copy of the module and of the assignments to the variables it references directly or
+// indirectly, in source order, along with the comments before or inside them.  Modules without a
+// name are left out, and if more than one module has the same name the last one is used.
+func (f *File) SplitByModule() map[string]*File {
+	ret := make(map[string]*File)
+	for _, def := range f.Defs {
+		module, ok := def.(*Module)
+		if !ok || module.Name() == "" {
+			continue
+		}
+		copied := copyFile(f.subset([]*Module{module}))
+
+		// Move the positions up so that the first definition or comment is on the first line.
+		start := copied.Defs[0].Pos()
+		if len(copied.Comments) > 0 && copied.Comments[0].Pos().Offset < start.Offset {
+			start = copied.Comments[0].Pos()
+		}
+		shift := func(pos scanner.Position) scanner.Position {
+			pos.Line -= start.Line - 1
+			pos.Offset -= start.Offset
+			return pos
+		}
+		remapPositions(copied, shift)
+		for _, cg := range copied.Comments {
+			for _, c := range cg.Comments {
+				c.Slash = shift(c.Slash)
+			}
+		}
+		ret[module.Name()] = copied
+	}
+	return ret
+}
+
+// copyFile returns a copy of the definitions and comments of a File that can be modified without
+// affecting the original.
+func copyFile(f *File) *File {
+	ret := &File{
+		Name:     f.Name,
+		Defs:     make([]Definition, len(f.Defs)),
+		Comments: make([]*CommentGroup, len(f.Comments)),
+		Warnings: f.Warnings,
+	}
+	for i, def := range f.Defs {
+		switch def := def.(type) {
+		case *Assignment:
+			ret.Defs[i] = def.copy()
+		case *Module:
+			ret.Defs[i] = def.Copy()
+		default:
+			panic(fmt.Errorf("unknown definition type %T", def))
+		}
+	}
+	copiedGroups := make(map[*CommentGroup]*CommentGroup, len(f.Comments))
+	for i, cg := range f.Comments {
+		comments := make([]*Comment, len(cg.Comments))
+		for j, c := range cg.Comments {
+			copied := *c
+			comments[j] = &copied
+		}
+		ret.Comments[i] = &CommentGroup{Comments: comments, attached: cg.attached}
+		copiedGroups[cg] = ret.Comments[i]
+	}
+	// Nodes share their comment groups with the file, point them at the copies.
+	copyGroups := func(groups []*CommentGroup) []*CommentGroup {
+		if len(groups) == 0 {
+			return groups
+		}
+		comments := make([]*CommentGroup, len(groups))
+		for i, cg := range groups {
+			if copied, ok := copiedGroups[cg]; ok {
+				comments[i] = copied
+			} else {
+				comments[i] = cg
+			}
+		}
+		return comments
+	}
+	Walk(ret, func(n Node) bool {
+		switch n := n.(type) {
+		case *Operator:
+			n.Comments = copyGroups(n.Comments)
+		case *Property:
+			n.Comments = copyGroups(n.Comments)
+		case *Module:
+			n.TrailingComments = copyGroups(n.TrailingComments)
+		case *Map:
+			n.TrailingComments = copyGroups(n.TrailingComments)
+		case *List:
+			for i, comments := range n.ValueComments {
+				n.ValueComments[i] = copyGroups(comments)
+			}
+			n.TrailingComments = copyGroups(n.TrailingComments)
+		}
+		return true
+	})
+	return ret
+}
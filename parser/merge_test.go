@@ -0,0 +1,239 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMergeFiles(t *testing.T) {
+	parse := func(filename, input string) *File {
+		file, errs := Parse(filename, bytes.NewBufferString(input), NewScope(nil))
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return file
+	}
+	a := parse("a.bp", `
+// Common flags
+cflags = ["-Wall"]
+
+foo {
+    name: "foo",
+    srcs: select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+}
+`)
+	b := parse("b.bp", `// From b
+ldflags = ["-s"]
+bar {
+    name: "bar", // bar
+}
+`)
+	origA, _ := Print(a)
+
+	merged, errs := MergeFiles(a, b)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	got, err := Print(merged)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `// Common flags
+cflags = ["-Wall"]
+
+foo {
+    name: "foo",
+    srcs: select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+}
+
+// From b
+ldflags = ["-s"]
+bar {
+    name: "bar", // bar
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+	if bar := merged.Defs[3].(*Module); bar.TypePos.Filename != "b.bp" {
+		t.Errorf("expected bar to keep its file name, got %s", bar.TypePos)
+	}
+	for i, w := range map[int]string{1: "a.bp", 3: "b.bp"} {
+		if got := merged.Defs[i].(*Module).Provenance(); !reflect.DeepEqual(got, []string{w}) {
+			t.Errorf("expected the provenance of %s to be %q, got %q", merged.Defs[i].(*Module).Name(), w, got)
+		}
+	}
+	if printed, _ := Print(a); !reflect.DeepEqual(printed, origA) {
+		t.Errorf("expected the input file to be unchanged, got:\n%s", printed)
+	}
+
+	c := parse("c.bp", `
+cflags = ["-O2"]
+foo {
+    name: "foo",
+}
+`)
+	_, errs = MergeFiles(a, b, c)
+	var gotErrs []string
+	for _, err := range errs {
+		gotErrs = append(gotErrs, err.Error())
+	}
+	w := []string{
+		`c.bp:2:1: variable "cflags" is already assigned at a.bp:3:1`,
+		`c.bp:3:1: module "foo" is already defined at a.bp:5:1`,
+	}
+	if !reflect.DeepEqual(gotErrs, w) {
+		t.Errorf("expected errors %q, got %q", w, gotErrs)
+	}
+
+	d := parse("d.bp", `
+baz {
+    name: "baz",
+}
+baz {
+    name: "baz",
+}
+`)
+	_, errs = MergeFiles(d)
+	gotErrs = nil
+	for _, err := range errs {
+		gotErrs = append(gotErrs, err.Error())
+	}
+	w = []string{`d.bp:5:1: module "baz" is already defined at d.bp:2:1`}
+	if !reflect.DeepEqual(gotErrs, w) {
+		t.Errorf("expected errors %q, got %q", w, gotErrs)
+	}
+}
+
+func TestMergeFilesProvenance(t *testing.T) {
+	parse := func(filename, input string) *File {
+		file, errs := Parse(filename, bytes.NewBufferString(input), NewScope(nil))
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return file
+	}
+	a := parse("a.bp", `
+common_cflags = ["-Wall"]
+foo {
+    name: "foo",
+}
+`)
+	b := parse("b.bp", `
+cflags = common_cflags + ["-DBAR"]
+`)
+	c := parse("c.bp", `
+bar {
+    name: "bar",
+    cflags: cflags,
+}
+`)
+
+	merged, errs := MergeFiles(a, b, c)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for i, w := range map[int][]string{1: {"a.bp"}, 3: {"c.bp", "a.bp", "b.bp"}} {
+		module := merged.Defs[i].(*Module)
+		if got := module.Provenance(); !reflect.DeepEqual(got, w) {
+			t.Errorf("expected the provenance of %s to be %q, got %q", module.Name(), w, got)
+		}
+	}
+	if got := c.Defs[0].(*Module).Provenance(); !reflect.DeepEqual(got, []string{"c.bp"}) {
+		t.Errorf("expected the input module to keep one source file, got %q", got)
+	}
+}
+
+func TestSplitByModule(t *testing.T) {
+	file := parseForTest(t, `
+common_cflags = ["-Wall"]
+foo_cflags = common_cflags + ["-DFOO"]
+bar_srcs = ["bar.c"]
+
+// The foo library
+cc_library {
+    name: "libfoo",
+    cflags: foo_cflags,
+}
+
+cc_binary {
+    name: "bar",
+    srcs: bar_srcs,
+}
+
+cc_defaults {
+    name: "defaults",
+}
+`)
+	split := file.SplitByModule()
+	if len(split) != 3 {
+		t.Errorf("expected 3 files, got %d", len(split))
+	}
+
+	expected := map[string]string{
+		"libfoo": `common_cflags = ["-Wall"]
+foo_cflags = common_cflags + ["-DFOO"]
+
+// The foo library
+cc_library {
+    name: "libfoo",
+    cflags: foo_cflags,
+}
+`,
+		"bar": `bar_srcs = ["bar.c"]
+
+cc_binary {
+    name: "bar",
+    srcs: bar_srcs,
+}
+`,
+		"defaults": `cc_defaults {
+    name: "defaults",
+}
+`,
+	}
+	for name, want := range expected {
+		f, ok := split[name]
+		if !ok {
+			t.Errorf("missing file for %q", name)
+			continue
+		}
+		printed, err := Print(f)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if string(printed) != want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", name, want, printed)
+		}
+		if _, errs := ParseAndEval(name, bytes.NewReader(printed), NewScope(nil)); len(errs) != 0 {
+			t.Errorf("%s: split file does not reparse: %v", name, errs)
+		}
+	}
+
+	// The split files are copies.
+	split["libfoo"].Defs[0].(*Assignment).Name = "changed"
+	if name := file.Defs[0].(*Assignment).Name; name != "common_cflags" {
+		t.Errorf("expected the original file to be unchanged, got %q", name)
+	}
+}
@@ -48,7 +48,7 @@ func RemoveStringFromList(list *List, s string) (modified bool) {
 		}
 
 		if sv, ok := v.(*String); ok && sv.Value == s {
-			list.Values = append(list.Values[:i], list.Values[i+1:]...)
+			list.removeValue(i)
 			return true
 		}
 	}
@@ -56,6 +56,38 @@ func RemoveStringFromList(list *List, s string) (modified bool) {
 	return false
 }
 
+// Append adds values to the end of the list.  Their positions are not changed, so values without
+// positions print after the last element.
+func (x *List) Append(values ...Expression) {
+	x.Values = append(x.Values, values...)
+}
+
+// RemoveMatching removes every value of the list for which pred returns true, along with the
+// comments attached to it, keeping the order and positions of the other values, and returns the
+// number of values removed.
+func (x *List) RemoveMatching(pred func(Expression) bool) int {
+	before := len(x.Values)
+	x.deleteValuesFunc(pred)
+	return before - len(x.Values)
+}
+
+// DedupeList removes the string literals of a list that are the same as an earlier string
+// literal, keeping the first occurrence of each.  Other values are left in place.
+func DedupeList(list *List) (modified bool) {
+	seen := make(map[string]bool)
+	list.deleteValuesFunc(func(v Expression) bool {
+		if sv, ok := v.(*String); ok {
+			if seen[sv.Value] {
+				modified = true
+				return true
+			}
+			seen[sv.Value] = true
+		}
+		return false
+	})
+	return modified
+}
+
 func ReplaceStringsInList(list *List, replacements map[string]string) (replaced bool) {
 	modified := false
 	for i, v := range list.Values {
@@ -16,6 +16,8 @@ package parser
 
 import (
 	"bytes"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -63,3 +65,72 @@ func TestPatchList(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, got)
 	}
 }
+
+func TestDedupeList(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    srcs: ["b.c", "a.c", "b.c", common, "a.c", "c.c", common],
+}
+`)
+	list := file.Defs[0].(*Module).Properties[0].Value.(*List)
+	if !DedupeList(list) {
+		t.Errorf("expected the list to be modified")
+	}
+	var got []string
+	for _, v := range list.Values {
+		got = append(got, valueString(v))
+	}
+	want := []string{`"b.c"`, `"a.c"`, `common`, `"c.c"`, `common`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if DedupeList(list) {
+		t.Errorf("expected a list without duplicates not to be modified")
+	}
+}
+
+func TestListAppendAndRemoveMatching(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    srcs: [
+        "a.c",
+        generated_srcs,
+        "test.c",
+        "b.c",
+        test_srcs,
+    ],
+}
+`)
+	list := file.Defs[0].(*Module).Properties[0].Value.(*List)
+	bPos := list.Values[3].Pos()
+
+	removed := list.RemoveMatching(func(e Expression) bool {
+		switch e := e.(type) {
+		case *String:
+			return strings.HasPrefix(e.Value, "test")
+		case *Variable:
+			return strings.HasPrefix(e.Name, "test")
+		}
+		return false
+	})
+	if removed != 2 {
+		t.Errorf("expected 2 values to be removed, got %d", removed)
+	}
+	if pos := list.Values[2].Pos(); pos != bPos {
+		t.Errorf("expected the position of a kept value to be unchanged, got %s, expected %s", pos, bPos)
+	}
+
+	list.Append(&String{Value: "c.c"}, &Variable{Name: "more_srcs"})
+	var got []string
+	for _, v := range list.Values {
+		got = append(got, valueString(v))
+	}
+	want := []string{`"a.c"`, `generated_srcs`, `"b.c"`, `"c.c"`, `more_srcs`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if removed := list.RemoveMatching(func(Expression) bool { return false }); removed != 0 {
+		t.Errorf("expected no values to be removed, got %d", removed)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ClassifyProperties partitions the names of the properties of module, in source order, into
+// those that are not set in defaults (added), those that are set in defaults to a different
+// value (overridden), and those that are set in defaults to the same value (inherited).
+func ClassifyProperties(module, defaults *Module) (added, overridden, inherited []string) {
+	for _, prop := range module.Properties {
+		defaultProp, found := defaults.GetProperty(prop.Name)
+		if !found {
+			added = append(added, prop.Name)
+		} else if same, _ := ExpressionsAreSame(prop.Value, defaultProp.Value); same {
+			inherited = append(inherited, prop.Name)
+		} else {
+			overridden = append(overridden, prop.Name)
+		}
+	}
+	return added, overridden, inherited
+}
+
+// A PropDup is a module property whose value is the same as the value of a variable, so it could
+// be replaced by a reference to the variable.
+type PropDup struct {
+	Module   *Module
+	Property *Property
+	Variable *Assignment
+}
+
+// PropertiesDuplicatingVariable returns the module properties, including properties nested in
+// maps, whose value does not reference any variables and is the same as the value of a variable
+// in scope.  If more than one variable has the same value, the first by name is reported.
+func (f *File) PropertiesDuplicatingVariable(scope *Scope) []PropDup {
+	var variables []*Assignment
+	scope.ForEach(func(name string, a *Assignment, local bool) {
+		variables = append(variables, a)
+	})
+
+	var ret []PropDup
+	var visit func(module *Module, props []*Property)
+	visit = func(module *Module, props []*Property) {
+		for _, prop := range props {
+			if m, ok := prop.Value.(*Map); ok {
+				visit(module, m.Properties)
+				continue
+			}
+			refs := make(map[string]bool)
+			referencedVariables(prop.Value, refs)
+			if len(refs) > 0 {
+				continue
+			}
+			for _, v := range variables {
+				if v.Value == nil {
+					continue
+				}
+				if same, _ := ExpressionsAreSame(prop.Value, v.Value.Eval()); same {
+					ret = append(ret, PropDup{Module: module, Property: prop, Variable: v})
+					break
+				}
+			}
+		}
+	}
+	for _, def := range f.Defs {
+		if module, ok := def.(*Module); ok {
+			visit(module, module.Properties)
+		}
+	}
+	return ret
+}
+
+// CheckRequired returns an error at the position of the module for each name in required that is
+// not a property of the module.
+func (m *Module) CheckRequired(required []string) []error {
+	var errs []error
+	for _, name := range required {
+		if _, found := m.GetProperty(name); !found {
+			errs = append(errs, &ParseError{
+				Err: fmt.Errorf("module %s is missing required property %q", m.Type, name),
+				Pos: m.TypePos,
+			})
+		}
+	}
+	return errs
+}
+
+// CommonPropertyValues returns, for each distinct value of the top level property of the modules
+// in the file, the modules that set the property to that value, in source order.  Values are keyed
+// by their printed form, ignoring positions and formatting, and only values set by at least
+// minOccurrences modules are returned.  Values that are shared by many modules are candidates to
+// be moved into a variable.
+func (f *File) CommonPropertyValues(property string, minOccurrences int) map[string][]*Module {
+	modules := make(map[string][]*Module)
+	for _, def := range f.Defs {
+		if module, ok := def.(*Module); ok {
+			if prop, found := module.GetProperty(property); found {
+				key := valueString(stripPositions(prop.Value))
+				modules[key] = append(modules[key], module)
+			}
+		}
+	}
+
+	for key, shared := range modules {
+		if len(shared) < minOccurrences {
+			delete(modules, key)
+		}
+	}
+	return modules
+}
+
+// ValidateListEnum returns an error at the position of each element of the list property that is
+// not in allowed.  It returns nothing if the property is not set, and an error at the position of
+// the value if it is not a list of strings.
+func (m *Module) ValidateListEnum(property string, allowed []string) []error {
+	prop, found := m.GetProperty(property)
+	if !found {
+		return nil
+	}
+
+	list, ok := prop.Value.Eval().(*List)
+	if !ok || !isListOfStrings(list) {
+		return []error{&ParseError{
+			Err: fmt.Errorf("property %q of module %s must be a list of strings, found %s",
+				property, m.Type, prop.Value.Type()),
+			Pos: prop.Value.Pos(),
+		}}
+	}
+
+	var errs []error
+	for _, value := range list.Values {
+		s := value.(*String)
+		if !slices.Contains(allowed, s.Value) {
+			errs = append(errs, &ParseError{
+				Err: fmt.Errorf("%q is not a valid value for property %q of module %s, expected one of %q",
+					s.Value, property, m.Type, allowed),
+				Pos: s.LiteralPos,
+			})
+		}
+	}
+	return errs
+}
+
+// DefaultsReferences returns the names of the defaults modules listed in the defaults property of
+// the module, in order.  It returns nil if the property is not set or is not a list, and skips any
+// element of the list that is not a string.
+func (m *Module) DefaultsReferences() []string {
+	prop, found := m.GetProperty("defaults")
+	if !found {
+		return nil
+	}
+	list, ok := prop.Value.Eval().(*List)
+	if !ok {
+		return nil
+	}
+	var ret []string
+	for _, value := range list.Values {
+		if s, ok := value.Eval().(*String); ok {
+			ret = append(ret, s.Value)
+		}
+	}
+	return ret
+}
+
+// GetPropertyPath returns the property found by following path through nested maps, for example
+// GetPropertyPath("arch", "arm", "srcs") for arch: { arm: { srcs: [...] } }.  It returns false if
+// path is empty, if any property along it is missing, or if any property before the last does not
+// have a map value.
+func (m *Module) GetPropertyPath(path ...string) (*Property, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	current := &m.Map
+	for _, name := range path[:len(path)-1] {
+		prop, found := current.GetProperty(name)
+		if !found {
+			return nil, false
+		}
+		next, ok := prop.Value.Eval().(*Map)
+		if !ok {
+			return nil, false
+		}
+		current = next
+	}
+	return current.GetProperty(path[len(path)-1])
+}
+
+// AppendToListAt adds values to the list of strings found by following path through nested maps,
+// as in GetPropertyPath, skipping values that are already in the list.  Missing maps along path
+// and a missing list are created at the end of the map that holds them.  It returns an error
+// without changing the module if path is empty, if a property along path is not a map, or if the
+// last property is not a list of strings.
+func (m *Module) AppendToListAt(path []string, values ...*String) error {
+	if len(path) == 0 {
+		return fmt.Errorf("empty property path")
+	}
+	// Check the existing properties before creating any, so that an error leaves the module as it
+	// was.
+	current := &m.Map
+	for i, name := range path {
+		prop, found := current.GetProperty(name)
+		if !found {
+			break
+		}
+		if i == len(path)-1 {
+			list, ok := prop.Value.(*List)
+			if !ok || !isListOfStrings(list) {
+				return fmt.Errorf("property %q is a %s, not a list of strings",
+					strings.Join(path, "."), prop.Value.Type())
+			}
+			break
+		}
+		next, ok := prop.Value.(*Map)
+		if !ok {
+			return fmt.Errorf("property %q is a %s, not a map", strings.Join(path[:i+1], "."),
+				prop.Value.Type())
+		}
+		current = next
+	}
+
+	current = &m.Map
+	for _, name := range path[:len(path)-1] {
+		if _, found := current.GetProperty(name); !found {
+			current.SetProperty(name, &Map{LBracePos: current.RBracePos, RBracePos: current.RBracePos})
+		}
+		prop, _ := current.GetProperty(name)
+		current = prop.Value.(*Map)
+	}
+	name := path[len(path)-1]
+	if _, found := current.GetProperty(name); !found {
+		current.SetProperty(name, &List{LBracePos: current.RBracePos, RBracePos: current.RBracePos})
+	}
+	prop, _ := current.GetProperty(name)
+	list := prop.Value.(*List)
+	for _, value := range values {
+		AddStringToList(list, value.Value)
+	}
+	return nil
+}
+
+// Rename sets the value of the module's name property to newName, and updates the name returned
+// by Name.  It returns an error without changing the module if it has no name property, or if
+// the name is not a string literal, for example a variable or a select.
+func (m *Module) Rename(newName string) error {
+	prop, found := m.GetProperty("name")
+	if !found {
+		return fmt.Errorf("module %s has no name property", m.Type)
+	}
+	s, ok := prop.Value.(*String)
+	if !ok {
+		return fmt.Errorf("can't rename module %s, its name is a %s expression, not a string literal",
+			m.Type, prop.Value.Type())
+	}
+	s.Value = newName
+	s.Raw = false
+	m.Name__internal_only = &newName
+	return nil
+}
@@ -0,0 +1,392 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestClassifyProperties(t *testing.T) {
+	file := parseForTest(t, `
+cc_defaults {
+    name: "defaults",
+    cflags: ["-Wall"],
+    srcs: ["a.c"],
+    enabled: true,
+}
+
+cc_library {
+    name: "lib",
+    cflags: ["-Wall"],
+    srcs: ["b.c"],
+    shared_libs: ["libc"],
+}
+`)
+	defaults := file.Defs[0].(*Module)
+	module := file.Defs[1].(*Module)
+
+	added, overridden, inherited := ClassifyProperties(module, defaults)
+	if w := []string{"shared_libs"}; !reflect.DeepEqual(added, w) {
+		t.Errorf("expected added %q, got %q", w, added)
+	}
+	if w := []string{"name", "srcs"}; !reflect.DeepEqual(overridden, w) {
+		t.Errorf("expected overridden %q, got %q", w, overridden)
+	}
+	if w := []string{"cflags"}; !reflect.DeepEqual(inherited, w) {
+		t.Errorf("expected inherited %q, got %q", w, inherited)
+	}
+}
+
+func TestPropertiesDuplicatingVariable(t *testing.T) {
+	scope := NewScope(nil)
+	file, errs := ParseAndEval("", bytes.NewBufferString(`
+common_cflags = ["-Wall", "-Werror"]
+version = "1.0"
+
+cc_library {
+    name: "lib",
+    cflags: ["-Wall", "-Werror"],
+    srcs: ["a.c"],
+    arch: {
+        arm: {
+            version: "1.0",
+        },
+    },
+}
+
+cc_library {
+    name: "other",
+    cflags: common_cflags,
+    version: "2.0",
+}
+`), scope)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dups := file.PropertiesDuplicatingVariable(scope)
+	var got []string
+	for _, dup := range dups {
+		got = append(got, dup.Module.Name()+"."+dup.Property.Name+"="+dup.Variable.Name)
+	}
+	if w := []string{"lib.cflags=common_cflags", "lib.version=version"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+}
+
+func TestCheckRequired(t *testing.T) {
+	file, errs := Parse("Android.bp", bytes.NewBufferString(`
+cc_library {
+    name: "lib",
+    srcs: ["a.c"],
+}
+`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[0].(*Module)
+
+	if errs := module.CheckRequired([]string{"name", "srcs"}); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	errs = module.CheckRequired([]string{"name", "shared_libs", "cflags"})
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	w := []string{
+		`Android.bp:2:1: module cc_library is missing required property "shared_libs"`,
+		`Android.bp:2:1: module cc_library is missing required property "cflags"`,
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+	for _, err := range errs {
+		if pos := err.(*ParseError).Pos; pos != module.TypePos {
+			t.Errorf("expected error at %s, got %s", module.TypePos, pos)
+		}
+	}
+}
+
+func TestCommonPropertyValues(t *testing.T) {
+	file := parseForTest(t, `
+cc_library {
+    name: "a",
+    cflags: ["-Wall", "-Werror"],
+}
+
+cc_library {
+    name: "b",
+    cflags: [
+        "-Wall",
+        "-Werror",
+    ],
+}
+
+cc_binary {
+    name: "c",
+    cflags: ["-Wall", "-Werror"],
+}
+
+cc_library {
+    name: "d",
+    cflags: ["-Wall"],
+}
+
+cc_library {
+    name: "e",
+}
+`)
+
+	names := func(common map[string][]*Module) map[string][]string {
+		ret := make(map[string][]string)
+		for value, modules := range common {
+			for _, module := range modules {
+				ret[value] = append(ret[value], module.Name())
+			}
+		}
+		return ret
+	}
+
+	got := names(file.CommonPropertyValues("cflags", 3))
+	// Values are keyed by their canonical printed form, which puts lists of more than one element
+	// on separate lines.
+	want := map[string][]string{"[\n    \"-Wall\",\n    \"-Werror\",\n]": {"a", "b", "c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	got = names(file.CommonPropertyValues("cflags", 1))
+	want[`["-Wall"]`] = []string{"d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestValidateListEnum(t *testing.T) {
+	file, errs := Parse("Android.bp", bytes.NewBufferString(`
+cc_library {
+    name: "lib",
+    sanitize: ["address", "thread"],
+    compile_multilib: ["32", "both", "64",
+        "all"],
+    stl: "none",
+}
+`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[0].(*Module)
+
+	if errs := module.ValidateListEnum("sanitize", []string{"address", "thread", "memory"}); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if errs := module.ValidateListEnum("missing", nil); len(errs) != 0 {
+		t.Errorf("expected no errors for a missing property, got %v", errs)
+	}
+
+	errorStrings := func(errs []error) []string {
+		var ret []string
+		for _, err := range errs {
+			ret = append(ret, err.Error())
+		}
+		return ret
+	}
+
+	got := errorStrings(module.ValidateListEnum("compile_multilib", []string{"32", "64", "both"}))
+	w := []string{
+		`Android.bp:6:9: "all" is not a valid value for property "compile_multilib" of module cc_library, expected one of ["32" "64" "both"]`,
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+
+	got = errorStrings(module.ValidateListEnum("stl", []string{"none"}))
+	w = []string{`Android.bp:7:10: property "stl" of module cc_library must be a list of strings, found string`}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+}
+
+func TestDefaultsReferences(t *testing.T) {
+	file := parseForTest(t, `
+cc_library {
+    name: "with_defaults",
+    defaults: ["foo_defaults", "bar_defaults"],
+}
+
+cc_library {
+    name: "without_defaults",
+}
+
+cc_library {
+    name: "mistyped_defaults",
+    defaults: "foo_defaults",
+}
+`)
+	testCases := []struct {
+		module   int
+		expected []string
+	}{
+		{0, []string{"foo_defaults", "bar_defaults"}},
+		{1, nil},
+		{2, nil},
+	}
+	for _, tt := range testCases {
+		module := file.Defs[tt.module].(*Module)
+		if got := module.DefaultsReferences(); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %q, got %q", module.Name(), tt.expected, got)
+		}
+	}
+}
+
+func TestGetPropertyPath(t *testing.T) {
+	file := parseForTest(t, `
+cc_library {
+    name: "libfoo",
+    srcs: ["foo.c"],
+    arch: {
+        arm: {
+            srcs: ["arm.c"],
+        },
+        x86: {},
+    },
+}
+`)
+	module := file.Defs[0].(*Module)
+	testCases := []struct {
+		path     []string
+		expected string
+	}{
+		{[]string{"srcs"}, `["foo.c"]`},
+		{[]string{"arch", "arm", "srcs"}, `["arm.c"]`},
+		{[]string{"arch", "x86"}, `{}`},
+		{[]string{"arch", "x86", "srcs"}, ""},
+		{[]string{"arch", "riscv64", "srcs"}, ""},
+		{[]string{"srcs", "arm"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range testCases {
+		prop, found := module.GetPropertyPath(tt.path...)
+		if tt.expected == "" {
+			if found {
+				t.Errorf("%q: expected no property, got %s", tt.path, prop)
+			}
+			continue
+		}
+		if !found {
+			t.Errorf("%q: expected property, got none", tt.path)
+		} else if got := valueString(prop.Value); got != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.path, tt.expected, got)
+		}
+	}
+}
+
+func TestModuleRename(t *testing.T) {
+	file := parseForTest(t, `
+name = "libbar"
+
+cc_library {
+    name: "libfoo",
+}
+
+cc_library {
+    name: name,
+}
+
+cc_defaults {
+    srcs: ["a.c"],
+}
+`)
+	module := file.Defs[1].(*Module)
+	if module.Name() != "libfoo" {
+		t.Fatalf("expected libfoo, got %s", module.Name())
+	}
+	if err := module.Rename("libfoo2"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if module.Name() != "libfoo2" {
+		t.Errorf("expected Name to return libfoo2, got %s", module.Name())
+	}
+	if prop, _ := module.GetProperty("name"); valueString(prop.Value) != `"libfoo2"` {
+		t.Errorf("expected the name property to be updated, got %s", prop.Value)
+	}
+
+	for _, def := range file.Defs[2:] {
+		if err := def.(*Module).Rename("x"); err == nil {
+			t.Errorf("expected an error renaming %s", def)
+		}
+	}
+	if prop, _ := file.Defs[2].(*Module).GetProperty("name"); valueString(prop.Value) != "name" {
+		t.Errorf("expected the name property to be unchanged, got %s", prop.Value)
+	}
+}
+
+func TestAppendToListAt(t *testing.T) {
+	file := parseForTest(t, `
+cc_library {
+    name: "libfoo",
+    arch: {
+        arm: {
+            shared_libs: ["liba"],
+        },
+    },
+}
+`)
+	module := file.Defs[0].(*Module)
+	if err := module.AppendToListAt([]string{"arch", "arm", "shared_libs"}, &String{Value: "liba"},
+		&String{Value: "libb"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := module.AppendToListAt([]string{"arch", "arm64", "shared_libs"}, &String{Value: "libc"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := module.AppendToListAt([]string{"static_libs"}, &String{Value: "libz"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, path := range [][]string{nil, {"name"}, {"name", "srcs"}, {"arch", "arm"}} {
+		if err := module.AppendToListAt(path, &String{Value: "x"}); err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `cc_library {
+    name: "libfoo",
+    arch: {
+        arm: {
+            shared_libs: [
+                "liba",
+                "libb",
+            ],
+        },
+        arm64: {
+            shared_libs: ["libc"],
+        },
+    },
+    static_libs: ["libz"],
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
@@ -15,18 +15,31 @@
 package parser
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"text/scanner"
+	"unicode"
+	"unicode/utf8"
 )
 
 var errTooManyErrors = errors.New("too many errors")
 
-const maxErrors = 1
+// errSkipDefinition is used to unwind the parser to the enclosing top level definition after an
+// error, so that parsing can resume at the next definition.
+var errSkipDefinition = errors.New("skip definition")
+
+// errStopParsing is used to unwind the parser when the callback of ParseStream returns an error,
+// or when the context of ParseContext is done.
+var errStopParsing = errors.New("stop parsing")
 
 const default_select_branch_name = "__soong_conditions_default__"
 
@@ -43,6 +56,43 @@ type File struct {
 	Name     string
 	Defs     []Definition
 	Comments []*CommentGroup
+	// Warnings holds the non-fatal diagnostics found while parsing.
+	Warnings []error
+	// Stats holds the counts collected while parsing with ParseOptions.CollectStats, or nil.
+	Stats *ParseStats
+
+	src []byte
+}
+
+// SourceBytes returns the input the File was parsed from, which the offsets of its positions
+// refer to.  The input is only kept when parsing with ParseOptions.KeepSource, otherwise it
+// returns nil.
+func (f *File) SourceBytes() []byte {
+	return f.src
+}
+
+// NodeText returns the text of src from the start of n to its end, including any formatting and
+// comments inside it.  It returns false if src is nil, which it is for a File that was not parsed
+// with ParseOptions.KeepSource, or if the positions of n are not inside src.
+func NodeText(src []byte, n Node) ([]byte, bool) {
+	pos := n.Pos()
+	start, end := pos.Offset, n.End().Offset
+	if src == nil || !pos.IsValid() || start < 0 || end < start || end > len(src) {
+		return nil, false
+	}
+	return src[start:end], true
+}
+
+// ParseStats holds counts of the constructs in a parsed file.  Only definitions that parsed
+// successfully are counted.
+type ParseStats struct {
+	ModuleCount int
+	// PropertyCount is the number of properties of modules and of nested maps.
+	PropertyCount int
+	SelectCount   int
+	// MaxNestingDepth is the largest number of unclosed braces, brackets and parentheses at any
+	// point in the file, including the ones that enclose module properties.
+	MaxNestingDepth int
 }
 
 func (f *File) Pos() scanner.Position {
@@ -61,10 +111,98 @@ func (f *File) End() scanner.Position {
 	return noPos
 }
 
+// UnusedAssignments returns the top level assignments in the File, in source order, to variables
+// in scope that are never referenced.  The File must have been parsed with ParseAndEval into
+// scope.  Appending to a variable with += is not a reference to it, so only the original
+// assignment with = is returned for a variable that is only appended to.
+func (f *File) UnusedAssignments(scope *Scope) []*Assignment {
+	var ret []*Assignment
+	for _, def := range f.Defs {
+		if a, ok := def.(*Assignment); ok && a.Assigner == "=" {
+			if v, local := scope.Get(a.Name); local && v == a && !v.Referenced {
+				ret = append(ret, a)
+			}
+		}
+	}
+	return ret
+}
+
+// AssignmentStats returns the number of top level assignments in the File that use each assignment
+// operator, = or +=.
+func (f *File) AssignmentStats() map[string]int {
+	stats := make(map[string]int)
+	for _, def := range f.Defs {
+		if a, ok := def.(*Assignment); ok {
+			stats[a.Assigner]++
+		}
+	}
+	return stats
+}
+
+// NormalizeIntTokens replaces the token of every integer literal in the File with the canonical
+// decimal form of its value, so that integers written in another base print as decimal.
+func (f *File) NormalizeIntTokens() {
+	Walk(f, func(n Node) bool {
+		if i, ok := n.(*Int64); ok {
+			i.Token = strconv.FormatInt(i.Value, 10)
+		}
+		return true
+	})
+}
+
+// StripComments removes all comments from the File, so that it prints without them.  Lines that
+// contained only comments are removed by moving the positions of the following definitions up,
+// so that they don't print as blank lines.
+func (f *File) StripComments() {
+	tokenLines := make(map[int]bool)
+	remapPositions(f, func(pos scanner.Position) scanner.Position {
+		tokenLines[pos.Line] = true
+		return pos
+	})
+
+	var removed []int
+	for _, cg := range f.Comments {
+		for _, c := range cg.Comments {
+			for line := c.Slash.Line; line < c.Slash.Line+len(c.Comment); line++ {
+				if !tokenLines[line] {
+					removed = append(removed, line)
+					// Avoid counting a line twice if it has more than one comment.
+					tokenLines[line] = true
+				}
+			}
+		}
+	}
+	sort.Ints(removed)
+
+	if len(removed) > 0 {
+		remapPositions(f, func(pos scanner.Position) scanner.Position {
+			pos.Line -= sort.SearchInts(removed, pos.Line)
+			return pos
+		})
+	}
+	f.Comments = nil
+	Walk(f, func(n Node) bool {
+		switch n := n.(type) {
+		case *Operator:
+			n.Comments = nil
+		case *Property:
+			n.Comments = nil
+		case *Module:
+			n.TrailingComments = nil
+		case *Map:
+			n.TrailingComments = nil
+		case *List:
+			n.ValueComments = nil
+			n.TrailingComments = nil
+		}
+		return true
+	})
+}
+
 func parse(p *parser) (file *File, errs []error) {
 	defer func() {
 		if r := recover(); r != nil {
-			if r == errTooManyErrors {
+			if r == errTooManyErrors || r == errSkipDefinition || r == errStopParsing {
 				errs = p.errors
 				return
 			}
@@ -82,27 +220,251 @@ func parse(p *parser) (file *File, errs []error) {
 		Name:     p.scanner.Filename,
 		Defs:     defs,
 		Comments: comments,
+		Warnings: p.warnings,
+		Stats:    p.stats,
 	}, errs
 
 }
 
+// ParseAndEval parses r like Parse, and evaluates variables and operators while parsing.  The input
+// is not kept, so NodeText reports false for the SourceBytes of the returned File.
 func ParseAndEval(filename string, r io.Reader, scope *Scope) (file *File, errs []error) {
+	return ParseWithOptions(filename, r, scope, ParseOptions{Eval: true, MaxErrors: 1})
+}
+
+// Parse parses the Blueprints file read from r, stopping at the first error.  The input is not
+// kept, so NodeText reports false for the SourceBytes of the returned File; use ParseWithOptions
+// with ParseOptions.KeepSource to keep it.
+func Parse(filename string, r io.Reader, scope *Scope) (file *File, errs []error) {
+	return ParseWithOptions(filename, r, scope, ParseOptions{MaxErrors: 1})
+}
+
+// ParseStream parses r like Parse, but instead of returning a File it calls fn with each top level
+// assignment or module as soon as it has been parsed, so that large files can be processed one
+// definition at a time without keeping all of them.  Comments are only kept in the properties and
+// values they are attached to.  Parsing stops at the first parse error, or at the first error
+// returned by fn, which is returned unchanged.
+func ParseStream(filename string, r io.Reader, scope *Scope, fn func(Definition) error) []error {
 	p := newParser(r, scope)
-	p.eval = true
+	p.maxErrors = 1
 	p.scanner.Filename = filename
+	p.onDefinition = fn
+	_, errs := parse(p)
+	return errs
+}
 
-	return parse(p)
+// ParseFile opens and parses the Blueprints file at path, using path as the filename in positions.
+// An error opening or closing the file is returned in errs.
+func ParseFile(path string, scope *Scope) (file *File, errs []error) {
+	return parseFileWithOptions(path, scope, ParseOptions{MaxErrors: 1})
 }
 
-func Parse(filename string, r io.Reader, scope *Scope) (file *File, errs []error) {
+// ParseAndEvalFile is like ParseFile, but evaluates variables and operators the same as
+// ParseAndEval.
+func ParseAndEvalFile(path string, scope *Scope) (file *File, errs []error) {
+	return parseFileWithOptions(path, scope, ParseOptions{Eval: true, MaxErrors: 1})
+}
+
+func parseFileWithOptions(path string, scope *Scope, opts ParseOptions) (file *File, errs []error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	file, errs = ParseWithOptions(path, f, scope, opts)
+	if err := f.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return file, errs
+}
+
+// ParseOptions controls optional parser behaviors for ParseWithOptions.
+type ParseOptions struct {
+	// Eval evaluates variables and operators while parsing, the same as ParseAndEval.
+	Eval bool
+
+	// MaxErrors is the number of errors after which parsing stops.  Parse and ParseAndEval stop
+	// at the first error.  Zero means there is no limit.  After an error the parser skips
+	// ahead to the next top level definition, and the returned File holds the definitions
+	// that parsed successfully.  If parsing stops early because of the limit no File is returned.
+	MaxErrors int
+
+	// Lenient recovers from a module, map or list that is missing its closing token at the end
+	// of the input by reporting an error and returning the partial definition, so that tools
+	// can still inspect a truncated file.  The error does not count toward MaxErrors.
+	Lenient bool
+
+	// AllowLineContinuations joins a line ending in a backslash with the following line before
+	// scanning.  Continuations inside raw strings and comments are left untouched.  Positions in
+	// the returned File refer to the original, unjoined input.
+	AllowLineContinuations bool
+
+	// IdentRune, if set, replaces the default rule for which characters may appear in
+	// identifiers, such as module types, property and variable names.  It is used as the
+	// scanner's IsIdentRune, so it is called with the index of each character in the identifier.
+	// For example a rule that accepts '-' after the first character allows module types like
+	// cc-library, but then a subtraction must have spaces around the operator.
+	IdentRune func(ch rune, i int) bool
+
+	// EmptySelectWarning reports a select statement whose cases are all unset as a warning in
+	// File.Warnings instead of an error.  Such a select is unset, so a property set to it is
+	// left out of its module or map.
+	EmptySelectWarning bool
+
+	// InterpolateStrings parses $(name) in string literals as a reference to the variable name,
+	// producing an InterpolatedString.  When evaluating, the referenced variables must be
+	// strings.  Without it a $ in a string literal has no special meaning.
+	InterpolateStrings bool
+
+	// AllowNumericSuffixes lists the type suffixes, like L or u, that may follow a number with no
+	// space in between, as in 42L.  The suffix is kept in the Token of the literal, so it is
+	// printed again, and does not affect its value.  Any other suffix is an error.
+	AllowNumericSuffixes []string
+
+	// MetadataOnly keeps only the structure of modules, to save memory when indexing large
+	// files.  The value of a module property is kept if it is a literal string, bool or number,
+	// so Module.Name still works, and is otherwise replaced by a Placeholder that records its
+	// Type.  Assignments are parsed in full so that they can still be referenced.  A File parsed
+	// with MetadataOnly cannot be printed, Print returns an error for it.
+	MetadataOnly bool
+
+	// RejectEmpty reports an error if the input has no assignments or modules, including an input
+	// that only has comments.
+	RejectEmpty bool
+
+	// DisallowCompatSyntax reports an error at the opening brace of a module written with the
+	// compat syntax, foo { name: "foo" }, so that only foo(name = "foo") is accepted.
+	DisallowCompatSyntax bool
+
+	// CollectStats counts modules, properties and selects while parsing and returns them in
+	// File.Stats.
+	CollectStats bool
+
+	// PreserveUnset keeps properties whose value is unset, like a select whose cases are all
+	// unset, instead of leaving them out of their module or map, and accepts such a select
+	// without an error or warning.  The Value of a kept property has Type UnsetType, and the
+	// unset keyword appears in the tree as an UnsetProperty in the Value of a SelectCase.
+	PreserveUnset bool
+
+	// AllowDuplicateProperties accepts a module or map that sets the same property more than
+	// once, keeping every copy in the tree.  By default the second occurrence is an error.
+	AllowDuplicateProperties bool
+
+	// AppendToInheritedVariables accepts += on a variable inherited from a parent scope, which is
+	// otherwise an error.  It makes a local variable of the same name, set to the inherited value
+	// plus the appended value, that hides the inherited one for the rest of the file and for scopes
+	// made from this one with NewScope.  The inherited assignment is not changed, so the file that
+	// set it and other files that inherit it still see the original value.  As with a local
+	// variable, += is an error after the variable has been referenced in the file.
+	AppendToInheritedVariables bool
+
+	// StrictEscapes reports an error for an escape sequence in a quoted string other than \n, \t,
+	// \\ and \", such as \x41 or \u00e9, which are accepted by default with their Go meaning.
+	// It catches backslashes written by accident, as in Windows paths, which should be written
+	// as \\ or in a raw string instead.
+	StrictEscapes bool
+
+	// KeepSource keeps a copy of the input in the returned File, for File.SourceBytes and
+	// NodeText.  It is off by default so that parsing doesn't hold the whole input in memory.
+	KeepSource bool
+}
+
+func ParseWithOptions(filename string, r io.Reader, scope *Scope, opts ParseOptions) (file *File, errs []error) {
+	return parseWithContext(context.Background(), filename, r, scope, opts)
+}
+
+// ParseContext parses r like Parse, but stops early if ctx is done, returning no File and the
+// error from ctx.Err() as the last error.  The context is checked every contextCheckInterval
+// tokens, so very large inputs can be abandoned without slowing down the parse.
+func ParseContext(ctx context.Context, filename string, r io.Reader, scope *Scope) (file *File, errs []error) {
+	return parseWithContext(ctx, filename, r, scope, ParseOptions{MaxErrors: 1})
+}
+
+// contextCheckInterval is the number of tokens between checks of the context of ParseContext.
+const contextCheckInterval = 1024
+
+func parseWithContext(ctx context.Context, filename string, r io.Reader, scope *Scope,
+	opts ParseOptions) (file *File, errs []error) {
+
+	var src []byte
+	if opts.KeepSource || opts.AllowLineContinuations {
+		var err error
+		src, err = io.ReadAll(r)
+		if err != nil {
+			return nil, []error{err}
+		}
+		r = bytes.NewReader(src)
+	}
+
+	var continuations *lineContinuations
+	if opts.AllowLineContinuations {
+		var joined []byte
+		joined, continuations = joinLineContinuations(src)
+		r = bytes.NewReader(joined)
+	}
+
 	p := newParser(r, scope)
+	p.ctx = ctx
+	p.eval = opts.Eval
+	p.maxErrors = opts.MaxErrors
+	p.lenient = opts.Lenient
+	p.continuations = continuations
 	p.scanner.Filename = filename
-
-	return parse(p)
+	p.scanner.IsIdentRune = opts.IdentRune
+	p.emptySelectWarning = opts.EmptySelectWarning
+	p.interpolateStrings = opts.InterpolateStrings
+	p.numericSuffixes = opts.AllowNumericSuffixes
+	p.metadataOnly = opts.MetadataOnly
+	p.disallowCompat = opts.DisallowCompatSyntax
+	p.preserveUnset = opts.PreserveUnset
+	p.allowDuplicates = opts.AllowDuplicateProperties
+	p.appendToInherited = opts.AppendToInheritedVariables
+	p.strictEscapes = opts.StrictEscapes
+	if opts.CollectStats {
+		p.stats = &ParseStats{}
+	}
+
+	file, errs = parse(p)
+	if file != nil && opts.KeepSource {
+		file.src = src
+	}
+	if opts.RejectEmpty && len(errs) == 0 && len(file.Defs) == 0 {
+		errs = append(errs, &ParseError{
+			Err: errors.New("file has no definitions"),
+			Pos: scanner.Position{Filename: filename, Line: 1, Column: 1},
+		})
+	}
+	return file, errs
 }
 
 func ParseExpression(r io.Reader) (value Expression, errs []error) {
-	p := newParser(r, NewScope(nil))
+	return parseExpression(r, NewScope(nil), false)
+}
+
+// ParseAndEvalExpression parses a single expression like ParseExpression, resolving variables from
+// scope, and returns the result of evaluating it.
+func ParseAndEvalExpression(r io.Reader, scope *Scope) (value Expression, errs []error) {
+	value, errs = parseExpression(r, scope, true)
+	if value != nil {
+		value = value.Eval()
+	}
+	return value, errs
+}
+
+func parseExpression(r io.Reader, scope *Scope, eval bool) (value Expression, errs []error) {
+	p := newParser(r, scope)
+	p.eval = eval
+	p.maxErrors = 1
+	defer func() {
+		if r := recover(); r != nil {
+			if r == errTooManyErrors || r == errSkipDefinition {
+				value = nil
+				errs = p.errors
+				return
+			}
+			panic(r)
+		}
+	}()
 	p.next()
 	value = p.parseExpression()
 	p.accept(scanner.EOF)
@@ -114,9 +476,49 @@ type parser struct {
 	scanner  scanner.Scanner
 	tok      rune
 	errors   []error
+	warnings []error
 	scope    *Scope
 	comments []*CommentGroup
 	eval     bool
+
+	maxErrors int
+	// depth is the number of unclosed brackets, braces and parentheses up to and including the
+	// current token, used to find the start of the next definition after an error.
+	depth int
+
+	lenient bool
+
+	// onDefinition is called with each top level definition instead of collecting them, when
+	// parsing with ParseStream.
+	onDefinition     func(Definition) error
+	reportedUnclosed bool
+
+	continuations *lineContinuations
+
+	// prevTok and prevPos are the token before the current one and its position.
+	prevTok rune
+	prevPos scanner.Position
+
+	emptySelectWarning bool
+	interpolateStrings bool
+	numericSuffixes    []string
+	metadataOnly       bool
+	disallowCompat     bool
+	preserveUnset      bool
+	allowDuplicates    bool
+	appendToInherited  bool
+	strictEscapes      bool
+
+	// referencedInherited holds the names of the inherited variables referenced in the file, which
+	// can't be appended to afterwards.
+	referencedInherited map[string]bool
+
+	// stats is only set when collecting statistics.
+	stats *ParseStats
+
+	// ctx is checked every contextCheckInterval tokens when it is set, tokens counts the tokens.
+	ctx    context.Context
+	tokens int
 }
 
 func newParser(r io.Reader, scope *Scope) *parser {
@@ -124,32 +526,53 @@ func newParser(r io.Reader, scope *Scope) *parser {
 	p.scope = scope
 	p.scanner.Init(r)
 	p.scanner.Error = func(sc *scanner.Scanner, msg string) {
-		p.errorf(msg)
+		// The scanner recovers from its own errors, so record them without unwinding.
+		p.recordError(errors.New(msg))
 	}
-	p.scanner.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanStrings |
+	p.scanner.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings |
 		scanner.ScanRawStrings | scanner.ScanComments
 	return p
 }
 
+// error records an error at the current position and abandons the current definition.
 func (p *parser) error(err error) {
+	p.recordError(err)
+	panic(errSkipDefinition)
+}
+
+// recordError records an error at the current position, and stops parsing if the maximum number
+// of errors has been reached.
+func (p *parser) recordError(err error) {
+	p.errors = append(p.errors, p.newError(err))
+	if p.maxErrors > 0 && len(p.errors) >= p.maxErrors {
+		panic(errTooManyErrors)
+	}
+}
+
+func (p *parser) newError(err error) error {
+	if perr, ok := err.(*ParseError); ok {
+		// The error already has a more precise position.
+		return perr
+	}
 	pos := p.scanner.Position
 	if !pos.IsValid() {
 		pos = p.scanner.Pos()
 	}
-	err = &ParseError{
+	return &ParseError{
 		Err: err,
 		Pos: pos,
 	}
-	p.errors = append(p.errors, err)
-	if len(p.errors) >= maxErrors {
-		panic(errTooManyErrors)
-	}
 }
 
 func (p *parser) errorf(format string, args ...interface{}) {
 	p.error(fmt.Errorf(format, args...))
 }
 
+// warnf records a warning at the current position without affecting the parse.
+func (p *parser) warnf(format string, args ...interface{}) {
+	p.warnings = append(p.warnings, p.newError(fmt.Errorf(format, args...)))
+}
+
 func (p *parser) accept(toks ...rune) bool {
 	for _, tok := range toks {
 		if p.tok != tok {
@@ -162,53 +585,184 @@ func (p *parser) accept(toks ...rune) bool {
 	return true
 }
 
+// acceptClose accepts the closing token of a module, map or list.  In lenient mode reaching the
+// end of the input is treated as closing every unclosed module, map and list, and a single error
+// is reported.
+func (p *parser) acceptClose(tok rune) {
+	if p.lenient && p.tok == scanner.EOF {
+		if !p.reportedUnclosed {
+			p.errors = append(p.errors, p.newError(fmt.Errorf("expected %s, found EOF",
+				scanner.TokenString(tok))))
+			p.reportedUnclosed = true
+		}
+		return
+	}
+	p.accept(tok)
+}
+
 func (p *parser) next() {
+	if p.ctx != nil {
+		if p.tokens%contextCheckInterval == 0 {
+			if err := p.ctx.Err(); err != nil {
+				p.errors = append(p.errors, err)
+				panic(errStopParsing)
+			}
+		}
+		p.tokens++
+	}
 	if p.tok != scanner.EOF {
-		p.tok = p.scanner.Scan()
+		p.prevTok, p.prevPos = p.tok, p.scanner.Position
+		p.scan()
 		if p.tok == scanner.Comment {
 			var comments []*Comment
 			for p.tok == scanner.Comment {
 				lines := strings.Split(p.scanner.TokenText(), "\n")
-				if len(comments) > 0 && p.scanner.Position.Line > comments[len(comments)-1].End().Line+1 {
+				// Start a new group after a blank line.  Also start one after comments at the end
+				// of the line of a comma between properties or values, which document what comes
+				// before the comma, so that the comments on the following lines can be attached to
+				// what follows them.
+				if len(comments) > 0 && (p.scanner.Position.Line > comments[len(comments)-1].End().Line+1 ||
+					p.prevTok == ',' && comments[0].Pos().Line == p.prevPos.Line &&
+						p.scanner.Position.Line > comments[len(comments)-1].End().Line) {
 					p.comments = append(p.comments, &CommentGroup{Comments: comments})
 					comments = nil
 				}
 				comments = append(comments, &Comment{lines, p.scanner.Position})
-				p.tok = p.scanner.Scan()
+				p.scan()
 			}
 			p.comments = append(p.comments, &CommentGroup{Comments: comments})
 		}
 	}
 }
 
+// scan reads the next token, translating its position back to the original input if line
+// continuations were removed before scanning.
+func (p *parser) scan() {
+	p.tok = p.scanner.Scan()
+	if p.continuations != nil {
+		p.scanner.Position = p.continuations.originalPos(p.scanner.Position)
+	}
+	switch p.tok {
+	case '{', '(', '[':
+		p.depth++
+		if p.stats != nil {
+			p.stats.MaxNestingDepth = max(p.stats.MaxNestingDepth, p.depth)
+		}
+	case '}', ')', ']':
+		if p.depth > 0 {
+			p.depth--
+		}
+	}
+}
+
 func (p *parser) parseDefinitions() (defs []Definition) {
-	for {
-		switch p.tok {
-		case scanner.Ident:
-			ident := p.scanner.TokenText()
-			pos := p.scanner.Position
+	var prev Definition
+	for p.tok != scanner.EOF {
+		if def := p.parseDefinition(); def != nil {
+			if prev != nil {
+				blankLines := p.blankLinesBetween(prev.End(), def.Pos())
+				switch def := def.(type) {
+				case *Assignment:
+					def.BlankLinesBefore = blankLines
+				case *Module:
+					def.BlankLinesBefore = blankLines
+				}
+			}
+			prev = def
+			if p.onDefinition == nil {
+				defs = append(defs, def)
+				continue
+			}
+			if err := p.onDefinition(def); err != nil {
+				p.errors = append(p.errors, err)
+				panic(errStopParsing)
+			}
+			// Only the comments after the definition are needed to count the blank lines before
+			// the next one.  Copy them, since the definition may share the backing array.
+			var comments []*CommentGroup
+			for _, cg := range p.comments {
+				if cg.Pos().Offset >= def.End().Offset {
+					comments = append(comments, cg)
+				}
+			}
+			p.comments = comments
+		}
+	}
+	return
+}
 
-			p.accept(scanner.Ident)
+// blankLinesBetween returns the number of lines after the line of start and before the line of end
+// that do not contain a comment.
+func (p *parser) blankLinesBetween(start, end scanner.Position) int {
+	blankLines := end.Line - start.Line - 1
+	for _, cg := range p.comments {
+		for _, c := range cg.Comments {
+			first, last := max(c.Pos().Line, start.Line+1), min(c.End().Line, end.Line-1)
+			if last >= first {
+				blankLines -= last - first + 1
+			}
+		}
+	}
+	return max(blankLines, 0)
+}
 
-			switch p.tok {
-			case '+':
-				p.accept('+')
-				defs = append(defs, p.parseAssignment(ident, pos, "+="))
-			case '=':
-				defs = append(defs, p.parseAssignment(ident, pos, "="))
-			case '{', '(':
-				defs = append(defs, p.parseModule(ident, pos))
-			default:
-				p.errorf("expected \"=\" or \"+=\" or \"{\" or \"(\", found %s",
-					scanner.TokenString(p.tok))
+// parseDefinition parses a single top level assignment or module.  If it encounters an error it
+// skips ahead to the start of the next definition and returns nil.
+func (p *parser) parseDefinition() (def Definition) {
+	start := p.scanner.Position
+	var statsBefore ParseStats
+	if p.stats != nil {
+		statsBefore = *p.stats
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errSkipDefinition {
+				panic(r)
 			}
-		case scanner.EOF:
-			return
+			def = nil
+			p.skipDefinition(start)
+			if p.stats != nil {
+				// Don't count the definition that failed to parse.
+				*p.stats = statsBefore
+			}
+		}
+	}()
+
+	switch p.tok {
+	case scanner.Ident:
+		ident := p.scanner.TokenText()
+		pos := p.scanner.Position
+
+		p.accept(scanner.Ident)
+
+		switch p.tok {
+		case '+':
+			p.accept('+')
+			return p.parseAssignment(ident, pos, "+=")
+		case '=':
+			return p.parseAssignment(ident, pos, "=")
+		case '{', '(':
+			return p.parseModule(ident, pos)
 		default:
-			p.errorf("expected assignment or module definition, found %s",
+			p.errorf("expected \"=\" or \"+=\" or \"{\" or \"(\", found %s",
 				scanner.TokenString(p.tok))
-			return
 		}
+	default:
+		p.errorf("expected assignment or module definition, found %s",
+			scanner.TokenString(p.tok))
+	}
+	return nil
+}
+
+// skipDefinition skips tokens until an identifier outside of any brackets, which is assumed to
+// start the next definition.  It always consumes at least one token if the definition that
+// failed started at start.
+func (p *parser) skipDefinition(start scanner.Position) {
+	if p.scanner.Position == start {
+		p.next()
+	}
+	for p.tok != scanner.EOF && !(p.depth == 0 && p.tok == scanner.Ident) {
+		p.next()
 	}
 }
 
@@ -242,16 +796,20 @@ func (p *parser) parseAssignment(name string, namePos scanner.Position,
 		if assigner == "+=" {
 			if old, local := p.scope.Get(assignment.Name); old == nil {
 				p.errorf("modified non-existent variable %q with +=", assignment.Name)
-			} else if !local {
+			} else if !local && !p.appendToInherited {
 				p.errorf("modified non-local variable %q with +=", assignment.Name)
-			} else if old.Referenced {
+			} else if old.Referenced && local || !local && p.referencedInherited[assignment.Name] {
 				p.errorf("modified variable %q with += after referencing", assignment.Name)
 			} else {
 				val, err := p.evaluateOperator(old.Value, assignment.Value, '+', assignment.EqualsPos)
 				if err != nil {
 					p.error(err)
-				} else {
+				} else if local {
 					old.Value = val
+				} else {
+					// Hide the inherited variable with a local copy instead of modifying it.
+					assignment.Value = val
+					p.scope.vars[assignment.Name] = assignment
 				}
 			}
 		} else {
@@ -270,38 +828,70 @@ func (p *parser) parseModule(typ string, typPos scanner.Position) *Module {
 	compat := false
 	lbracePos := p.scanner.Position
 	if p.tok == '{' {
+		if p.disallowCompat {
+			p.errorf("module %s uses the compat { } syntax, use ( ) instead", typ)
+		}
 		compat = true
 	}
 
 	if !p.accept(p.tok) {
 		return nil
 	}
-	properties := p.parsePropertyList(true, compat)
+	properties, trailingComments := p.parsePropertyList(true, compat)
+	if p.metadataOnly {
+		for _, prop := range properties {
+			switch prop.Value.(type) {
+			case *String, *Bool, *Int64, *Float64:
+			default:
+				prop.Value = &Placeholder{
+					StartPos:  prop.Value.Pos(),
+					EndPos:    prop.Value.End(),
+					ValueType: prop.Value.Type(),
+				}
+			}
+		}
+	}
 	rbracePos := p.scanner.Position
 	if !compat {
-		p.accept(')')
+		p.acceptClose(')')
 	} else {
-		p.accept('}')
+		p.acceptClose('}')
+	}
+	if p.stats != nil {
+		p.stats.ModuleCount++
 	}
 
 	return &Module{
 		Type:    typ,
 		TypePos: typPos,
 		Map: Map{
-			Properties: properties,
-			LBracePos:  lbracePos,
-			RBracePos:  rbracePos,
+			Properties:       properties,
+			LBracePos:        lbracePos,
+			RBracePos:        rbracePos,
+			TrailingComments: trailingComments,
 		},
 	}
 }
 
-func (p *parser) parsePropertyList(isModule, compat bool) (properties []*Property) {
+func (p *parser) parsePropertyList(isModule, compat bool) (properties []*Property, trailingComments []*CommentGroup) {
+	seen := make(map[string]scanner.Position)
 	for p.tok == scanner.Ident {
+		comments := p.commentsBeforeToken()
 		property := p.parseProperty(isModule, compat)
 
+		if first, ok := seen[property.Name]; !ok {
+			seen[property.Name] = property.NamePos
+		} else if !p.allowDuplicates {
+			p.error(&ParseError{
+				Err: fmt.Errorf("property %q already defined at %s", property.Name, first),
+				Pos: property.NamePos,
+			})
+		}
+
 		// If a property is set to an empty select or a select where all branches are "unset",
-		// skip emitting the property entirely.
-		if property.Value.Type() != UnsetType {
+		// skip emitting the property entirely, unless unset properties are being preserved.
+		if p.preserveUnset || property.Value.Type() != UnsetType {
+			property.Comments = attachComments(comments)
 			properties = append(properties, property)
 		}
 
@@ -313,10 +903,39 @@ func (p *parser) parsePropertyList(isModule, compat bool) (properties []*Propert
 		p.accept(',')
 	}
 
-	return
+	return properties, attachComments(p.commentsBeforeToken())
+}
+
+// commentsBeforeToken returns the comment groups between the previous token and the current one,
+// leaving out a group that starts on the line of the previous token, since it documents the code
+// at the end of which it was written.
+func (p *parser) commentsBeforeToken() []*CommentGroup {
+	i := len(p.comments)
+	for i > 0 && p.comments[i-1].Pos().Offset > p.prevPos.Offset {
+		i--
+	}
+	if i < len(p.comments) && p.comments[i].Pos().Line == p.prevPos.Line {
+		i++
+	}
+	return p.comments[i:len(p.comments):len(p.comments)]
+}
+
+// attachComments marks comment groups as belonging to the node they are stored in, so that the
+// printer prints them with the node instead of at their position.
+func attachComments(comments []*CommentGroup) []*CommentGroup {
+	if len(comments) == 0 {
+		return nil
+	}
+	for _, cg := range comments {
+		cg.attached = true
+	}
+	return comments
 }
 
 func (p *parser) parseProperty(isModule, compat bool) (property *Property) {
+	if p.stats != nil {
+		p.stats.PropertyCount++
+	}
 	property = new(Property)
 
 	name := p.scanner.TokenText()
@@ -351,18 +970,328 @@ func (p *parser) parseProperty(isModule, compat bool) (property *Property) {
 }
 
 func (p *parser) parseExpression() (value Expression) {
+	value = p.parseOr()
+	if p.tok == '?' {
+		value = p.parseConditional(value)
+	}
+	return value
+}
+
+// parseOr parses values joined by ||, which binds less tightly than &&.
+func (p *parser) parseOr() (value Expression) {
+	value = p.parseAnd()
+	for p.tok == '|' {
+		value = p.parseBoolOp(value, p.parseAnd)
+	}
+	return value
+}
+
+// parseAnd parses values joined by &&, which binds less tightly than comparisons.
+func (p *parser) parseAnd() (value Expression) {
+	value = p.parseComparisons()
+	for p.tok == '&' {
+		value = p.parseBoolOp(value, p.parseComparisons)
+	}
+	return value
+}
+
+// parseBoolOp parses the && or || operator at the current token and its right operand, which is
+// parsed with parseOperand.
+func (p *parser) parseBoolOp(value1 Expression, parseOperand func() Expression) Expression {
+	pos := p.scanner.Position
+	tok := p.tok
+	p.accept(tok)
+	// The scanner returns each character of a two character operator as a separate token.
+	if p.tok != tok || p.scanner.Position.Offset != pos.Offset+1 {
+		p.error(&ParseError{Err: fmt.Errorf("expected %c%c, found %c", tok, tok, tok), Pos: pos})
+	}
+	p.accept(tok)
+
+	value2 := parseOperand()
+
+	value, err := p.evaluateBoolOp(value1, value2, string([]rune{tok, tok}), pos)
+	if err != nil {
+		p.error(err)
+		return nil
+	}
+	return value
+}
+
+// parseNot parses a unary ! and the value it negates.
+func (p *parser) parseNot() Expression {
+	pos := p.scanner.Position
+	p.accept('!')
+
+	value := p.parseValue()
+
+	result, err := p.evaluateBoolOp(nil, value, "!", pos)
+	if err != nil {
+		p.error(err)
+		return nil
+	}
+	return result
+}
+
+// evaluateBoolOp returns a BoolOp for the operator, with the result as its Value when evaluating.
+// value1 is nil for a unary !.  Both operands must be bools, which is checked without evaluating
+// if their types are known.
+func (p *parser) evaluateBoolOp(value1, value2 Expression, operator string,
+	pos scanner.Position) (Expression, error) {
+
+	op := &BoolOp{
+		Args:        [2]Expression{value1, value2},
+		Operator:    operator,
+		OperatorPos: pos,
+		Value:       &NotEvaluated{},
+	}
+
+	if p.eval {
+		value, err := boolOpValue(value1, value2, operator, pos)
+		if err != nil {
+			return nil, err
+		}
+		op.Value = value
+		return op, nil
+	}
+	for _, arg := range op.Args {
+		if arg == nil {
+			continue
+		}
+		if _, err := boolOperand(arg, operator, false); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+// boolOpValue returns the Bool result of a bool operator, evaluating its operands.  value1 is nil
+// for a unary !.
+func boolOpValue(value1, value2 Expression, operator string, pos scanner.Position) (Expression, error) {
+	var operands [2]*Bool
+	for i, arg := range [2]Expression{value1, value2} {
+		if arg == nil {
+			continue
+		}
+		var err error
+		if operands[i], err = boolOperand(arg, operator, true); err != nil {
+			return nil, err
+		}
+	}
+
+	var result bool
+	switch operator {
+	case "!":
+		result = !operands[1].Value
+	case "&&":
+		result = operands[0].Value && operands[1].Value
+	case "||":
+		result = operands[0].Value || operands[1].Value
+	default:
+		panic("unknown bool operator " + operator)
+	}
+	return &Bool{
+		LiteralPos: pos,
+		Value:      result,
+	}, nil
+}
+
+// boolOperand returns the operand of a bool operator as a Bool.  If evaluate is false the operand
+// is not evaluated, and an operand whose type isn't known is accepted and returned as nil.
+func boolOperand(arg Expression, operator string, evaluate bool) (*Bool, error) {
+	e := arg
+	if evaluate {
+		e = arg.Eval()
+	}
+	if _, ok := e.(*Select); ok {
+		return nil, &ParseError{
+			Err: fmt.Errorf("operator %s not supported on select statements", operator),
+			Pos: arg.Pos(),
+		}
+	}
+	b, ok := e.(*Bool)
+	if t := e.Type(); t != BoolType && t != NotEvaluatedType || evaluate && !ok {
+		return nil, &ParseError{
+			Err: fmt.Errorf("operand of operator %s must be a bool, found %s", operator, t),
+			Pos: arg.Pos(),
+		}
+	}
+	return b, nil
+}
+
+func (p *parser) parseComparisons() (value Expression) {
+	value = p.parseSum()
+	for {
+		switch p.tok {
+		case '=', '!', '<', '>':
+			value = p.parseComparison(value)
+		default:
+			return value
+		}
+	}
+}
+
+// parseSum parses values joined by + and - operators.  Newlines are whitespace to the scanner, so
+// an operator may end the line of its first operand or start the line of its second, with any
+// number of newlines, blank lines and comments before or after it, and it still joins the two
+// operands.  A line that starts with + or - therefore always continues the previous expression;
+// it can't start a new definition, which always starts with an identifier.
+func (p *parser) parseSum() (value Expression) {
 	value = p.parseValue()
-	switch p.tok {
-	case '+':
-		return p.parseOperator(value)
-	case '-':
-		p.errorf("subtraction not supported: %s", p.scanner.String())
-		return value
+	for {
+		switch p.tok {
+		case '+', '-':
+			value = p.parseOperator(value)
+		default:
+			return value
+		}
+	}
+}
+
+func (p *parser) parseComparison(value1 Expression) Expression {
+	pos := p.scanner.Position
+	operator := string(p.tok)
+	p.accept(p.tok)
+	// The scanner returns each character of a two character operator as a separate token.
+	if p.tok == '=' && p.scanner.Position.Offset == pos.Offset+1 {
+		operator += "="
+		p.accept('=')
+	}
+	if operator == "=" || operator == "!" {
+		p.errorf("expected comparison operator, found %q", operator)
+	}
+
+	value2 := p.parseSum()
+
+	value, err := p.evaluateComparison(value1, value2, operator, pos)
+	if err != nil {
+		p.error(err)
+		return nil
+	}
+	return value
+}
+
+func (p *parser) parseConditional(cond Expression) Expression {
+	result := &Conditional{
+		Cond:        cond,
+		QuestionPos: p.scanner.Position,
+	}
+	p.accept('?')
+	result.True = p.parseExpression()
+	result.ColonPos = p.scanner.Position
+	if !p.accept(':') {
+		return nil
+	}
+	result.False = p.parseExpression()
+
+	// Like the cases of a select, both branches must have the same type.  The type of a variable
+	// isn't known when not evaluating.
+	trueType, falseType := result.True.Type(), result.False.Type()
+	if trueType != NotEvaluatedType && falseType != NotEvaluatedType && trueType != falseType {
+		p.errorf("Found conditional expression with differing types %q and %q in its branches",
+			trueType.String(), falseType.String())
+	}
+
+	if !p.eval {
+		result.Value = &NotEvaluated{}
+		return result
+	}
+	branch, err := conditionalBranch(result, cond)
+	if err != nil {
+		p.error(err)
+	}
+	result.Value = branch
+	return result
+}
+
+// conditionalBranch returns the branch of a conditional expression that is chosen by the evaluated
+// value of its condition.
+func conditionalBranch(c *Conditional, cond Expression) (Expression, error) {
+	b, ok := cond.Eval().(*Bool)
+	if !ok {
+		return nil, &ParseError{
+			Err: fmt.Errorf("condition of a conditional expression must be a bool, found %s", cond.Eval().Type()),
+			Pos: c.QuestionPos,
+		}
+	}
+	if b.Value {
+		return c.True, nil
+	}
+	return c.False, nil
+}
+
+func (p *parser) evaluateComparison(value1, value2 Expression, operator string,
+	pos scanner.Position) (Expression, error) {
+
+	comparison := &Comparison{
+		Args:        [2]Expression{value1, value2},
+		Operator:    operator,
+		OperatorPos: pos,
+		Value:       &NotEvaluated{},
+	}
+	if !p.eval {
+		return comparison, nil
+	}
+
+	value, err := comparisonValue(value1, value2, operator, pos)
+	if err != nil {
+		return nil, err
+	}
+	comparison.Value = value
+	return comparison, nil
+}
+
+// comparisonValue returns the Bool result of a comparison operator, evaluating both values.
+func comparisonValue(value1, value2 Expression, operator string, pos scanner.Position) (Expression, error) {
+	e1 := value1.Eval()
+	e2 := value2.Eval()
+	for i, e := range []Expression{e1, e2} {
+		if _, ok := e.(*Select); ok {
+			return nil, &ParseError{
+				Err: fmt.Errorf("operator %s not supported on select statements", operator),
+				Pos: []Expression{value1, value2}[i].Pos(),
+			}
+		}
+	}
+	if e1.Type() != e2.Type() {
+		return nil, fmt.Errorf("mismatched type in operator %s: %s != %s", operator,
+			e1.Type(), e2.Type())
+	}
+
+	var c int
+	switch v := e1.(type) {
+	case *Int64:
+		c = cmp.Compare(v.Value, e2.(*Int64).Value)
+	case *String:
+		c = strings.Compare(v.Value, e2.(*String).Value)
 	default:
-		return value
+		return nil, fmt.Errorf("operator %s not supported on type %s", operator, v.Type())
+	}
+
+	var result bool
+	switch operator {
+	case "==":
+		result = c == 0
+	case "!=":
+		result = c != 0
+	case "<":
+		result = c < 0
+	case ">":
+		result = c > 0
+	case "<=":
+		result = c <= 0
+	case ">=":
+		result = c >= 0
+	default:
+		panic("unknown comparison operator " + operator)
 	}
+	return &Bool{
+		LiteralPos: pos,
+		Value:      result,
+	}, nil
 }
 
+// evaluateOperator returns an Operator for value1 operator value2, with the result as its Value
+// when evaluating, or value1 otherwise.  If either value is unset the other value is returned.
 func (p *parser) evaluateOperator(value1, value2 Expression, operator rune,
 	pos scanner.Position) (Expression, error) {
 
@@ -374,52 +1303,11 @@ func (p *parser) evaluateOperator(value1, value2 Expression, operator rune,
 	}
 
 	value := value1
-
 	if p.eval {
-		e1 := value1.Eval()
-		e2 := value2.Eval()
-		if e1.Type() != e2.Type() {
-			return nil, fmt.Errorf("mismatched type in operator %c: %s != %s", operator,
-				e1.Type(), e2.Type())
-		}
-
-		if _, ok := e1.(*Select); !ok {
-			if _, ok := e2.(*Select); ok {
-				// Promote e1 to a select so we can add e2 to it
-				e1 = &Select{
-					Cases: []*SelectCase{{
-						Value: e1,
-					}},
-					ExpressionType: e1.Type(),
-				}
-			}
-		}
-
-		value = e1.Copy()
-
-		switch operator {
-		case '+':
-			switch v := value.(type) {
-			case *String:
-				v.Value += e2.(*String).Value
-			case *Int64:
-				v.Value += e2.(*Int64).Value
-				v.Token = ""
-			case *List:
-				v.Values = append(v.Values, e2.(*List).Values...)
-			case *Map:
-				var err error
-				v.Properties, err = p.addMaps(v.Properties, e2.(*Map).Properties, pos)
-				if err != nil {
-					return nil, err
-				}
-			case *Select:
-				v.Append = e2
-			default:
-				return nil, fmt.Errorf("operator %c not supported on type %s", operator, v.Type())
-			}
-		default:
-			panic("unknown operator " + string(operator))
+		var err error
+		value, err = operatorValue(value1, value2, operator, pos)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -431,11 +1319,209 @@ func (p *parser) evaluateOperator(value1, value2 Expression, operator rune,
 	}, nil
 }
 
-func (p *parser) addMaps(map1, map2 []*Property, pos scanner.Position) ([]*Property, error) {
+// operatorValue returns the result of value1 operator value2, evaluating both values.  If either
+// value is unset the other evaluated value is returned.  Neither value is modified.
+func operatorValue(value1, value2 Expression, operator rune, pos scanner.Position) (Expression, error) {
+	e1 := value1.Eval()
+	e2 := value2.Eval()
+	if e1.Type() == UnsetType {
+		return e2, nil
+	}
+	if e2.Type() == UnsetType {
+		return e1, nil
+	}
+
+	if e1.Type() != e2.Type() {
+		if detail := collectionMismatch(e1, e2); detail != "" {
+			return nil, fmt.Errorf("mismatched type in operator %c: %s != %s (%s)", operator,
+				e1.Type(), e2.Type(), detail)
+		}
+		return nil, fmt.Errorf("mismatched type in operator %c: %s != %s", operator,
+			e1.Type(), e2.Type())
+	}
+
+	if _, ok := e1.(*Select); !ok && operator == '+' {
+		if _, ok := e2.(*Select); ok {
+			// Promote e1 to a select so we can add e2 to it
+			e1 = &Select{
+				Cases: []*SelectCase{{
+					Value: e1,
+				}},
+				ExpressionType: e1.Type(),
+			}
+		}
+	}
+
+	value := e1.Copy()
+
+	switch operator {
+	case '+':
+		switch v := value.(type) {
+		case *String:
+			v.Value += e2.(*String).Value
+		case *Int64:
+			sum, ok := addInt64(v.Value, e2.(*Int64).Value)
+			if !ok {
+				return nil, intOverflowError(v.Value, e2.(*Int64).Value, operator, pos)
+			}
+			v.Value = sum
+			v.Token = ""
+		case *Float64:
+			v.Value += e2.(*Float64).Value
+			v.Token = ""
+		case *List:
+			other := e2.(*List)
+			if len(other.ValueComments) > 0 {
+				// Keep the comments of the appended values at their new indexes.
+				comments := make([][]*CommentGroup, len(v.Values), len(v.Values)+len(other.ValueComments))
+				copy(comments, v.ValueComments)
+				v.ValueComments = append(comments, other.ValueComments...)
+			}
+			v.Values = append(v.Values, other.Values...)
+		case *Map:
+			var err error
+			v.Properties, err = mergeProperties(v.Properties, e2.(*Map).Properties,
+				func(value1, value2 Expression) (Expression, error) {
+					return operatorValue(value1, value2, '+', pos)
+				})
+			if err != nil {
+				return nil, err
+			}
+		case *Select:
+			v.Append = e2
+		default:
+			return nil, fmt.Errorf("operator %c not supported on type %s", operator, v.Type())
+		}
+	case '-':
+		if _, ok := e2.(*Select); ok {
+			return nil, fmt.Errorf("operator %c not supported on select statements", operator)
+		}
+		switch v := value.(type) {
+		case *Int64:
+			difference, ok := subtractInt64(v.Value, e2.(*Int64).Value)
+			if !ok {
+				return nil, intOverflowError(v.Value, e2.(*Int64).Value, operator, pos)
+			}
+			v.Value = difference
+			v.Token = ""
+		case *Float64:
+			v.Value -= e2.(*Float64).Value
+			v.Token = ""
+		case *List:
+			remove := e2.(*List).Values
+			v.deleteValuesFunc(func(value Expression) bool { return containsSame(remove, value) })
+		case *Select:
+			return nil, fmt.Errorf("operator %c not supported on select statements", operator)
+		default:
+			return nil, fmt.Errorf("operator %c not supported on type %s", operator, v.Type())
+		}
+	default:
+		panic("unknown operator " + string(operator))
+	}
+	return value, nil
+}
+
+// addInt64 returns a + b, or false if the sum overflows.  Adding values with the same sign
+// overflowed if the sign of the result is different.
+func addInt64(a, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (a >= 0) != (b >= 0) || (sum >= 0) == (a >= 0)
+}
+
+// subtractInt64 returns a - b, or false if the difference overflows.  Subtracting a value with the
+// other sign overflowed if the sign of the result is different from the sign of a.
+func subtractInt64(a, b int64) (int64, bool) {
+	difference := a - b
+	return difference, (a >= 0) == (b >= 0) || (difference >= 0) == (a >= 0)
+}
+
+func intOverflowError(a, b int64, operator rune, pos scanner.Position) error {
+	return &ParseError{
+		Err: fmt.Errorf("integer overflow in operator %c: %d %c %d is out of the range of int64",
+			operator, a, operator, b),
+		Pos: pos,
+	}
+}
+
+// collectionMismatch describes an operator between a list or map and a scalar value, or returns
+// an empty string if the values are not a collection and a scalar.
+func collectionMismatch(e1, e2 Expression) string {
+	isScalar := func(e Expression) bool {
+		switch e.Type() {
+		case BoolType, StringType, Int64Type, Float64Type:
+			return true
+		}
+		return false
+	}
+	describe := func(e Expression) string {
+		switch e := e.(type) {
+		case *List:
+			if len(e.Values) == 0 {
+				return "the empty list []"
+			}
+			return "a list"
+		case *Map:
+			if len(e.Properties) == 0 {
+				return "the empty map {}"
+			}
+			return "a map"
+		}
+		return ""
+	}
+
+	if collection := describe(e1); collection != "" && isScalar(e2) {
+		return fmt.Sprintf("%s can't be combined with the %s value %s", collection, e2.Type(), valueString(e2))
+	}
+	if collection := describe(e2); collection != "" && isScalar(e1) {
+		return fmt.Sprintf("the %s value %s can't be combined with %s", e1.Type(), valueString(e1), collection)
+	}
+	return ""
+}
+
+// valueString returns the printed form of a value for use in error messages.
+func valueString(e Expression) string {
+	b, err := PrintExpression(e)
+	if err != nil {
+		return e.String()
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// containsSame returns true if any of values is the same as value.  It is used to drop every
+// occurrence of a removed element when subtracting lists.
+func containsSame(values []Expression, value Expression) bool {
+	for _, v := range values {
+		if same, _ := ExpressionsAreSame(value.Eval(), v.Eval()); same {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeMaps returns the result of a + b: the properties of a followed by the properties of b that
+// a doesn't have.  A property in both maps is set to the sum of its values, evaluated the same way
+// as the + operator, so nested maps are merged, lists are concatenated and values of different
+// types are an error.  a and b are not modified.
+func MergeMaps(a, b *Map) (*Map, error) {
+	a, b = a.Copy().(*Map), b.Copy().(*Map)
+	props, err := mergeProperties(a.Properties, b.Properties, func(value1, value2 Expression) (Expression, error) {
+		return operatorValue(value1, value2, '+', noPos)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Map{LBracePos: a.LBracePos, RBracePos: a.RBracePos, Properties: props}, nil
+}
+
+// mergeProperties returns the properties of map1 followed by the properties of map2 that map1
+// doesn't have, with each property that is in both maps set to the result of combine on the value
+// in map1 and the value in map2.  The properties of map1 and map2 are not modified.
+func mergeProperties(map1, map2 []*Property,
+	combine func(value1, value2 Expression) (Expression, error)) ([]*Property, error) {
+
 	ret := make([]*Property, 0, len(map1))
 
 	inMap1 := make(map[string]*Property)
-	inMap2 := make(map[string]*Property)
 	inBoth := make(map[string]*Property)
 
 	for _, prop1 := range map1 {
@@ -443,7 +1529,6 @@ func (p *parser) addMaps(map1, map2 []*Property, pos scanner.Position) ([]*Prope
 	}
 
 	for _, prop2 := range map2 {
-		inMap2[prop2.Name] = prop2
 		if _, ok := inMap1[prop2.Name]; ok {
 			inBoth[prop2.Name] = prop2
 		}
@@ -453,7 +1538,7 @@ func (p *parser) addMaps(map1, map2 []*Property, pos scanner.Position) ([]*Prope
 		if prop2, ok := inBoth[prop1.Name]; ok {
 			var err error
 			newProp := *prop1
-			newProp.Value, err = p.evaluateOperator(prop1.Value, prop2.Value, '+', pos)
+			newProp.Value, err = combine(prop1.Value, prop2.Value)
 			if err != nil {
 				return nil, err
 			}
@@ -472,18 +1557,32 @@ func (p *parser) addMaps(map1, map2 []*Property, pos scanner.Position) ([]*Prope
 	return ret, nil
 }
 
+// parseOperator parses the operator at the current token and its right operand.  Since addition
+// is associative, a chain of additions is parsed as a single right-nested Operator, while
+// subtraction is left associative and only takes the following value.  Together with
+// parseExpression this gives "a + b - c" the meaning "(a + b) - c".
 func (p *parser) parseOperator(value1 Expression) Expression {
 	operator := p.tok
 	pos := p.scanner.Position
+	numComments := len(p.comments)
 	p.accept(operator)
+	comments := p.comments[numComments:len(p.comments):len(p.comments)]
 
-	value2 := p.parseExpression()
+	value2 := p.parseValue()
+	if operator == '+' {
+		for p.tok == '+' {
+			value2 = p.parseOperator(value2)
+		}
+	}
 
 	value, err := p.evaluateOperator(value1, value2, operator, pos)
 	if err != nil {
 		p.error(err)
 		return nil
 	}
+	if op, ok := value.(*Operator); ok && len(comments) > 0 {
+		op.Comments = comments
+	}
 
 	return value
 
@@ -498,16 +1597,21 @@ func (p *parser) parseValue() (value Expression) {
 		case "select":
 			return p.parseSelect()
 		default:
-			return p.parseVariable()
+			return p.parseAccesses(p.parseVariable())
 		}
-	case '-', scanner.Int: // Integer might have '-' sign ahead ('+' is only treated as operator now)
-		return p.parseIntValue()
+	case '-', scanner.Int, scanner.Float: // Number might have '-' sign ahead ('+' is only treated as operator now)
+		return p.parseNumberValue()
+	case '!':
+		return p.parseNot()
 	case scanner.String, scanner.RawString:
+		if p.interpolateStrings {
+			return p.parseInterpolatedStringValue()
+		}
 		return p.parseStringValue()
 	case '[':
-		return p.parseListValue()
+		return p.parseAccesses(p.parseListValue())
 	case '{':
-		return p.parseMapValue()
+		return p.parseAccesses(p.parseMapValue())
 	default:
 		p.errorf("expected bool, list, or string value; found %s",
 			scanner.TokenString(p.tok))
@@ -515,6 +1619,115 @@ func (p *parser) parseValue() (value Expression) {
 	}
 }
 
+// parseAccesses parses any number of .field and [index] accesses following base.
+func (p *parser) parseAccesses(base Expression) Expression {
+	for {
+		switch p.tok {
+		case '.':
+			base = p.parseMemberAccess(base)
+		case '[':
+			base = p.parseIndexAccess(base)
+		default:
+			return base
+		}
+	}
+}
+
+func (p *parser) parseMemberAccess(base Expression) Expression {
+	dotPos := p.scanner.Position
+	p.accept('.')
+	if p.tok != scanner.Ident {
+		p.errorf("expected property name after '.', found %s", scanner.TokenString(p.tok))
+		return nil
+	}
+	access := &MemberAccess{
+		Base:    base,
+		DotPos:  dotPos,
+		Name:    p.scanner.TokenText(),
+		NamePos: p.scanner.Position,
+	}
+	if p.eval {
+		value, err := memberValue(access, base)
+		if err != nil {
+			p.error(err)
+			return nil
+		}
+		access.Value = value
+	} else {
+		access.Value = &NotEvaluated{}
+	}
+	p.accept(scanner.Ident)
+	return access
+}
+
+// memberValue returns the value of the property of the evaluated base of a member access.
+func memberValue(access *MemberAccess, base Expression) (Expression, error) {
+	m, ok := base.Eval().(*Map)
+	if !ok {
+		return nil, &ParseError{
+			Err: fmt.Errorf("cannot access property %q of a %s", access.Name, base.Eval().Type()),
+			Pos: access.NamePos,
+		}
+	}
+	prop, found := m.GetProperty(access.Name)
+	if !found {
+		return nil, &ParseError{Err: fmt.Errorf("map has no property %q", access.Name), Pos: access.NamePos}
+	}
+	return prop.Value, nil
+}
+
+func (p *parser) parseIndexAccess(base Expression) Expression {
+	access := &IndexAccess{
+		Base:        base,
+		LBracketPos: p.scanner.Position,
+	}
+	p.accept('[')
+	access.Index = p.parseExpression()
+	access.RBracketPos = p.scanner.Position
+	if p.tok != ']' {
+		p.accept(']')
+		return nil
+	}
+	if p.eval {
+		value, err := indexValue(access, base, access.Index)
+		if err != nil {
+			p.error(err)
+			return nil
+		}
+		access.Value = value
+	} else {
+		access.Value = &NotEvaluated{}
+	}
+	p.accept(']')
+	return access
+}
+
+// indexValue returns the element of the evaluated base of an index access at the evaluated index.
+// Errors are reported at the closing bracket, next to the index.
+func indexValue(access *IndexAccess, base, index Expression) (Expression, error) {
+	list, ok := base.Eval().(*List)
+	if !ok {
+		return nil, &ParseError{
+			Err: fmt.Errorf("cannot index a %s", base.Eval().Type()),
+			Pos: access.RBracketPos,
+		}
+	}
+	i, ok := index.Eval().(*Int64)
+	if !ok {
+		return nil, &ParseError{
+			Err: fmt.Errorf("list index must be an int64, found %s", index.Eval().Type()),
+			Pos: access.RBracketPos,
+		}
+	}
+	if i.Value < 0 || i.Value >= int64(len(list.Values)) {
+		return nil, &ParseError{
+			Err: fmt.Errorf("list index %d out of range for a list of length %d", i.Value, len(list.Values)),
+			Pos: access.RBracketPos,
+		}
+	}
+	return list.Values[i.Value], nil
+}
+
 func (p *parser) parseBoolean() Expression {
 	switch text := p.scanner.TokenText(); text {
 	case "true", "false":
@@ -532,32 +1745,52 @@ func (p *parser) parseBoolean() Expression {
 }
 
 func (p *parser) parseVariable() Expression {
-	var value Expression
-
 	text := p.scanner.TokenText()
-	if p.eval {
-		if assignment, local := p.scope.Get(text); assignment == nil {
-			p.errorf("variable %q is not set", text)
-		} else {
-			if local {
-				assignment.Referenced = true
-			}
-			value = assignment.Value
-		}
-	} else {
-		value = &NotEvaluated{}
-	}
-	value = &Variable{
-		Name:    text,
-		NamePos: p.scanner.Position,
-		Value:   value,
-	}
+	value := p.newVariable(text, p.scanner.Position)
 
 	p.accept(scanner.Ident)
 	return value
 }
 
+// newVariable returns a reference to the named variable, linked to its assignment if it is in
+// scope, so that Variable.Root can find it with or without evaluating.
+func (p *parser) newVariable(name string, pos scanner.Position) *Variable {
+	v := &Variable{
+		Name:    name,
+		NamePos: pos,
+		Value:   p.variableValue(name),
+	}
+	if p.scope != nil {
+		v.assignment, _ = p.scope.Get(name)
+	}
+	return v
+}
+
+// variableValue returns the value of the named variable when evaluating, marking it as
+// referenced, or NotEvaluated otherwise.
+func (p *parser) variableValue(name string) Expression {
+	if !p.eval {
+		return &NotEvaluated{}
+	}
+	assignment, local := p.scope.Get(name)
+	if assignment == nil {
+		p.errorf("variable %q is not set", name)
+	}
+	if local {
+		assignment.Referenced = true
+	} else {
+		if p.referencedInherited == nil {
+			p.referencedInherited = make(map[string]bool)
+		}
+		p.referencedInherited[name] = true
+	}
+	return assignment.Value
+}
+
 func (p *parser) parseSelect() Expression {
+	if p.stats != nil {
+		p.stats.SelectCount++
+	}
 	result := &Select{
 		KeywordPos: p.scanner.Position,
 	}
@@ -580,12 +1813,25 @@ func (p *parser) parseSelect() Expression {
 	conditions := []ConfigurableCondition{}
 	for first := true; first || multipleConditions; first = false {
 		condition := ConfigurableCondition{
-			position:     p.scanner.Position,
-			FunctionName: p.scanner.TokenText(),
+			position: p.scanner.Position,
 		}
+		if p.tok == '!' {
+			condition.Negated = true
+			p.accept('!')
+		}
+		namePos := p.scanner.Position
+		condition.FunctionName = p.scanner.TokenText()
 		if !p.accept(scanner.Ident) {
 			return nil
 		}
+		// not is the name of the condition when it is followed by its arguments, and otherwise
+		// negates the condition that follows it.
+		if !condition.Negated && condition.FunctionName == "not" && p.tok == scanner.Ident {
+			condition.Negated = true
+			namePos = p.scanner.Position
+			condition.FunctionName = p.scanner.TokenText()
+			p.accept(scanner.Ident)
+		}
 		if !p.accept('(') {
 			return nil
 		}
@@ -605,6 +1851,10 @@ func (p *parser) parseSelect() Expression {
 		}
 		p.accept(')')
 
+		if err := checkSelectFunction(condition); err != nil {
+			p.error(&ParseError{Err: err, Pos: namePos})
+		}
+
 		for _, c := range conditions {
 			if c.Equals(condition) {
 				p.errorf("Duplicate select condition found: %s", c.String())
@@ -737,78 +1987,18 @@ func (p *parser) parseSelect() Expression {
 
 	// If all branches have the value "unset", then this is equivalent
 	// to an empty select.
-	if !hasNonUnsetValue {
-		p.errorf("This select statement is empty, remove it")
-		return nil
-	}
-
-	patternsEqual := func(a, b Expression) bool {
-		switch a2 := a.(type) {
-		case *String:
-			if b2, ok := b.(*String); ok {
-				return a2.Value == b2.Value
-			} else {
-				return false
-			}
-		case *Bool:
-			if b2, ok := b.(*Bool); ok {
-				return a2.Value == b2.Value
-			} else {
-				return false
-			}
-		default:
-			// true so that we produce an error in this unexpected scenario
-			return true
-		}
-	}
-
-	patternListsEqual := func(a, b []Expression) bool {
-		if len(a) != len(b) {
-			return false
-		}
-		for i := range a {
-			if !patternsEqual(a[i], b[i]) {
-				return false
-			}
-		}
-		return true
-	}
-
-	for i, c := range result.Cases {
-		// Check for duplicates
-		for _, d := range result.Cases[i+1:] {
-			if patternListsEqual(c.Patterns, d.Patterns) {
-				p.errorf("Found duplicate select patterns: %v", c.Patterns)
-				return nil
-			}
-		}
-		// Check that the only all-default cases is the last one
-		if i < len(result.Cases)-1 {
-			isAllDefault := true
-			for _, x := range c.Patterns {
-				if x2, ok := x.(*String); !ok || x2.Value != default_select_branch_name {
-					isAllDefault = false
-					break
-				}
-			}
-			if isAllDefault {
-				p.errorf("Found a default select branch at index %d, expected it to be last (index %d)", i, len(result.Cases)-1)
-				return nil
-			}
+	if !hasNonUnsetValue && !p.preserveUnset {
+		if !p.emptySelectWarning {
+			p.errorf("This select statement is empty, remove it")
+			return nil
 		}
+		p.warnf("This select statement is empty, remove it")
 	}
 
-	ty := UnsetType
-	for _, c := range result.Cases {
-		otherTy := c.Value.Type()
-		// Any other type can override UnsetType
-		if ty == UnsetType {
-			ty = otherTy
-		}
-		if otherTy != UnsetType && otherTy != ty {
-			p.errorf("Found select statement with differing types %q and %q in its cases", ty.String(), otherTy.String())
-			return nil
-		}
+	ty, err := checkSelectCases(result.Cases)
+	if err != nil {
+		p.error(err)
+		return nil
 	}
 
 	result.ExpressionType = ty
@@ -824,7 +2014,27 @@ func (p *parser) parseSelect() Expression {
 }
 
 func (p *parser) parseStringValue() *String {
-	str, err := strconv.Unquote(p.scanner.TokenText())
+	text := p.scanner.TokenText()
+	if p.tok == scanner.RawString {
+		// strconv.Unquote drops carriage returns from raw strings, keep the contents verbatim
+		// instead.
+		if len(text) < 2 || text[len(text)-1] != '`' {
+			p.errorf("couldn't parse string: unterminated raw string")
+			return nil
+		}
+		value := &String{
+			LiteralPos: p.scanner.Position,
+			Value:      text[1 : len(text)-1],
+			Raw:        true,
+		}
+		p.accept(p.tok)
+		return value
+	}
+
+	if p.strictEscapes {
+		p.checkEscapes(text, p.scanner.Position)
+	}
+	str, err := strconv.Unquote(text)
 	if err != nil {
 		p.errorf("couldn't parse string: %s", err)
 		return nil
@@ -838,30 +2048,200 @@ func (p *parser) parseStringValue() *String {
 	return value
 }
 
-func (p *parser) parseIntValue() *Int64 {
+// parseInterpolatedStringValue parses a string literal that may reference variables with
+// $(name).  A literal without any references is returned as a String.
+func (p *parser) parseInterpolatedStringValue() Expression {
+	text := p.scanner.TokenText()
+	if len(text) < 2 || !strings.Contains(text, "$(") {
+		return p.parseStringValue()
+	}
+
+	result := &InterpolatedString{
+		LiteralPos: p.scanner.Position,
+		Raw:        p.tok == scanner.RawString,
+	}
+	body := text[1 : len(text)-1]
+	offset := 1
+	for body != "" {
+		literal := body
+		i := strings.Index(body, "$(")
+		if i >= 0 {
+			literal = body[:i]
+		}
+		if literal != "" {
+			value := literal
+			if !result.Raw {
+				if p.strictEscapes {
+					p.checkEscapes(literal, advancePos(result.LiteralPos, text[:offset]))
+				}
+				var err error
+				value, err = strconv.Unquote(`"` + literal + `"`)
+				if err != nil {
+					p.errorf("couldn't parse string: %s", err)
+				}
+			}
+			result.Parts = append(result.Parts, &String{
+				LiteralPos: advancePos(result.LiteralPos, text[:offset]),
+				Value:      value,
+				Raw:        result.Raw,
+			})
+		}
+		if i < 0 {
+			break
+		}
+
+		offset += i + len("$(")
+		body = body[i+len("$("):]
+		end := strings.IndexByte(body, ')')
+		if end < 0 || !isIdentifier(body[:end]) {
+			p.errorf("expected $(variable) in string, found %q", "$("+body)
+		}
+		name := body[:end]
+		result.Parts = append(result.Parts, p.newVariable(name, advancePos(result.LiteralPos, text[:offset])))
+		offset += end + len(")")
+		body = body[end+len(")"):]
+	}
+
+	if p.eval {
+		values := make([]Expression, len(result.Parts))
+		for i, part := range result.Parts {
+			values[i] = part.Eval()
+		}
+		value, err := interpolatedValue(result, values)
+		if err != nil {
+			p.error(err)
+		}
+		result.Value = value
+	} else {
+		result.Value = &NotEvaluated{}
+	}
+
+	p.accept(p.tok)
+	return result
+}
+
+// interpolatedValue returns the String that an interpolated string evaluates to, given the
+// evaluated values of its parts.
+func interpolatedValue(s *InterpolatedString, values []Expression) (Expression, error) {
+	var value strings.Builder
+	for i, part := range values {
+		str, ok := part.(*String)
+		if !ok {
+			what := "a value"
+			if v, ok := s.Parts[i].(*Variable); ok {
+				what = fmt.Sprintf("variable %q", v.Name)
+			}
+			return nil, &ParseError{
+				Err: fmt.Errorf("cannot interpolate %s of type %s into a string, expected string", what, part.Type()),
+				Pos: s.LiteralPos,
+			}
+		}
+		value.WriteString(str.Value)
+	}
+	return &String{
+		LiteralPos: s.LiteralPos,
+		Value:      value.String(),
+	}, nil
+}
+
+// isIdentifier returns true if s is a valid variable name.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// checkEscapes reports an error at the first escape sequence in the quoted string text, which
+// starts at pos, that is not allowed by ParseOptions.StrictEscapes.
+func (p *parser) checkEscapes(text string, pos scanner.Position) {
+	for i := 0; i < len(text)-1; i++ {
+		if text[i] != '\\' {
+			continue
+		}
+		switch text[i+1] {
+		case 'n', 't', '\\', '"':
+			i++
+		default:
+			_, size := utf8.DecodeRuneInString(text[i+1:])
+			p.error(&ParseError{
+				Err: fmt.Errorf(`unsupported escape sequence %s in string, only \n, \t, \\ and \" are allowed`,
+					text[i:i+1+size]),
+				Pos: advancePos(pos, text[:i]),
+			})
+		}
+	}
+}
+
+// advancePos returns the position after text, which starts at pos.
+func advancePos(pos scanner.Position, text string) scanner.Position {
+	pos.Offset += len(text)
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		pos.Line += strings.Count(text, "\n")
+		pos.Column = 1
+		text = text[i+1:]
+	}
+	pos.Column += utf8.RuneCountInString(text)
+	return pos
+}
+
+func (p *parser) parseNumberValue() Expression {
 	var str string
 	literalPos := p.scanner.Position
 	if p.tok == '-' {
 		str += string(p.tok)
 		p.accept(p.tok)
-		if p.tok != scanner.Int {
-			p.errorf("expected int; found %s", scanner.TokenString(p.tok))
+		if p.tok != scanner.Int && p.tok != scanner.Float {
+			p.errorf("expected number; found %s", scanner.TokenString(p.tok))
 			return nil
 		}
 	}
 	str += p.scanner.TokenText()
-	i, err := strconv.ParseInt(str, 10, 64)
-	if err != nil {
-		p.errorf("couldn't parse int: %s", err)
-		return nil
+
+	var value Expression
+	if p.tok == scanner.Float {
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			p.errorf("couldn't parse float: %s", err)
+			return nil
+		}
+		value = &Float64{
+			LiteralPos: literalPos,
+			Value:      f,
+			Token:      str,
+		}
+	} else {
+		// Base 0 accepts the prefixes for hexadecimal, octal and binary integers.
+		i, err := strconv.ParseInt(str, 0, 64)
+		if err != nil {
+			p.errorf("couldn't parse int: %s", err)
+			return nil
+		}
+		value = &Int64{
+			LiteralPos: literalPos,
+			Value:      i,
+			Token:      str,
+		}
 	}
+	numberEnd := p.scanner.Position.Offset + len(p.scanner.TokenText())
+	p.accept(p.tok)
 
-	value := &Int64{
-		LiteralPos: literalPos,
-		Value:      i,
-		Token:      str,
+	// A suffix is scanned as an identifier immediately following the number.
+	if len(p.numericSuffixes) > 0 && p.tok == scanner.Ident && p.scanner.Position.Offset == numberEnd {
+		suffix := p.scanner.TokenText()
+		if !slices.Contains(p.numericSuffixes, suffix) {
+			p.errorf("unsupported numeric suffix %q", suffix)
+		}
+		switch v := value.(type) {
+		case *Int64:
+			v.Token += suffix
+		case *Float64:
+			v.Token += suffix
+		}
+		p.accept(scanner.Ident)
 	}
-	p.accept(scanner.Int)
 	return value
 }
 
@@ -872,9 +2252,17 @@ func (p *parser) parseListValue() *List {
 	}
 
 	var elements []Expression
-	for p.tok != ']' {
+	var valueComments [][]*CommentGroup
+	for p.tok != ']' && !(p.lenient && p.tok == scanner.EOF) {
+		comments := p.commentsBeforeToken()
 		element := p.parseExpression()
 		elements = append(elements, element)
+		if len(comments) > 0 && valueComments == nil {
+			valueComments = make([][]*CommentGroup, len(elements)-1, cap(elements))
+		}
+		if valueComments != nil {
+			valueComments = append(valueComments, attachComments(comments))
+		}
 
 		if p.tok != ',' {
 			// There was no comma, so the list is done.
@@ -884,13 +2272,16 @@ func (p *parser) parseListValue() *List {
 		p.accept(',')
 	}
 
+	trailingComments := attachComments(p.commentsBeforeToken())
 	rBracePos := p.scanner.Position
-	p.accept(']')
+	p.acceptClose(']')
 
 	return &List{
-		LBracePos: lBracePos,
-		RBracePos: rBracePos,
-		Values:    elements,
+		LBracePos:        lBracePos,
+		RBracePos:        rBracePos,
+		Values:           elements,
+		ValueComments:    valueComments,
+		TrailingComments: trailingComments,
 	}
 }
 
@@ -900,15 +2291,16 @@ func (p *parser) parseMapValue() *Map {
 		return nil
 	}
 
-	properties := p.parsePropertyList(false, false)
+	properties, trailingComments := p.parsePropertyList(false, false)
 
 	rBracePos := p.scanner.Position
-	p.accept('}')
+	p.acceptClose('}')
 
 	return &Map{
-		LBracePos:  lBracePos,
-		RBracePos:  rBracePos,
-		Properties: properties,
+		LBracePos:        lBracePos,
+		RBracePos:        rBracePos,
+		Properties:       properties,
+		TrailingComments: trailingComments,
 	}
 }
 
@@ -935,6 +2327,22 @@ func NewScope(s *Scope) *Scope {
 	return newScope
 }
 
+// Clone returns a copy of the scope whose assignments can be modified without affecting the
+// original scope.
+func (s *Scope) Clone() *Scope {
+	clone := &Scope{
+		vars:          make(map[string]*Assignment, len(s.vars)),
+		inheritedVars: make(map[string]*Assignment, len(s.inheritedVars)),
+	}
+	for k, v := range s.vars {
+		clone.vars[k] = v.copy()
+	}
+	for k, v := range s.inheritedVars {
+		clone.inheritedVars[k] = v.copy()
+	}
+	return clone
+}
+
 func (s *Scope) Add(assignment *Assignment) error {
 	if old, ok := s.vars[assignment.Name]; ok {
 		return fmt.Errorf("variable already set, previous assignment: %s", old)
@@ -966,26 +2374,274 @@ func (s *Scope) Get(name string) (*Assignment, bool) {
 	return nil, false
 }
 
-func (s *Scope) String() string {
+// Names returns the sorted names of the variables in the scope, both local and inherited.
+func (s *Scope) Names() []string {
 	vars := []string{}
 
 	for k := range s.vars {
 		vars = append(vars, k)
 	}
 	for k := range s.inheritedVars {
-		vars = append(vars, k)
+		if _, ok := s.vars[k]; !ok {
+			vars = append(vars, k)
+		}
 	}
 
 	sort.Strings(vars)
+	return vars
+}
 
-	ret := []string{}
-	for _, v := range vars {
-		if assignment, ok := s.vars[v]; ok {
-			ret = append(ret, assignment.String())
-		} else {
-			ret = append(ret, s.inheritedVars[v].String())
+// ForEach calls fn for each variable in the scope in sorted order, along with whether the
+// variable is local to the scope or inherited.  A local variable shadows an inherited variable
+// with the same name.
+func (s *Scope) ForEach(fn func(name string, a *Assignment, local bool)) {
+	for _, name := range s.Names() {
+		a, local := s.Get(name)
+		fn(name, a, local)
+	}
+}
+
+// CheckReferenceCycles returns an error for each cycle of variables in scope whose values refer
+// to each other, which would recurse forever when evaluated.  The parser never creates such a
+// cycle, but a scope built or modified directly can contain one.
+func CheckReferenceCycles(scope *Scope) []error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var errs []error
+	var path []*Assignment
+
+	var visit func(a *Assignment)
+	visit = func(a *Assignment) {
+		state[a.Name] = visiting
+		path = append(path, a)
+
+		var refs []string
+		Walk(a.Value, func(n Node) bool {
+			if v, ok := n.(*Variable); ok {
+				refs = append(refs, v.Name)
+			}
+			return true
+		})
+		for _, name := range refs {
+			ref, _ := scope.Get(name)
+			if ref == nil {
+				continue
+			}
+			switch state[name] {
+			case unvisited:
+				visit(ref)
+			case visiting:
+				start := len(path) - 1
+				for path[start].Name != name {
+					start--
+				}
+				var names []string
+				for _, p := range path[start:] {
+					names = append(names, fmt.Sprintf("%s (%s)", p.Name, p.NamePos))
+				}
+				names = append(names, name)
+				errs = append(errs, &ParseError{
+					Err: fmt.Errorf("variable reference cycle: %s", strings.Join(names, " -> ")),
+					Pos: ref.NamePos,
+				})
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[a.Name] = done
+	}
+
+	scope.ForEach(func(name string, a *Assignment, local bool) {
+		if state[name] == unvisited {
+			visit(a)
+		}
+	})
+	return errs
+}
+
+// ScopeDiffKind describes how a variable differs between two scopes.
+type ScopeDiffKind int
+
+const (
+	// VariableAdded is a variable that is only in the second scope.
+	VariableAdded ScopeDiffKind = iota
+	// VariableRemoved is a variable that is only in the first scope.
+	VariableRemoved
+	// VariableChanged is a variable that is in both scopes with different values.
+	VariableChanged
+)
+
+func (k ScopeDiffKind) String() string {
+	switch k {
+	case VariableAdded:
+		return "added"
+	case VariableRemoved:
+		return "removed"
+	case VariableChanged:
+		return "changed"
+	default:
+		panic(fmt.Errorf("Unknown scope diff kind %d", k))
+	}
+}
+
+// A ScopeDiff is a variable that differs between two scopes.  Old is nil for an added variable
+// and New is nil for a removed variable.
+type ScopeDiff struct {
+	Name string
+	Kind ScopeDiffKind
+	Old  *Assignment
+	New  *Assignment
+}
+
+// DiffScopes returns the variables, local or inherited, that differ between scopes a and b,
+// sorted by name.
+func DiffScopes(a, b *Scope) []ScopeDiff {
+	names := append(a.Names(), b.Names()...)
+	sort.Strings(names)
+
+	var ret []ScopeDiff
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		old, _ := a.Get(name)
+		new, _ := b.Get(name)
+		switch {
+		case old == nil:
+			ret = append(ret, ScopeDiff{Name: name, Kind: VariableAdded, New: new})
+		case new == nil:
+			ret = append(ret, ScopeDiff{Name: name, Kind: VariableRemoved, Old: old})
+		default:
+			if same, _ := ExpressionsAreSame(old.Value.Eval(), new.Value.Eval()); !same {
+				ret = append(ret, ScopeDiff{Name: name, Kind: VariableChanged, Old: old, New: new})
+			}
 		}
 	}
+	return ret
+}
+
+func (s *Scope) String() string {
+	ret := []string{}
+	s.ForEach(func(name string, a *Assignment, local bool) {
+		ret = append(ret, a.String())
+	})
 
 	return strings.Join(ret, "\n")
 }
+
+// lineContinuations records the backslash-newline sequences removed by joinLineContinuations so
+// that positions in the joined input can be mapped back to the original input.
+type lineContinuations struct {
+	src        []byte
+	lineStarts []int
+	// offsets holds the offset in the joined input of each removed continuation, and removed
+	// holds the total number of bytes removed up to and including that continuation.
+	offsets []int
+	removed []int
+}
+
+// joinLineContinuations removes each backslash that is immediately followed by a newline, along
+// with the newline, outside of raw strings and comments.
+func joinLineContinuations(src []byte) ([]byte, *lineContinuations) {
+	c := &lineContinuations{src: src, lineStarts: []int{0}}
+	joined := make([]byte, 0, len(src))
+
+	const (
+		code = iota
+		quoted
+		raw
+		lineComment
+		blockComment
+	)
+	state := code
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+		if ch == '\n' {
+			c.lineStarts = append(c.lineStarts, i+1)
+		}
+
+		if ch == '\\' && state != raw && state != lineComment && state != blockComment {
+			n := 0
+			if i+1 < len(src) && src[i+1] == '\n' {
+				n = 2
+			} else if i+2 < len(src) && src[i+1] == '\r' && src[i+2] == '\n' {
+				n = 3
+			}
+			if n > 0 {
+				c.lineStarts = append(c.lineStarts, i+n)
+				total := n
+				if len(c.removed) > 0 {
+					total += c.removed[len(c.removed)-1]
+				}
+				c.offsets = append(c.offsets, len(joined))
+				c.removed = append(c.removed, total)
+				i += n - 1
+				continue
+			}
+		}
+
+		joined = append(joined, ch)
+
+		switch state {
+		case code:
+			switch {
+			case ch == '"':
+				state = quoted
+			case ch == '`':
+				state = raw
+			case ch == '/' && i+1 < len(src) && src[i+1] == '/':
+				state = lineComment
+			case ch == '/' && i+1 < len(src) && src[i+1] == '*':
+				state = blockComment
+				joined = append(joined, src[i+1])
+				i++
+			}
+		case quoted:
+			if ch == '\\' && i+1 < len(src) {
+				joined = append(joined, src[i+1])
+				i++
+			} else if ch == '"' || ch == '\n' {
+				state = code
+			}
+		case raw:
+			if ch == '`' {
+				state = code
+			}
+		case lineComment:
+			if ch == '\n' {
+				state = code
+			}
+		case blockComment:
+			if ch == '*' && i+1 < len(src) && src[i+1] == '/' {
+				state = code
+				joined = append(joined, src[i+1])
+				i++
+			}
+		}
+	}
+
+	return joined, c
+}
+
+// originalPos converts a position in the joined input into the corresponding position in the
+// original input.
+func (c *lineContinuations) originalPos(pos scanner.Position) scanner.Position {
+	if !pos.IsValid() {
+		return pos
+	}
+	// Find the number of continuations removed at or before this offset.
+	n := sort.SearchInts(c.offsets, pos.Offset+1)
+	if n == 0 {
+		return pos
+	}
+	offset := pos.Offset + c.removed[n-1]
+	line := sort.SearchInts(c.lineStarts, offset+1)
+	pos.Offset = offset
+	pos.Line = line
+	pos.Column = utf8.RuneCount(c.src[c.lineStarts[line-1]:offset]) + 1
+	return pos
+}
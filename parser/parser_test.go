@@ -16,11 +16,18 @@ package parser
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 	"text/scanner"
+	"unicode"
 )
 
 func mkpos(offset, line, column int) scanner.Position {
@@ -183,6 +190,7 @@ var validParseTestCases = []struct {
 									&String{
 										LiteralPos: mkpos(57, 4, 13),
 										Value:      "bnm,\n",
+										Raw:        true,
 									},
 								},
 							},
@@ -434,6 +442,17 @@ var validParseTestCases = []struct {
 								Value:      true,
 								Token:      "true",
 							},
+							Comments: []*CommentGroup{
+								{
+									Comments: []*Comment{
+										&Comment{
+											Comment: []string{"// comment2"},
+											Slash:   mkpos(37, 4, 4),
+										},
+									},
+									attached: true,
+								},
+							},
 						},
 					},
 				},
@@ -463,6 +482,7 @@ var validParseTestCases = []struct {
 						Slash:   mkpos(37, 4, 4),
 					},
 				},
+				attached: true,
 			},
 			{
 				Comments: []*Comment{
@@ -544,6 +564,7 @@ var validParseTestCases = []struct {
 						},
 					},
 				},
+				BlankLinesBefore: 1,
 			},
 		},
 		nil,
@@ -1183,6 +1204,8 @@ func TestParseValidInput(t *testing.T) {
 
 			if len(file.Defs) == len(testCase.defs) {
 				for i := range file.Defs {
+					// The links from variables to their assignments are checked in TestVariableRoot.
+					unlinkVariables(file.Defs[i])
 					if !reflect.DeepEqual(file.Defs[i], testCase.defs[i]) {
 						t.Errorf("test case: %s", testCase.input)
 						t.Errorf("incorrect definition %d:", i)
@@ -1214,6 +1237,32 @@ func TestParseValidInput(t *testing.T) {
 	}
 }
 
+// unlinkVariables clears the assignments of the variables referenced in node, which the test
+// cases can't easily include.
+func unlinkVariables(node Node) {
+	switch n := node.(type) {
+	case *Assignment:
+		unlinkVariables(n.Value)
+		unlinkVariables(n.OrigValue)
+	case *Module:
+		unlinkVariables(&n.Map)
+	case *Map:
+		for _, prop := range n.Properties {
+			unlinkVariables(prop.Value)
+		}
+	case *List:
+		for _, value := range n.Values {
+			unlinkVariables(value)
+		}
+	case *Operator:
+		unlinkVariables(n.Args[0])
+		unlinkVariables(n.Args[1])
+	case *Variable:
+		n.assignment = nil
+		unlinkVariables(n.Value)
+	}
+}
+
 func TestParserError(t *testing.T) {
 	testcases := []struct {
 		name  string
@@ -1336,3 +1385,1873 @@ func TestParserNotEvaluated(t *testing.T) {
 		t.Errorf("Attempt to print FOO returned %s", s)
 	}
 }
+
+func TestParseLineContinuations(t *testing.T) {
+	input := "foo {\n" +
+		"    srcs: [\"a.c\", \\\n" +
+		"        \"b.c\"],\n" +
+		"    name: \"f\\\n" +
+		"oo\",\n" +
+		"    cmd: `x \\\n" +
+		"y`,\n" +
+		"}\n"
+
+	if _, errs := Parse("", bytes.NewBufferString(input), NewScope(nil)); len(errs) == 0 {
+		t.Fatalf("expected an error parsing continuations without AllowLineContinuations")
+	}
+
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{AllowLineContinuations: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	mod := file.Defs[0].(*Module)
+	srcs := mod.Properties[0].Value.(*List)
+	if len(srcs.Values) != 2 {
+		t.Fatalf("expected 2 srcs, got %s", srcs)
+	}
+	if g, w := srcs.Values[1].Pos(), mkpos(34, 3, 9); g != w {
+		t.Errorf("expected continued element at %s, got %s", w, g)
+	}
+	if g, w := mod.Properties[1].NamePos, mkpos(46, 4, 5); g != w {
+		t.Errorf("expected property after continuation at %s, got %s", w, g)
+	}
+	if g, w := mod.Properties[1].Value.(*String).Value, "foo"; g != w {
+		t.Errorf("expected continued string %q, got %q", w, g)
+	}
+	if g, w := mod.Properties[2].Value.(*String).Value, "x \\\ny"; g != w {
+		t.Errorf("expected raw string %q to be unchanged, got %q", w, g)
+	}
+	if g, w := mod.RBracePos, mkpos(len(input)-2, 8, 1); g != w {
+		t.Errorf("expected closing brace at %s, got %s", w, g)
+	}
+}
+
+func TestParseListOfMaps(t *testing.T) {
+	input := `
+foo {
+    list: [
+        {
+            name: "a",
+            value: "x",
+        },
+        {name: "b", value: "y"},
+    ],
+}
+`
+	file, errs := ParseAndEval("", bytes.NewBufferString(input), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	list := file.Defs[0].(*Module).Properties[0].Value.(*List)
+	if len(list.Values) != 2 {
+		t.Fatalf("expected 2 maps, got %s", list)
+	}
+	first, ok := list.Values[0].(*Map)
+	if !ok {
+		t.Fatalf("expected a map, got %s", list.Values[0])
+	}
+	second, ok := list.Values[1].(*Map)
+	if !ok {
+		t.Fatalf("expected a map, got %s", list.Values[1])
+	}
+	if g, w := first.Pos(), mkpos(27, 4, 9); g != w {
+		t.Errorf("expected first map at %s, got %s", w, g)
+	}
+	if g, w := first.End(), mkpos(85, 7, 10); g != w {
+		t.Errorf("expected first map to end at %s, got %s", w, g)
+	}
+	if g, w := second.Pos(), mkpos(95, 8, 9); g != w {
+		t.Errorf("expected second map at %s, got %s", w, g)
+	}
+	if g, w := list.End(), mkpos(125, 9, 6); g != w {
+		t.Errorf("expected list to end at %s, got %s", w, g)
+	}
+	for i, m := range []*Map{first, second} {
+		if g, w := len(m.Properties), 2; g != w {
+			t.Errorf("expected %d properties in map %d, got %d", w, i, g)
+		}
+	}
+}
+
+func TestParseMaxErrors(t *testing.T) {
+	input := `
+m1 {
+    x: ,
+}
+m2 {
+    y: ["a" "b"],
+}
+m3 {
+    z: undefined,
+}
+good {
+    name: "good",
+}
+`
+	parse := func(maxErrors int) (*File, []error) {
+		return ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+			ParseOptions{Eval: true, MaxErrors: maxErrors})
+	}
+
+	file, errs := parse(2)
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if file != nil {
+		t.Errorf("expected no file when the error limit is reached")
+	}
+
+	file, errs = parse(0)
+	expected := []string{
+		`<input>:3:8: expected bool, list, or string value; found ","`,
+		`<input>:6:13: expected "]", found String`,
+		`<input>:9:8: variable "undefined" is not set`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i := range expected {
+		if g, w := errs[i].Error(), expected[i]; g != w {
+			t.Errorf("expected error %d to be %q, got %q", i, w, g)
+		}
+	}
+	if file == nil || len(file.Defs) != 1 {
+		t.Fatalf("expected the valid module to be returned, got %v", file)
+	}
+	if g, w := file.Defs[0].(*Module).Name(), "good"; g != w {
+		t.Errorf("expected module %q, got %q", w, g)
+	}
+}
+
+func TestParseExpressionError(t *testing.T) {
+	value, errs := ParseExpression(bytes.NewBufferString(`["a" +]`))
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+	if value != nil {
+		t.Errorf("expected no value, got %s", value)
+	}
+}
+
+func TestParseLenientUnclosed(t *testing.T) {
+	input := `
+foo {
+    name: "foo",
+    arch: {
+        arm: {
+            srcs: ["a.c",
+`
+	if _, errs := Parse("", bytes.NewBufferString(input), NewScope(nil)); len(errs) != 1 {
+		t.Errorf("expected 1 error without Lenient, got %v", errs)
+	}
+
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{MaxErrors: 1, Lenient: true})
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	if g, w := errs[0].Error(), `<input>:7:1: expected "]", found EOF`; g != w {
+		t.Errorf("expected error %q, got %q", w, g)
+	}
+	if file == nil || len(file.Defs) != 1 {
+		t.Fatalf("expected a partial module, got %v", file)
+	}
+
+	mod := file.Defs[0].(*Module)
+	if g, w := mod.Name(), "foo"; g != w {
+		t.Errorf("expected module %q, got %q", w, g)
+	}
+	arch, _ := mod.GetProperty("arch")
+	arm, _ := arch.Value.(*Map).GetProperty("arm")
+	srcs, found := arm.Value.(*Map).GetProperty("srcs")
+	if !found {
+		t.Fatalf("expected to find arch.arm.srcs")
+	}
+	if values := srcs.Value.(*List).Values; len(values) != 1 || values[0].(*String).Value != "a.c" {
+		t.Errorf("expected srcs to contain a.c, got %s", srcs.Value)
+	}
+}
+
+func TestParseListSubtraction(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "removes all occurrences",
+			input:    `x = ["a", "b", "c", "a"] - ["a", "c"]`,
+			expected: []string{"b"},
+		},
+		{
+			name:     "left associative",
+			input:    `x = ["a", "b", "c"] - ["a"] - ["b"]`,
+			expected: []string{"c"},
+		},
+		{
+			name:     "after addition",
+			input:    `x = ["a"] + ["b"] - ["a"]`,
+			expected: []string{"b"},
+		},
+		{
+			name: "variables",
+			input: `
+remove = ["b"]
+x = ["a", "b"] - remove`,
+			expected: []string{"a"},
+		},
+		{
+			name:  "list from string",
+			input: `x = "a" - ["a"]`,
+			err:   "mismatched type in operator -: string != list",
+		},
+		{
+			name:  "strings",
+			input: `x = "ab" - "b"`,
+			err:   "operator - not supported on type string",
+		},
+		{
+			name:  "select",
+			input: `x = ["a"] - select(arch(), {"arm": ["b"], default: [],})`,
+			err:   "operator - not supported on select statements",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			var got []string
+			for _, v := range x.Value.Eval().(*List).Values {
+				got = append(got, v.Eval().(*String).Value)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseIntSubtraction(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+		err      string
+	}{
+		{input: "x = 10 - 3", expected: 7},
+		{input: "x = 10 - 3 - 2", expected: 5},
+		{input: "x = 10 - -3", expected: 13},
+		{input: "x = 1 + 2 - 4", expected: -1},
+		{input: "a = 4\nx = a - 1", expected: 3},
+		{input: `x = 10 - "3"`, err: "mismatched type in operator -: int64 != string"},
+		{input: "x = {a: 1} - {a: 1}", err: "operator - not supported on type map"},
+		{
+			input: `x = 1 - select(arch(), {"arm": 1, default: 2,})`,
+			err:   "operator - not supported on select statements",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			got := x.Value.Eval().(*Int64)
+			if got.Value != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got.Value)
+			}
+			if got.Token != "" {
+				t.Errorf("expected the computed value to have no token, got %q", got.Token)
+			}
+		})
+	}
+}
+
+func TestParseFloat(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected float64
+		err      string
+	}{
+		{input: "x = 0.8", expected: 0.8},
+		{input: "x = -1.5", expected: -1.5},
+		{input: "x = 1e3", expected: 1000},
+		{input: "x = 0.5 + 0.25", expected: 0.75},
+		{input: "x = 1.0 - 0.25", expected: 0.75},
+		{input: "x = 1.5 + 1", err: "mismatched type in operator +: float64 != int64"},
+		{
+			input: `x = 1.5 - select(arch(), {"arm": 1.0, default: 2.0,})`,
+			err:   "operator - not supported on select statements",
+		},
+		{input: "x = - a", err: "expected number; found Ident"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			got, ok := x.Value.Eval().(*Float64)
+			if !ok {
+				t.Fatalf("expected a float64, got %s", x.Value.Type())
+			}
+			if got.Value != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got.Value)
+			}
+		})
+	}
+}
+
+func TestParseIntBases(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+	}{
+		{input: "x = 0xFF", expected: 255},
+		{input: "x = 0o755", expected: 493},
+		{input: "x = 0755", expected: 493},
+		{input: "x = 0b101", expected: 5},
+		{input: "x = -0x10", expected: -16},
+		{input: "x = 0x10 - 1", expected: 15},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			got := x.Value.Eval().(*Int64)
+			if got.Value != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got.Value)
+			}
+		})
+	}
+}
+
+func TestScopeClone(t *testing.T) {
+	parent := NewScope(nil)
+	_, errs := ParseAndEval("", bytes.NewBufferString(`inherited = "a"`), parent)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	scope := NewScope(parent)
+	_, errs = ParseAndEval("", bytes.NewBufferString(`
+list = ["b"]
+x = inherited
+`), scope)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	clone := scope.Clone()
+	if clone.String() != scope.String() {
+		t.Fatalf("expected clone:\n%s\ngot:\n%s", scope, clone)
+	}
+
+	list, _ := clone.Get("list")
+	list.Value.(*List).Values[0].(*String).Value = "c"
+	list.Referenced = true
+	inherited, local := clone.Get("inherited")
+	if local {
+		t.Errorf("expected inherited variable to stay inherited in the clone")
+	}
+	inherited.Value = &String{Value: "changed"}
+	clone.Remove("x")
+	if err := clone.Add(&Assignment{Name: "y", Value: &Bool{Value: true}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	orig, _ := scope.Get("list")
+	if got := orig.Value.(*List).Values[0].(*String).Value; got != "b" {
+		t.Errorf("expected original list to be unchanged, got %q", got)
+	}
+	if orig.Referenced {
+		t.Errorf("expected original Referenced to be unchanged")
+	}
+	if orig, _ := scope.Get("inherited"); orig.Value.(*String).Value != "a" {
+		t.Errorf("expected original inherited variable to be unchanged, got %s", orig.Value)
+	}
+	if a, _ := scope.Get("x"); a == nil {
+		t.Errorf("expected x to still be set in the original scope")
+	}
+	if a, _ := scope.Get("y"); a != nil {
+		t.Errorf("expected y not to be set in the original scope")
+	}
+}
+
+func TestScopeForEach(t *testing.T) {
+	parent := NewScope(nil)
+	parent.Add(&Assignment{Name: "b", Value: &String{Value: "parent"}})
+	parent.Add(&Assignment{Name: "a", Value: &String{Value: "parent"}})
+	scope := NewScope(parent)
+	// Inherited variables can only be shadowed by modifying the scope directly.
+	scope.vars["b"] = &Assignment{Name: "b", Value: &String{Value: "local"}}
+	scope.Add(&Assignment{Name: "c", Value: &String{Value: "local"}})
+
+	if got, w := scope.Names(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected names %q, got %q", w, got)
+	}
+
+	var got []string
+	scope.ForEach(func(name string, a *Assignment, local bool) {
+		got = append(got, fmt.Sprintf("%s=%s %t", name, a.Value.(*String).Value, local))
+	})
+	if w := []string{"a=parent false", "b=local true", "c=local true"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+}
+
+func TestParseIdentRune(t *testing.T) {
+	input := `
+cc-library {
+    name: "foo",
+    export-headers: true,
+    count: 3 - 1,
+}
+`
+	if _, errs := Parse("", bytes.NewBufferString(input), NewScope(nil)); len(errs) == 0 {
+		t.Errorf("expected hyphenated module type to fail with the default identifier rule")
+	}
+
+	hyphenated := func(ch rune, i int) bool {
+		return ch == '_' || unicode.IsLetter(ch) || (i > 0 && (ch == '-' || unicode.IsDigit(ch)))
+	}
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{Eval: true, MaxErrors: 1, IdentRune: hyphenated})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[0].(*Module)
+	if module.Type != "cc-library" {
+		t.Errorf("expected module type cc-library, got %q", module.Type)
+	}
+	if _, found := module.GetProperty("export-headers"); !found {
+		t.Errorf("expected property export-headers")
+	}
+	count, _ := module.GetProperty("count")
+	if got := count.Value.Eval().(*Int64).Value; got != 2 {
+		t.Errorf("expected count 2, got %d", got)
+	}
+}
+
+func TestParseMemberAccess(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{input: "m = {a: {b: \"x\"}}\ny = m.a.b", expected: `"x"`},
+		{input: "y = {a: \"x\"}.a", expected: `"x"`},
+		{input: "m = {a: [\"x\"]}\ny = m.a + [\"z\"]", expected: `["x", "z"]`},
+		{input: "m = {a: \"x\"}\ny = m.b", err: `map has no property "b"`},
+		{input: "s = \"x\"\ny = s.a", err: `cannot access property "a" of a string`},
+		{input: "m = {a: \"x\"}\ny = m.", err: "expected property name after '.', found EOF"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			y, _ := scope.Get("y")
+			expected, errs := ParseExpression(bytes.NewBufferString(tt.expected))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if same, _ := ExpressionsAreSame(y.Value.Eval(), expected); !same {
+				t.Errorf("expected %s, got %s", tt.expected, y.Value.Eval())
+			}
+		})
+	}
+
+	file := parseForTest(t, "y = m.a")
+	access, ok := file.Defs[0].(*Assignment).Value.(*MemberAccess)
+	if !ok {
+		t.Fatalf("expected a member access, got %s", file.Defs[0].(*Assignment).Value)
+	}
+	if access.Name != "a" || access.Type() != NotEvaluatedType {
+		t.Errorf("expected an unevaluated access to a, got %s", access)
+	}
+}
+
+func TestParseIndexAccess(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{input: "l = [\"a\", \"b\"]\ny = l[1]", expected: `"b"`},
+		{input: "y = [\"a\", \"b\"][0]", expected: `"a"`},
+		{input: "i = 1\nl = [[\"a\"], [\"b\", \"c\"]]\ny = l[i][1 - 1]", expected: `"b"`},
+		{input: "m = {a: [\"x\"]}\ny = m.a[0]", expected: `"x"`},
+		{input: "l = [{a: \"x\"}]\ny = l[0].a", expected: `"x"`},
+		{input: "l = [\"a\"]\ny = l[1]", err: "2:8: list index 1 out of range for a list of length 1"},
+		{input: "l = [\"a\"]\ny = l[-1]", err: "list index -1 out of range"},
+		{input: "l = [\"a\"]\ny = l[\"a\"]", err: "list index must be an int64, found string"},
+		{input: "s = \"a\"\ny = s[0]", err: "cannot index a string"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			y, _ := scope.Get("y")
+			expected, errs := ParseExpression(bytes.NewBufferString(tt.expected))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if same, _ := ExpressionsAreSame(y.Value.Eval(), expected); !same {
+				t.Errorf("expected %s, got %s", tt.expected, y.Value.Eval())
+			}
+		})
+	}
+}
+
+func TestParseEmptySelectWarning(t *testing.T) {
+	input := `
+foo {
+    cflags: select(soong_config_variable("my_namespace", "my_variable"), {
+        "a": unset,
+        default: unset,
+    }),
+}
+`
+	_, errs := Parse("", bytes.NewBufferString(input), NewScope(nil))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "This select statement is empty") {
+		t.Errorf("expected an empty select error, got %v", errs)
+	}
+
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{MaxErrors: 1, EmptySelectWarning: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(file.Warnings) != 1 || file.Warnings[0].Error() != "<input>:6:5: This select statement is empty, remove it" {
+		t.Errorf("expected an empty select warning, got %v", file.Warnings)
+	}
+	if cflags, found := file.Defs[0].(*Module).GetProperty("cflags"); found {
+		t.Errorf("expected the unset property to be left out, got %s", cflags)
+	}
+}
+
+func TestPreserveUnset(t *testing.T) {
+	input := `
+foo {
+    name: "foo",
+    cflags: select(soong_config_variable("my_namespace", "my_variable"), {
+        "a": unset,
+        default: unset,
+    }),
+    arch: {
+        arm: {
+            srcs: select(arch(), {
+                "arm": unset,
+                default: unset,
+            }),
+        },
+    },
+}
+`
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{MaxErrors: 1, PreserveUnset: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(file.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", file.Warnings)
+	}
+
+	module := file.Defs[0].(*Module)
+	cflags, found := module.GetProperty("cflags")
+	if !found {
+		t.Fatalf("expected the unset cflags property to be kept")
+	}
+	if cflags.Value.Type() != UnsetType {
+		t.Errorf("expected the cflags property to be unset, got %s", cflags.Value.Type())
+	}
+	for _, c := range cflags.Value.(*Select).Cases {
+		if _, ok := c.Value.(UnsetProperty); !ok {
+			t.Errorf("expected an unset case, got %s", c.Value)
+		}
+	}
+	if _, found := module.GetPropertyPath("arch", "arm", "srcs"); !found {
+		t.Errorf("expected the unset srcs property in the arch map to be kept")
+	}
+
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != input[1:] {
+		t.Errorf("expected:\n%s\ngot:\n%s", input[1:], got)
+	}
+}
+
+func TestListAndMapComments(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    // about deps
+    deps: [
+        // why libc
+        "libc", // for libc
+        // why libz
+        "libz",
+        // after libz
+    ],
+    props: {
+        a: 1, // for a
+
+        // about b
+        b: 2,
+        // after b
+    },
+    // after props
+}
+`)
+	text := func(groups []*CommentGroup) []string {
+		var ret []string
+		for _, cg := range groups {
+			for _, c := range cg.Comments {
+				ret = append(ret, strings.Join(c.Comment, "\n"))
+			}
+		}
+		return ret
+	}
+	check := func(name string, groups []*CommentGroup, expected ...string) {
+		t.Helper()
+		if got := text(groups); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected comments %q, got %q", name, expected, got)
+		}
+	}
+
+	module := file.Defs[0].(*Module)
+	deps, _ := module.GetProperty("deps")
+	check("deps", deps.Comments, "// about deps")
+	list := deps.Value.(*List)
+	check("libc", list.ValueComments[0], "// why libc")
+	check("libz", list.ValueComments[1], "// why libz")
+	check("end of list", list.TrailingComments, "// after libz")
+
+	props, _ := module.GetProperty("props")
+	check("props", props.Comments)
+	m := props.Value.(*Map)
+	check("a", m.Properties[0].Comments)
+	check("b", m.Properties[1].Comments, "// about b")
+	check("end of map", m.TrailingComments, "// after b")
+	check("end of module", module.TrailingComments, "// after props")
+
+	// Every comment is still in the File, including the ones at the end of a line.
+	if len(file.Comments) != 9 {
+		t.Errorf("expected 9 comment groups in the file, got %d: %v", len(file.Comments), file.Comments)
+	}
+}
+
+func TestParseStream(t *testing.T) {
+	input := `
+cflags = ["-Wall"]
+foo {
+    name: "a",
+}
+
+// A comment
+bar {
+    name: "b",
+    cflags: cflags,
+}
+`
+	var got []string
+	scope := NewScope(nil)
+	errs := ParseStream("", bytes.NewBufferString(input), scope, func(def Definition) error {
+		switch def := def.(type) {
+		case *Assignment:
+			got = append(got, fmt.Sprintf("%s %d", def.Name, def.BlankLinesBefore))
+		case *Module:
+			got = append(got, fmt.Sprintf("%s %d", def.Name(), def.BlankLinesBefore))
+		}
+		return nil
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if w := []string{"cflags 0", "a 0", "b 1"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected definitions %q, got %q", w, got)
+	}
+	if _, found := scope.Get("cflags"); !found {
+		t.Errorf("expected the assignment to be added to the scope")
+	}
+
+	// An error from the callback stops parsing.
+	errStop := errors.New("stop")
+	got = nil
+	errs = ParseStream("", bytes.NewBufferString(input), NewScope(nil), func(def Definition) error {
+		if m, ok := def.(*Module); ok {
+			got = append(got, m.Name())
+			return errStop
+		}
+		return nil
+	})
+	if len(errs) != 1 || errs[0] != errStop {
+		t.Errorf("expected the callback error, got %v", errs)
+	}
+	if w := []string{"a"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected definitions %q, got %q", w, got)
+	}
+
+	errs = ParseStream("", bytes.NewBufferString("foo {\n    name: ,\n}\n"), NewScope(nil),
+		func(Definition) error {
+			t.Errorf("unexpected definition")
+			return nil
+		})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "<input>:2:11") {
+		t.Errorf("expected a parse error, got %v", errs)
+	}
+}
+
+func TestDiffScopes(t *testing.T) {
+	parse := func(parent *Scope, input string) *Scope {
+		scope := NewScope(parent)
+		if _, errs := ParseAndEval("", bytes.NewBufferString(input), scope); len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return scope
+	}
+	parent := parse(nil, `inherited = ["a"]`)
+	a := parse(parent, `
+same = "x"
+changed = ["b"]
+removed = true
+`)
+	b := parse(nil, `
+inherited = ["a"]
+same = "x"
+changed = ["b"] + ["c"]
+added = 1
+`)
+
+	var got []string
+	for _, diff := range DiffScopes(a, b) {
+		got = append(got, diff.Name+" "+diff.Kind.String())
+	}
+	if w := []string{"added added", "changed changed", "removed removed"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+
+	if diffs := DiffScopes(a, a.Clone()); len(diffs) != 0 {
+		t.Errorf("expected no differences from a clone, got %v", diffs)
+	}
+}
+
+func TestUnusedAssignments(t *testing.T) {
+	scope := NewScope(nil)
+	file, errs := ParseAndEval("", bytes.NewBufferString(`
+unused = ["a"]
+appended = ["b"]
+appended += ["c"]
+used_by_append = ["d"]
+list = ["e"]
+list += used_by_append
+used_by_select = ["f"]
+config = {srcs: ["g"]}
+foo {
+    name: "foo",
+    srcs: list + select(arch(), {
+        "arm": used_by_select,
+        default: [],
+    }) + config.srcs,
+}
+`), scope)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var got []string
+	for _, a := range file.UnusedAssignments(scope) {
+		got = append(got, a.Name)
+	}
+	if w := []string{"unused", "appended"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+}
+
+func TestParseEmptyCollectionOperators(t *testing.T) {
+	testCases := []struct {
+		input string
+		err   string
+	}{
+		{input: `x = [] + ["a"]`},
+		{input: `x = ["a"] + []`},
+		{input: `x = {} + {a: 1}`},
+		{
+			input: `x = [] + 1`,
+			err:   "mismatched type in operator +: list != int64 (the empty list [] can't be combined with the int64 value 1)",
+		},
+		{
+			input: `x = "a" + {}`,
+			err:   `mismatched type in operator +: string != map (the string value "a" can't be combined with the empty map {})`,
+		},
+		{
+			input: `x = ["a"] + "b"`,
+			err:   `mismatched type in operator +: list != string (a list can't be combined with the string value "b")`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), NewScope(nil))
+			if tt.err == "" {
+				if len(errs) != 0 {
+					t.Errorf("unexpected errors: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+				t.Errorf("expected error %q, got %v", tt.err, errs)
+			}
+		})
+	}
+}
+
+func TestAssignmentStats(t *testing.T) {
+	file := parseForTest(t, `
+a = ["a"]
+a += ["b"]
+b = "b"
+a += ["c"]
+c = 1
+foo {
+    name: "foo",
+}
+`)
+	if got, w := file.AssignmentStats(), map[string]int{"=": 3, "+=": 2}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %v, got %v", w, got)
+	}
+}
+
+func TestCheckReferenceCycles(t *testing.T) {
+	scope := NewScope(nil)
+	_, errs := ParseAndEval("vars.bp", bytes.NewBufferString(`
+a = ["a"]
+b = a + ["b"]
+c = ["c"]
+d = "d"
+`), scope)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if errs := CheckReferenceCycles(scope); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	// Make a refer to c, and c refer back to b, which refers to a.
+	a, _ := scope.Get("a")
+	c, _ := scope.Get("c")
+	a.Value = &Variable{Name: "c", Value: c.Value}
+	b, _ := scope.Get("b")
+	c.Value = &Operator{
+		Args:     [2]Expression{&List{}, &Variable{Name: "b", Value: b.Value}},
+		Operator: '+',
+	}
+	// d refers to itself.
+	d, _ := scope.Get("d")
+	d.Value = &Variable{Name: "d", Value: d.Value}
+
+	var got []string
+	for _, err := range CheckReferenceCycles(scope) {
+		got = append(got, err.Error())
+	}
+	w := []string{
+		"vars.bp:2:1: variable reference cycle: a (vars.bp:2:1) -> c (vars.bp:4:1) -> b (vars.bp:3:1) -> a",
+		"vars.bp:5:1: variable reference cycle: d (vars.bp:5:1) -> d",
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("expected %q, got %q", w, got)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Android.bp")
+	if err := os.WriteFile(path, []byte("x = 1\nfoo {\n    bar: x + 1,\n}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	file, errs := ParseFile(path, NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if file.Name != path || file.Defs[1].(*Module).Pos().Filename != path {
+		t.Errorf("expected positions in %q, got %q", path, file.Defs[1].(*Module).Pos().Filename)
+	}
+	bar, _ := file.Defs[1].(*Module).GetProperty("bar")
+	if _, ok := bar.Value.(*Operator).Value.(*Int64); ok {
+		t.Errorf("expected ParseFile not to evaluate, got %s", bar.Value.(*Operator).Value)
+	}
+
+	file, errs = ParseAndEvalFile(path, NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	bar, _ = file.Defs[1].(*Module).GetProperty("bar")
+	if value, ok := bar.Value.(*Operator).Value.(*Int64); !ok || value.Value != 2 {
+		t.Errorf("expected ParseAndEvalFile to evaluate to 2, got %s", bar.Value.(*Operator).Value)
+	}
+
+	_, errs = ParseFile(filepath.Join(t.TempDir(), "missing.bp"), NewScope(nil))
+	if len(errs) != 1 || !errors.Is(errs[0], os.ErrNotExist) {
+		t.Errorf("expected a not exist error, got %v", errs)
+	}
+}
+
+func TestRejectEmpty(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{name: "comment only", input: "// nothing here\n/* or here */\n", err: "Android.bp:1:1: file has no definitions"},
+		{name: "empty", input: "", err: "Android.bp:1:1: file has no definitions"},
+		{name: "whitespace", input: "\n  \n", err: "Android.bp:1:1: file has no definitions"},
+		{name: "module", input: "foo {\n    name: \"foo\",\n}\n"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := ParseWithOptions("Android.bp", strings.NewReader(tt.input), NewScope(nil),
+				ParseOptions{MaxErrors: 1, RejectEmpty: true})
+			if tt.err == "" {
+				if len(errs) != 0 {
+					t.Errorf("unexpected errors: %v", errs)
+				}
+			} else if len(errs) != 1 || errs[0].Error() != tt.err {
+				t.Errorf("expected error %q, got %v", tt.err, errs)
+			}
+
+			// Without the option an empty file is not an error.
+			if _, errs := Parse("Android.bp", strings.NewReader(tt.input), NewScope(nil)); len(errs) != 0 {
+				t.Errorf("unexpected errors without RejectEmpty: %v", errs)
+			}
+		})
+	}
+}
+
+func TestParseRawStringVerbatim(t *testing.T) {
+	input := "foo {\n    script: `  a\r\n\tb  `,\n}\n"
+	file := parseForTest(t, input)
+	script, _ := file.Defs[0].(*Module).GetProperty("script")
+	if s := script.Value.(*String); !s.Raw || s.Value != "  a\r\n\tb  " {
+		t.Errorf("expected the raw string contents verbatim, got %q", s.Value)
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(printed) != input {
+		t.Errorf("expected:\n%q\ngot:\n%q", input, printed)
+	}
+}
+
+func TestInterpolatedString(t *testing.T) {
+	input := `
+dir = "out"
+name = "foo"
+n = 1
+foo {
+    path: "$(dir)/bin/$(name)_x",
+    literal: "no $ here",
+}
+`
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{Eval: true, InterpolateStrings: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[3].(*Module)
+	path, _ := module.GetProperty("path")
+	interpolated, ok := path.Value.(*InterpolatedString)
+	if !ok {
+		t.Fatalf("expected an InterpolatedString, got %T", path.Value)
+	}
+	if s, ok := interpolated.Eval().(*String); !ok || s.Value != "out/bin/foo_x" {
+		t.Errorf("expected %q, got %s", "out/bin/foo_x", interpolated.Eval())
+	}
+	if len(interpolated.Parts) != 4 || interpolated.Parts[2].(*Variable).NamePos != mkpos(62, 6, 25) {
+		t.Errorf("unexpected parts %v", interpolated.Parts)
+	}
+	if literal, _ := module.GetProperty("literal"); literal.Value.Type() != StringType {
+		t.Errorf("expected a string literal, got %s", literal.Value)
+	}
+	if !file.Defs[0].(*Assignment).Referenced || file.Defs[2].(*Assignment).Referenced {
+		t.Errorf("expected only the interpolated variables to be referenced")
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(printed) != input[1:] {
+		t.Errorf("expected:\n%s\ngot:\n%s", input[1:], printed)
+	}
+
+	_, errs = ParseWithOptions("", bytes.NewBufferString("n = 1\nfoo {\n    path: \"$(n)\",\n}\n"),
+		NewScope(nil), ParseOptions{Eval: true, InterpolateStrings: true})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `cannot interpolate variable "n" of type int64`) {
+		t.Errorf("expected a type error, got %v", errs)
+	}
+
+	_, errs = ParseWithOptions("", bytes.NewBufferString("foo {\n    path: \"$(a-b)\",\n}\n"),
+		NewScope(nil), ParseOptions{InterpolateStrings: true})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `expected $(variable) in string`) {
+		t.Errorf("expected an invalid interpolation error, got %v", errs)
+	}
+
+	file, errs = ParseAndEval("", bytes.NewBufferString("foo {\n    path: \"$(dir)\",\n}\n"), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if path, _ := file.Defs[0].(*Module).GetProperty("path"); path.Value.(*String).Value != "$(dir)" {
+		t.Errorf("expected the string to be left alone without InterpolateStrings, got %s", path.Value)
+	}
+}
+
+func TestParseNumericSuffixes(t *testing.T) {
+	opts := ParseOptions{AllowNumericSuffixes: []string{"L", "u"}}
+	input := "foo {\n    size: 42L,\n    count: 3u,\n    scale: 1.5L,\n    plain: 7,\n}\n"
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil), opts)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[0].(*Module)
+	size, _ := module.GetProperty("size")
+	if i := size.Value.(*Int64); i.Value != 42 || i.Token != "42L" {
+		t.Errorf("expected 42 with token 42L, got %d with token %q", i.Value, i.Token)
+	}
+	scale, _ := module.GetProperty("scale")
+	if f := scale.Value.(*Float64); f.Value != 1.5 || f.Token != "1.5L" {
+		t.Errorf("expected 1.5 with token 1.5L, got %g with token %q", f.Value, f.Token)
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(printed) != input {
+		t.Errorf("expected:\n%s\ngot:\n%s", input, printed)
+	}
+
+	_, errs = ParseWithOptions("", bytes.NewBufferString("foo {\n    size: 42UL,\n}\n"), NewScope(nil), opts)
+	if len(errs) != 1 || errs[0].Error() != `<input>:2:13: unsupported numeric suffix "UL"` {
+		t.Errorf("expected an unsupported suffix error, got %v", errs)
+	}
+
+	_, errs = Parse("", bytes.NewBufferString("foo {\n    size: 42L,\n}\n"), NewScope(nil))
+	if len(errs) == 0 {
+		t.Errorf("expected an error for a suffix without AllowNumericSuffixes")
+	}
+}
+
+const metadataTestInput = `
+common = ["-Wall"]
+
+cc_library {
+    name: "libfoo",
+    enabled: true,
+    srcs: ["a.c", "b.c"] + select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+    cflags: common,
+    arch: {
+        arm: {
+            srcs: ["arm.c"],
+        },
+    },
+}
+
+cc_binary {
+    name: "bar",
+    stl: "none",
+}
+`
+
+func TestParseMetadataOnly(t *testing.T) {
+	full, errs := ParseAndEval("", bytes.NewBufferString(metadataTestInput), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	metadata, errs := ParseWithOptions("", bytes.NewBufferString(metadataTestInput), NewScope(nil),
+		ParseOptions{Eval: true, MetadataOnly: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if len(full.Defs) != len(metadata.Defs) {
+		t.Fatalf("expected %d definitions, got %d", len(full.Defs), len(metadata.Defs))
+	}
+	if !reflect.DeepEqual(full.Defs[0], metadata.Defs[0]) {
+		t.Errorf("expected the assignment to be parsed in full, got %s", metadata.Defs[0])
+	}
+	for i := 1; i < len(full.Defs); i++ {
+		fullModule, module := full.Defs[i].(*Module), metadata.Defs[i].(*Module)
+		if module.Type != fullModule.Type || module.Name() != fullModule.Name() {
+			t.Errorf("expected module %s %q, got %s %q", fullModule.Type, fullModule.Name(), module.Type, module.Name())
+		}
+		if len(module.Properties) != len(fullModule.Properties) {
+			t.Fatalf("expected %d properties, got %d", len(fullModule.Properties), len(module.Properties))
+		}
+		for j, prop := range module.Properties {
+			fullProp := fullModule.Properties[j]
+			if prop.Name != fullProp.Name || prop.Value.Type() != fullProp.Value.Type() {
+				t.Errorf("expected property %s of type %s, got %s of type %s",
+					fullProp.Name, fullProp.Value.Type(), prop.Name, prop.Value.Type())
+			}
+			switch fullProp.Value.(type) {
+			case *String, *Bool:
+				if !reflect.DeepEqual(prop.Value, fullProp.Value) {
+					t.Errorf("expected literal %s to be kept, got %s", fullProp.Value, prop.Value)
+				}
+			default:
+				placeholder, ok := prop.Value.(*Placeholder)
+				if !ok {
+					t.Errorf("expected %s to be a placeholder, got %s", prop.Name, prop.Value)
+				} else if placeholder.Pos() != fullProp.Value.Pos() || placeholder.End() != fullProp.Value.End() {
+					t.Errorf("expected placeholder for %s at %s-%s, got %s", prop.Name,
+						fullProp.Value.Pos(), fullProp.Value.End(), placeholder)
+				}
+			}
+		}
+	}
+
+	if _, err := Print(metadata); err == nil || !strings.Contains(err.Error(), "parsed with MetadataOnly") {
+		t.Errorf("expected an error printing a MetadataOnly file, got %v", err)
+	}
+}
+
+func BenchmarkParseMetadataOnly(b *testing.B) {
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		input.WriteString(strings.Replace(metadataTestInput[strings.Index(metadataTestInput, "cc_library"):],
+			`"libfoo"`, strconv.Quote(fmt.Sprintf("lib%d", i)), 1))
+	}
+	src := input.String()
+	for _, metadataOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("MetadataOnly=%t", metadataOnly), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, errs := ParseWithOptions("", strings.NewReader(src), NewScope(nil),
+					ParseOptions{MetadataOnly: metadataOnly})
+				if len(errs) != 0 {
+					b.Fatalf("unexpected errors: %v", errs)
+				}
+			}
+		})
+	}
+}
+
+func TestParseComparison(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected bool
+		err      string
+	}{
+		{input: "x = 1 == 1", expected: true},
+		{input: "x = 1 != 1", expected: false},
+		{input: "x = 1 < 2", expected: true},
+		{input: "x = 2 > 2", expected: false},
+		{input: "x = 2 <= 2", expected: true},
+		{input: "x = 1 >= 2", expected: false},
+		{input: `x = "a" < "b"`, expected: true},
+		{input: `x = "abc" == "ab" + "c"`, expected: true},
+		{input: "a = 4\nx = a - 1 == 3", expected: true},
+		{input: `x = 1 == "1"`, err: "mismatched type in operator ==: int64 != string"},
+		{input: "x = true == true", err: "operator == not supported on type bool"},
+		{input: "x = [1] < [2]", err: "operator < not supported on type list"},
+		{input: "x = 1 = 1", err: `expected comparison operator, found "="`},
+		{input: "x = 1 ! 1", err: `expected comparison operator, found "!"`},
+		{
+			input: `x = 1 == select(arch(), {"arm": 1, default: 2,})`,
+			err:   "<input>:1:10: operator == not supported on select statements",
+		},
+		{
+			input: `x = "a" < select(arch(), {"arm": "b", default: "c",})`,
+			err:   "<input>:1:11: operator < not supported on select statements",
+		},
+		{
+			input: `x = select(arch(), {"arm": 1, default: 2,}) >= 1`,
+			err:   "<input>:1:5: operator >= not supported on select statements",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			if _, ok := x.Value.(*Comparison); !ok {
+				t.Errorf("expected a Comparison, got %s", x.Value)
+			}
+			got, ok := x.Value.Eval().(*Bool)
+			if !ok {
+				t.Fatalf("expected a bool, got %s", x.Value.Eval())
+			}
+			if got.Value != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, got.Value)
+			}
+		})
+	}
+}
+
+func TestParseBoolOp(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected bool
+		err      string
+	}{
+		{input: "x = true && false", expected: false},
+		{input: "x = true && true", expected: true},
+		{input: "x = false || true", expected: true},
+		{input: "x = false || false", expected: false},
+		{input: "x = !false", expected: true},
+		{input: "x = !!false", expected: false},
+		{input: "a = true\nb = false\nx = a && !b", expected: true},
+		// && binds more tightly than ||.
+		{input: "x = true || false && false", expected: true},
+		{input: "x = false && false || true", expected: true},
+		// Comparisons bind more tightly than && and ||.
+		{input: "x = 1 < 2 && 2 < 1 || 3 == 3", expected: true},
+		{input: "x = !false && 1 < 2", expected: true},
+		// Both operands are checked even if the first decides the result.
+		{input: `x = false && "a"`, err: `<input>:1:14: operand of operator && must be a bool, found string`},
+		{input: "l = [\"a\"]\nx = false || l", err: "<input>:2:14: operand of operator || must be a bool, found list"},
+		{input: "x = false && select(arch(), {\"arm\": true, default: false,})", err: "<input>:1:14: operator && not supported on select statements"},
+		{input: `x = true && "a"`, err: `<input>:1:13: operand of operator && must be a bool, found string`},
+		{input: "x = 1 || true", err: "<input>:1:5: operand of operator || must be a bool, found int64"},
+		{input: "x = ![true]", err: "<input>:1:6: operand of operator ! must be a bool, found list"},
+		{input: "x = true & false", err: "<input>:1:10: expected &&, found &"},
+		{input: "x = true | | false", err: "<input>:1:10: expected ||, found |"},
+		{
+			input: "x = select(arch(), {\"arm\": true, default: false,}) && true",
+			err:   "<input>:1:5: operator && not supported on select statements",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			if _, ok := x.Value.(*BoolOp); !ok {
+				t.Errorf("expected a BoolOp, got %s", x.Value)
+			}
+			got, ok := x.Value.Eval().(*Bool)
+			if !ok {
+				t.Fatalf("expected a bool, got %s", x.Value.Eval())
+			}
+			if got.Value != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, got.Value)
+			}
+		})
+	}
+
+	// The types of variables aren't known without evaluating, but the types of literals are.
+	if _, errs := Parse("", bytes.NewBufferString("x = a && !b || c"), NewScope(nil)); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if _, errs := Parse("", bytes.NewBufferString(`x = a && "b"`), NewScope(nil)); len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), "operand of operator && must be a bool, found string") {
+		t.Errorf("expected an error for the string operand, got %v", errs)
+	}
+}
+
+func TestParseConditional(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{input: `x = true ? "a" : "b"`, expected: `"a"`},
+		{input: `x = false ? "a" : "b"`, expected: `"b"`},
+		{input: "v = 3\nx = v >= 3 ? [\"new\"] : [\"old\"]", expected: `["new"]`},
+		{input: "x = 1 > 2 ? 1 : 2 > 1 ? 2 : 3", expected: `2`},
+		{input: `x = true ? "a" + "b" : "c"`, expected: `"ab"`},
+		{input: `x = true ? "a" : 1`, err: `Found conditional expression with differing types "string" and "int64" in its branches`},
+		{input: `x = "true" ? "a" : "b"`, err: "condition of a conditional expression must be a bool, found string"},
+		{input: `x = true ? "a"`, err: `expected ":", found EOF`},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			scope := NewScope(nil)
+			_, errs := ParseAndEval("", bytes.NewBufferString(tt.input), scope)
+			if tt.err != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x, _ := scope.Get("x")
+			if _, ok := x.Value.(*Conditional); !ok {
+				t.Errorf("expected a Conditional, got %s", x.Value)
+			}
+			if got := valueString(stripPositions(x.Value.Eval())); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+
+	// The types of variables aren't known without evaluating.
+	if _, errs := Parse("", bytes.NewBufferString(`x = debug ? flags : "-O2"`), NewScope(nil)); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestOperatorsAcrossNewlines(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{"same line", `["a"] + ["b"] + ["c"]`},
+		{"end of line", "[\"a\"] +\n    [\"b\"] +\n    [\"c\"]"},
+		{"start of line", "[\"a\"]\n    + [\"b\"]\n    + [\"c\"]"},
+		{"mixed", "[\"a\"] +\n    [\"b\"]\n    + [\"c\"]"},
+		{"blank lines and comments", "[\"a\"]\n\n    // b\n    +\n\n    [\"b\"] + // c\n    [\"c\"]"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			input := "x = " + tt.input + "\nfoo {\n    srcs: x,\n}\n"
+			file, errs := ParseAndEval("", strings.NewReader(input), NewScope(nil))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			x := file.Defs[0].(*Assignment)
+			if got, expected := valueString(stripPositions(x.Value.Eval())), "[\n    \"a\",\n    \"b\",\n    \"c\",\n]"; got != expected {
+				t.Errorf("expected %s, got %s", expected, got)
+			}
+			if len(file.Defs) != 2 {
+				t.Errorf("expected the module to be parsed as a separate definition, got %d definitions", len(file.Defs))
+			}
+		})
+	}
+
+	// The printer moves an operator at the start of a line to the end of the previous line.
+	file := parseForTest(t, "x = [\"a\"]\n    + [\"b\"]\n")
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "x = [\"a\"] +\n    [\"b\"]\n"; string(printed) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, printed)
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	file, errs := ParseAndEval("", strings.NewReader(`
+a = {
+    name: "a",
+    srcs: ["a.c"],
+    arch: {
+        arm: {cflags: ["-DA"]},
+    },
+}
+b = {
+    srcs: ["b.c"],
+    arch: {
+        arm: {cflags: ["-DB"]},
+        x86: {cflags: ["-DX86"]},
+    },
+    enabled: true,
+}
+mismatched = {
+    srcs: "b.c",
+}
+`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	getMap := func(i int) *Map {
+		return file.Defs[i].(*Assignment).Value.(*Map)
+	}
+	a, b, mismatched := getMap(0), getMap(1), getMap(2)
+	aBefore := valueString(stripPositions(a))
+
+	merged, err := MergeMaps(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `{
+    name: "a",
+    srcs: [
+        "a.c",
+        "b.c",
+    ],
+    arch: {
+        arm: {
+            cflags: [
+                "-DA",
+                "-DB",
+            ],
+        },
+        x86: {
+            cflags: ["-DX86"],
+        },
+    },
+    enabled: true,
+}`
+	if got := valueString(stripPositions(merged)); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+	if got := valueString(stripPositions(a)); got != aBefore {
+		t.Errorf("expected a not to be modified, got:\n%s", got)
+	}
+
+	_, err = MergeMaps(a, mismatched)
+	if expected := "mismatched type in operator +: list != string"; err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestDisallowCompatSyntax(t *testing.T) {
+	input := "foo(name = \"foo\", srcs = [\"a.c\"])\nbar {\n    name: \"bar\",\n}\n"
+	if _, errs := Parse("Android.bp", strings.NewReader(input), NewScope(nil)); len(errs) != 0 {
+		t.Fatalf("unexpected errors without the option: %v", errs)
+	}
+
+	file, errs := ParseWithOptions("Android.bp", strings.NewReader(input), NewScope(nil),
+		ParseOptions{DisallowCompatSyntax: true})
+	expected := `Android.bp:2:5: module bar uses the compat { } syntax, use ( ) instead`
+	if len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, errs)
+	}
+	if len(file.Defs) != 1 || file.Defs[0].(*Module).Name() != "foo" {
+		t.Errorf("expected the module using ( ) to be parsed, got %v", file.Defs)
+	}
+}
+
+func TestCollectStats(t *testing.T) {
+	input := `
+cflags = ["-Wall"]
+
+cc_library {
+    name: "libfoo",
+    srcs: ["a.c"] + select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+    arch: {
+        arm: {
+            cflags: [select(os(), {"linux": "-DLINUX", default: "",})],
+        },
+    },
+}
+
+cc_binary(name = "bar")
+
+broken {
+    name: select(,
+}
+`
+	file, errs := ParseWithOptions("", strings.NewReader(input), NewScope(nil),
+		ParseOptions{CollectStats: true})
+	if len(errs) != 1 {
+		t.Fatalf("expected one error for the broken module, got %v", errs)
+	}
+	// The modules that parsed, their properties and selects, counted by hand.
+	expected := ParseStats{
+		ModuleCount:   2,
+		PropertyCount: 6,
+		SelectCount:   2,
+		// The module, arch, arm, the list, select( and its map.
+		MaxNestingDepth: 6,
+	}
+	if file.Stats == nil || *file.Stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, file.Stats)
+	}
+
+	file, _ = ParseWithOptions("", strings.NewReader(input), NewScope(nil), ParseOptions{})
+	if file.Stats != nil {
+		t.Errorf("expected no stats without CollectStats, got %+v", file.Stats)
+	}
+}
+
+func TestNodeText(t *testing.T) {
+	input := `cc_library {
+    name: "libfoo",
+    srcs: [
+        "a.c", // the first
+        "b.c",
+    ],
+}
+`
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil), ParseOptions{KeepSource: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if got := string(file.SourceBytes()); got != input {
+		t.Errorf("expected the source bytes to be the input, got %q", got)
+	}
+
+	module := file.Defs[0].(*Module)
+	srcs, _ := module.GetProperty("srcs")
+	name, _ := module.GetProperty("name")
+	testCases := []struct {
+		node     Node
+		expected string
+		ok       bool
+	}{
+		{module, strings.TrimSuffix(input, "\n"), true},
+		{srcs, "srcs: [\n        \"a.c\", // the first\n        \"b.c\",\n    ]", true},
+		{srcs.Value.(*List).Values[1], `"b.c"`, true},
+		{name.Value, `"libfoo"`, true},
+		{&String{Value: "no position"}, "", false},
+	}
+	for _, tt := range testCases {
+		got, ok := NodeText(file.SourceBytes(), tt.node)
+		if string(got) != tt.expected || ok != tt.ok {
+			t.Errorf("expected %q, %t, got %q, %t", tt.expected, tt.ok, got, ok)
+		}
+	}
+
+	// The input is only kept when it is asked for.
+	unkept := parseForTest(t, input)
+	if src := unkept.SourceBytes(); src != nil {
+		t.Errorf("expected no source bytes without KeepSource, got %q", src)
+	}
+	if _, ok := NodeText(unkept.SourceBytes(), unkept.Defs[0]); ok {
+		t.Errorf("expected NodeText to report false without KeepSource")
+	}
+}
+
+func TestIntOverflow(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+		err      string
+	}{
+		{input: "9223372036854775806 + 1", expected: math.MaxInt64},
+		{input: "9223372036854775807 + 1", err: "<input>:1:25: integer overflow in operator +: 9223372036854775807 + 1 is out of the range of int64"},
+		{input: "1 + 9223372036854775807", err: "<input>:1:7: integer overflow in operator +: 1 + 9223372036854775807 is out of the range of int64"},
+		{input: "-9223372036854775807 + -1", expected: math.MinInt64},
+		{input: "-9223372036854775807 + -2", err: "<input>:1:26: integer overflow in operator +: -9223372036854775807 + -2 is out of the range of int64"},
+		{input: "9223372036854775807 + -9223372036854775807", expected: 0},
+		{input: "-9223372036854775807 - 1", expected: math.MinInt64},
+		{input: "-9223372036854775807 - 2", err: "<input>:1:26: integer overflow in operator -: -9223372036854775807 - 2 is out of the range of int64"},
+		{input: "9223372036854775807 - -1", err: "<input>:1:25: integer overflow in operator -: 9223372036854775807 - -1 is out of the range of int64"},
+		{input: "0 - 9223372036854775807", expected: -math.MaxInt64},
+	}
+	for _, tt := range testCases {
+		file, errs := ParseAndEval("", strings.NewReader("x = "+tt.input+"\n"), NewScope(nil))
+		if tt.err != "" {
+			if len(errs) != 1 || errs[0].Error() != tt.err {
+				t.Errorf("%s: expected error %q, got %v", tt.input, tt.err, errs)
+			}
+			continue
+		}
+		if len(errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.input, errs)
+			continue
+		}
+		if got := file.Defs[0].(*Assignment).Value.Eval().(*Int64).Value; got != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestParseAndEvalExpression(t *testing.T) {
+	file, errs := ParseAndEval("", bytes.NewBufferString(`
+srcs = ["a.c"]
+extra = {b: ["b.c"]}
+`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	scope := NewScope(nil)
+	for _, def := range file.Defs {
+		if err := scope.Add(def.(*Assignment)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	value, errs := ParseAndEvalExpression(bytes.NewBufferString(`srcs + extra.b`), scope)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if g, w := valueString(stripPositions(value)), "[\n    \"a.c\",\n    \"b.c\",\n]"; g != w {
+		t.Errorf("expected %s, got %s", w, g)
+	}
+
+	value, errs = ParseAndEvalExpression(bytes.NewBufferString(`missing`), scope)
+	if len(errs) != 1 || value != nil {
+		t.Errorf("expected 1 error and no value, got %v and %v", errs, value)
+	}
+}
+
+func TestDuplicateProperties(t *testing.T) {
+	input := `
+foo {
+    name: "foo",
+    arch: {
+        arm: {
+            cflags: ["-a"],
+            cflags: ["-b"],
+        },
+    },
+}
+`
+	_, errs := Parse("", bytes.NewBufferString(input), NewScope(nil))
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	if g, w := errs[0].Error(), `<input>:7:13: property "cflags" already defined at <input>:6:13`; g != w {
+		t.Errorf("expected error %q, got %q", w, g)
+	}
+
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+		ParseOptions{MaxErrors: 1, AllowDuplicateProperties: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	arch, _ := file.Defs[0].(*Module).GetProperty("arch")
+	arm, _ := arch.Value.(*Map).GetProperty("arm")
+	if n := len(arm.Value.(*Map).Properties); n != 2 {
+		t.Errorf("expected both copies of cflags to be kept, got %d properties", n)
+	}
+}
+
+func TestAppendToInheritedVariables(t *testing.T) {
+	parent := NewScope(nil)
+	if _, errs := ParseAndEval("", bytes.NewBufferString(`cflags = ["-Wall"]`), parent); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	opts := ParseOptions{Eval: true, MaxErrors: 1, AppendToInheritedVariables: true}
+
+	input := `
+cflags += ["-Werror"]
+cflags += ["-O2"]
+foo {
+    cflags: cflags,
+}
+`
+	if _, errs := ParseAndEval("", bytes.NewBufferString(input), NewScope(parent)); len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), `modified non-local variable "cflags" with +=`) {
+		t.Errorf("expected a non-local variable error by default, got %v", errs)
+	}
+
+	scope := NewScope(parent)
+	file, errs := ParseWithOptions("", bytes.NewBufferString(input), scope, opts)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	prop, _ := file.Defs[2].(*Module).GetProperty("cflags")
+	if g, w := valueString(stripPositions(prop.Value.Eval())), "[\n    \"-Wall\",\n    \"-Werror\",\n    \"-O2\",\n]"; g != w {
+		t.Errorf("expected %s, got %s", w, g)
+	}
+	if a, local := scope.Get("cflags"); !local || a != file.Defs[0] {
+		t.Errorf("expected the first += to make a local variable, got %s, %t", a, local)
+	}
+	inherited, _ := parent.Get("cflags")
+	if g, w := valueString(stripPositions(inherited.Value)), "[\"-Wall\"]"; g != w {
+		t.Errorf("expected the inherited variable to be unchanged, got %s", g)
+	}
+
+	_, errs = ParseWithOptions("", bytes.NewBufferString(`
+foo {
+    cflags: cflags,
+}
+cflags += ["-Werror"]
+`), NewScope(parent), opts)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `modified variable "cflags" with += after referencing`) {
+		t.Errorf("expected an error appending after referencing, got %v", errs)
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&input, "foo {\n    name: \"foo%d\",\n    srcs: [\"a.c\", \"b.c\"],\n}\n", i)
+	}
+
+	file, errs := ParseContext(context.Background(), "", strings.NewReader(input.String()), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(file.Defs) != 1000 {
+		t.Errorf("expected 1000 definitions, got %d", len(file.Defs))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	file, errs = ParseContext(ctx, "", strings.NewReader(input.String()), NewScope(nil))
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("expected a context.Canceled error, got %v", errs)
+	}
+	if file != nil {
+		t.Errorf("expected no file, got %d definitions", len(file.Defs))
+	}
+}
+
+func TestStrictEscapes(t *testing.T) {
+	testCases := []struct {
+		input string
+		err   string
+	}{
+		{input: `x = "a\tb\n\\c\"d"`},
+		{input: "x = `C:\\x41`"},
+		{input: `x = "C:\x41"`, err: `<input>:1:8: unsupported escape sequence \x in string`},
+		{input: `x = "\u00e9"`, err: `<input>:1:6: unsupported escape sequence \u in string`},
+		{input: `x = "a\\\a"`, err: `<input>:1:9: unsupported escape sequence \a in string`},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			if _, errs := Parse("", bytes.NewBufferString(tt.input), NewScope(nil)); len(errs) != 0 {
+				t.Errorf("unexpected errors by default: %v", errs)
+			}
+			_, errs := ParseWithOptions("", bytes.NewBufferString(tt.input), NewScope(nil),
+				ParseOptions{MaxErrors: 1, StrictEscapes: true})
+			if tt.err == "" {
+				if len(errs) != 0 {
+					t.Errorf("unexpected errors: %v", errs)
+				}
+			} else if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), tt.err) {
+				t.Errorf("expected error %q, got %v", tt.err, errs)
+			}
+		})
+	}
+
+	y := NewScope(nil)
+	if _, errs := ParseAndEval("", bytes.NewBufferString(`y = "b"`), y); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	_, errs := ParseWithOptions("", bytes.NewBufferString(`x = "$(y)\x41"`), NewScope(y),
+		ParseOptions{Eval: true, MaxErrors: 1, StrictEscapes: true, InterpolateStrings: true})
+	if w := `<input>:1:10: unsupported escape sequence \x in string`; len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), w) {
+		t.Errorf("expected error %q, got %v", w, errs)
+	}
+}
+
+func TestVariableRoot(t *testing.T) {
+	input := `
+foo = ["a"]
+bar = foo
+baz = bar
+baz += ["b"]
+qux = bar + ["c"]
+
+m {
+    srcs: baz,
+    deps: qux,
+}
+`
+	for _, eval := range []bool{false, true} {
+		t.Run(strconv.FormatBool(eval), func(t *testing.T) {
+			file, errs := ParseWithOptions("", bytes.NewBufferString(input), NewScope(nil),
+				ParseOptions{Eval: eval, MaxErrors: 1})
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			bar := file.Defs[1].(*Assignment)
+			assignment, value := bar.Value.(*Variable).Root()
+			if assignment != file.Defs[0] || valueString(value) != `["a"]` {
+				t.Errorf("expected bar to resolve to foo, got %s and %s", assignment, value)
+			}
+
+			module := file.Defs[5].(*Module)
+			// baz += ["b"] made the value of baz an expression, so the chain ends at baz.
+			srcs, _ := module.GetProperty("srcs")
+			assignment, value = srcs.Value.(*Variable).Root()
+			if assignment != file.Defs[2] {
+				t.Errorf("expected srcs to resolve to baz, got %s", assignment)
+			}
+			if _, ok := value.(*Operator); !ok {
+				t.Errorf("expected the value of baz to include the appended value, got %s", value)
+			}
+
+			deps, _ := module.GetProperty("deps")
+			if assignment, _ := deps.Value.(*Variable).Root(); assignment != file.Defs[4] {
+				t.Errorf("expected qux to resolve to itself, got %s", assignment)
+			}
+		})
+	}
+
+	a := &Variable{Name: "a"}
+	b := &Variable{Name: "b", Value: a}
+	a.Value = b
+	if assignment, value := a.Root(); assignment != nil || value != nil {
+		t.Errorf("expected nil for a cycle, got %s and %s", assignment, value)
+	}
+
+	unlinked := &Variable{Name: "x", Value: &String{Value: "x"}}
+	if assignment, value := unlinked.Root(); assignment != nil || valueString(value) != `"x"` {
+		t.Errorf("expected the value of an unlinked variable, got %s and %s", assignment, value)
+	}
+}
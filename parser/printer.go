@@ -15,7 +15,11 @@
 package parser
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"text/scanner"
@@ -41,12 +45,22 @@ type printer struct {
 	wsBuf      []byte
 
 	skippedComments []*CommentGroup
+
+	// err is the first error found while printing, like a Placeholder that can't be printed.
+	err error
 }
 
 func newPrinter(file *File) *printer {
+	// Comments attached to a property or list value are printed with it.
+	var comments []*CommentGroup
+	for _, cg := range file.Comments {
+		if !cg.attached {
+			comments = append(comments, cg)
+		}
+	}
 	return &printer{
 		defs:       file.Defs,
-		comments:   file.Comments,
+		comments:   comments,
 		indentList: []int{0},
 
 		// pendingNewLine is initialized to -1 to eat initial spaces if the first token is a comment
@@ -58,14 +72,488 @@ func newPrinter(file *File) *printer {
 	}
 }
 
+// Print returns the File formatted as canonical Blueprint source, the same as bpfmt.
 func Print(file *File) ([]byte, error) {
+	return PrintWithConfig(file, PrinterConfig{})
+}
+
+// PrinterConfig holds options that control how definitions are printed.  The zero value prints
+// the same output as Print.
+type PrinterConfig struct {
+	// Header is printed as // comment lines before the first definition, separated from it by a
+	// blank line, for example to mark a generated file.
+	Header string
+
+	// Footer is printed as // comment lines after the last definition, separated from it by a
+	// blank line.
+	Footer string
+
+	// GroupBy, if set, returns the name of the group of a module property.  The properties of each
+	// module are printed grouped together, with a blank line between groups.  Groups are printed in
+	// the order their first property appears, and properties keep their order within a group.
+	GroupBy func(p *Property) string
+
+	// SortProperties prints the properties of every module and map sorted by name, with a name
+	// property first.  Maps nested in property values, lists and selects are sorted too.  It is
+	// applied before GroupBy, so the properties in each group are sorted.
+	SortProperties bool
+}
+
+// PrintWithConfig returns the File formatted as canonical Blueprint source with the options in
+// cfg applied.
+func PrintWithConfig(file *File, cfg PrinterConfig) ([]byte, error) {
+	if cfg.SortProperties {
+		file = sortProperties(file)
+	}
+	if cfg.GroupBy != nil {
+		file = groupProperties(file, cfg.GroupBy)
+	}
 	p := newPrinter(file)
 
 	for _, def := range p.defs {
 		p.printDef(def)
 	}
 	p.flush()
-	return p.output, nil
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if cfg.Header == "" && cfg.Footer == "" {
+		return p.output, nil
+	}
+	var output []byte
+	if cfg.Header != "" {
+		output = appendCommentLines(output, cfg.Header)
+		output = append(output, '\n')
+	}
+	output = append(output, p.output...)
+	if cfg.Footer != "" {
+		output = append(output, '\n')
+		output = appendCommentLines(output, cfg.Footer)
+	}
+	return output, nil
+}
+
+// groupProperties returns a copy of file with the properties of each module reordered into the
+// groups returned by groupBy.  The printer lays out properties by their positions, so each property
+// is moved along with the comments before it and extra lines are inserted between groups, shifting
+// everything after the module down.
+func groupProperties(file *File, groupBy func(p *Property) string) *File {
+	file = copyFile(file)
+	for _, def := range file.Defs {
+		module, ok := def.(*Module)
+		if !ok || len(module.Properties) < 2 {
+			continue
+		}
+		props := module.Properties
+
+		var groupNames []string
+		groups := make(map[string][]int)
+		for i, prop := range props {
+			name := groupBy(prop)
+			if _, exists := groups[name]; !exists {
+				groupNames = append(groupNames, name)
+			}
+			groups[name] = append(groups[name], i)
+		}
+		if len(groupNames) < 2 {
+			continue
+		}
+
+		rbrace := module.RBracePos
+		spans := propertySpans(file, props, module.LBracePos, rbrace)
+
+		line, offset := spans[0].begin.Line, spans[0].begin.Offset
+		var reordered []*Property
+		for g, name := range groupNames {
+			if g > 0 {
+				// Leave a blank line before each group after the first.
+				line++
+				offset++
+			}
+			for _, i := range groups[name] {
+				line, offset = spans[i].moveTo(props[i], line, offset)
+				reordered = append(reordered, props[i])
+			}
+		}
+		module.Properties = reordered
+
+		// Move the closing brace and everything after it down by the inserted lines.
+		lines, offsets := line-rbrace.Line, offset-rbrace.Offset
+		shift := func(pos scanner.Position) scanner.Position {
+			if pos.Offset >= rbrace.Offset {
+				pos.Line += lines
+				pos.Offset += offsets
+			}
+			return pos
+		}
+		module.RBracePos = shift(module.RBracePos)
+		for _, other := range file.Defs {
+			if other.Pos().Offset > rbrace.Offset {
+				remapPositions(other, shift)
+			}
+		}
+		for _, cg := range file.Comments {
+			for _, c := range cg.Comments {
+				c.Slash = shift(c.Slash)
+			}
+		}
+	}
+	// The printer consumes the comments in order, so they must follow their new positions.
+	sort.Sort(commentsByOffset(file.Comments))
+	return file
+}
+
+// sortProperties returns a copy of file with the properties of every module and map sorted by
+// name, with a name property first.  As in groupProperties each property is moved along with the
+// comments before it, but the properties only trade places, so nothing outside the map moves.
+// Inner maps are sorted before the maps that hold them, so that they move with their property.
+func sortProperties(file *File) *File {
+	file = copyFile(file)
+	var maps []*Map
+	Walk(file, func(n Node) bool {
+		switch n := n.(type) {
+		case *Module:
+			maps = append(maps, &n.Map)
+		case *Map:
+			maps = append(maps, n)
+		}
+		return true
+	})
+	for i := len(maps) - 1; i >= 0; i-- {
+		sortMapProperties(file, maps[i])
+	}
+	// The printer consumes the comments in order, so they must follow their new positions.
+	sort.Sort(commentsByOffset(file.Comments))
+	return file
+}
+
+func sortMapProperties(file *File, m *Map) {
+	props := m.Properties
+	order := make([]int, len(props))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		if x, y := props[a].Name == "name", props[b].Name == "name"; x != y {
+			if x {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(props[a].Name, props[b].Name)
+	})
+	if slices.IsSorted(order) {
+		return
+	}
+
+	// The last property ends at the comments after it, which stay before the closing brace.
+	end := m.RBracePos
+	if len(m.TrailingComments) > 0 {
+		end = m.TrailingComments[0].Pos()
+	}
+	spans := propertySpans(file, props, m.LBracePos, end)
+	for i := 1; i < len(spans); i++ {
+		if spans[i].begin.Offset < spans[i-1].begin.Offset {
+			// The properties are not in source order, so they can't be moved by their positions.
+			return
+		}
+	}
+
+	line, offset := spans[0].begin.Line, spans[0].begin.Offset
+	sorted := make([]*Property, len(props))
+	for j, i := range order {
+		line, offset = spans[i].moveTo(props[i], line, offset)
+		sorted[j] = props[i]
+	}
+	m.Properties = sorted
+}
+
+// propertySpan is the part of the source taken by a property and the comments before it.
+type propertySpan struct {
+	begin, end scanner.Position
+	comments   []*Comment
+}
+
+// propertySpans returns the span of each of props, the properties of a map that opens at lbrace.
+// Each property spans from the first comment on its own line before it, or its name if there is
+// no such comment, to the start of the next property's span.  The last one ends at end.
+func propertySpans(file *File, props []*Property, lbrace, end scanner.Position) []propertySpan {
+	spans := make([]propertySpan, len(props))
+	for i, prop := range props {
+		prevEnd := lbrace
+		if i > 0 {
+			prevEnd = props[i-1].End()
+		}
+		spans[i].begin = prop.Pos()
+		for _, cg := range file.Comments {
+			if pos := cg.Pos(); pos.Line > prevEnd.Line && pos.Offset < spans[i].begin.Offset {
+				spans[i].begin = pos
+			}
+		}
+	}
+	for i := range spans {
+		if i+1 < len(spans) {
+			spans[i].end = spans[i+1].begin
+		} else {
+			spans[i].end = end
+		}
+		for _, cg := range file.Comments {
+			for _, c := range cg.Comments {
+				if c.Slash.Offset >= spans[i].begin.Offset && c.Slash.Offset < spans[i].end.Offset {
+					spans[i].comments = append(spans[i].comments, c)
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// moveTo moves prop and the comments in its span so that the span begins at line and offset, and
+// returns the line and offset after the moved span.
+func (s propertySpan) moveTo(prop *Property, line, offset int) (int, int) {
+	lines, offsets := line-s.begin.Line, offset-s.begin.Offset
+	shift := func(pos scanner.Position) scanner.Position {
+		pos.Line += lines
+		pos.Offset += offsets
+		return pos
+	}
+	remapPositions(prop, shift)
+	for _, c := range s.comments {
+		c.Slash = shift(c.Slash)
+	}
+	return line + s.end.Line - s.begin.Line, offset + s.end.Offset - s.begin.Offset
+}
+
+// appendCommentLines appends each line of text to b as a // comment.
+func appendCommentLines(b []byte, text string) []byte {
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if line == "" {
+			b = append(b, "//"...)
+		} else {
+			b = append(b, "// "...)
+			b = append(b, line...)
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// PrintModules prints the modules with the given names, along with the assignments to any variables
+// they reference directly or indirectly, in source order.  Comments before or inside a printed
+// definition are kept.  It returns an error if any of the names is not a module in f.
+func PrintModules(f *File, names []string, cfg PrinterConfig) ([]byte, error) {
+	subset, err := f.moduleSubset(names)
+	if err != nil {
+		return nil, err
+	}
+	return PrintWithConfig(subset, cfg)
+}
+
+// moduleSubset returns a File with the modules with the given names, the assignments to the
+// variables they reference directly or indirectly and the comments before or inside them, sharing
+// the definitions of f.
+func (f *File) moduleSubset(names []string) (*File, error) {
+	modules := make(map[string]*Module)
+	for _, def := range f.Defs {
+		if module, ok := def.(*Module); ok {
+			modules[module.Name()] = module
+		}
+	}
+
+	var selectedModules []*Module
+	for _, name := range names {
+		module, ok := modules[name]
+		if !ok {
+			return nil, fmt.Errorf("module %q not found", name)
+		}
+		selectedModules = append(selectedModules, module)
+	}
+	return f.subset(selectedModules), nil
+}
+
+// subset returns a File with the given modules of f, the assignments to the variables they
+// reference directly or indirectly and the comments before or inside them, sharing the definitions
+// of f.
+func (f *File) subset(modules []*Module) *File {
+	selected := f.referencedDefinitions(modules)
+
+	subset := &File{Name: f.Name}
+	for _, def := range f.Defs {
+		if selected[def] {
+			subset.Defs = append(subset.Defs, def)
+		}
+	}
+
+	// Keep the comments that precede or are inside a selected definition.
+	for _, c := range f.Comments {
+		for _, def := range f.Defs {
+			if c.Pos().Offset < def.End().Offset {
+				if selected[def] {
+					subset.Comments = append(subset.Comments, c)
+				}
+				break
+			}
+		}
+	}
+
+	return subset
+}
+
+// referencedDefinitions returns the set of the given modules of f and the assignments in f to the
+// variables they reference directly or indirectly.
+func (f *File) referencedDefinitions(modules []*Module) map[Definition]bool {
+	selected := make(map[Definition]bool)
+	needed := make(map[string]bool)
+	for _, module := range modules {
+		selected[module] = true
+		for _, prop := range module.Properties {
+			referencedVariables(prop.Value, needed)
+		}
+	}
+
+	// Add the assignments to every needed variable, including variables referenced by the values
+	// of other needed variables.
+	for added := true; added; {
+		added = false
+		for _, def := range f.Defs {
+			if a, ok := def.(*Assignment); ok && needed[a.Name] && !selected[a] {
+				selected[a] = true
+				referencedVariables(a.OrigValue, needed)
+				added = true
+			}
+		}
+	}
+	return selected
+}
+
+// referencedVariables adds the names of the variables referenced in an unevaluated expression to
+// names.
+func referencedVariables(value Expression, names map[string]bool) {
+	switch v := value.(type) {
+	case *Variable:
+		names[v.Name] = true
+	case *InterpolatedString:
+		for _, part := range v.Parts {
+			referencedVariables(part, names)
+		}
+	case *Comparison:
+		referencedVariables(v.Args[0], names)
+		referencedVariables(v.Args[1], names)
+	case *BoolOp:
+		if v.Args[0] != nil {
+			referencedVariables(v.Args[0], names)
+		}
+		referencedVariables(v.Args[1], names)
+	case *Conditional:
+		referencedVariables(v.Cond, names)
+		referencedVariables(v.True, names)
+		referencedVariables(v.False, names)
+	case *MemberAccess:
+		referencedVariables(v.Base, names)
+	case *IndexAccess:
+		referencedVariables(v.Base, names)
+		referencedVariables(v.Index, names)
+	case *Operator:
+		referencedVariables(v.Args[0], names)
+		referencedVariables(v.Args[1], names)
+	case *List:
+		for _, value := range v.Values {
+			referencedVariables(value, names)
+		}
+	case *Map:
+		for _, prop := range v.Properties {
+			referencedVariables(prop.Value, names)
+		}
+	case *Select:
+		for _, c := range v.Cases {
+			referencedVariables(c.Value, names)
+		}
+		if v.Append != nil {
+			referencedVariables(v.Append, names)
+		}
+	}
+}
+
+// Fprint writes the File to w formatted as canonical Blueprint source, the same as Print.
+func Fprint(w io.Writer, file *File) error {
+	b, err := Print(file)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// FormatRegion formats the definitions in src that overlap the bytes from startOffset to
+// endOffset, and returns src with only the lines containing those definitions replaced.  The rest
+// of src is returned unchanged.  src must parse without errors, and the offsets must be in order
+// and inside src.
+func FormatRegion(src []byte, startOffset, endOffset int) ([]byte, error) {
+	if startOffset < 0 || endOffset < startOffset || endOffset > len(src) {
+		return nil, fmt.Errorf("invalid region %d-%d of %d bytes", startOffset, endOffset, len(src))
+	}
+	file, errs := Parse("", bytes.NewReader(src), NewScope(nil))
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	lineStart := func(offset int) int {
+		return bytes.LastIndexByte(src[:offset], '\n') + 1
+	}
+	lineEnd := func(offset int) int {
+		if i := bytes.IndexByte(src[offset:], '\n'); i >= 0 {
+			return offset + i
+		}
+		return len(src)
+	}
+
+	// Expand the region to whole lines, and then to any definitions that share a line with the
+	// region, until it stops growing.
+	regionStart, regionEnd := startOffset, endOffset
+	var selected []Definition
+	for {
+		regionStart, regionEnd = lineStart(regionStart), lineEnd(regionEnd)
+		selected = nil
+		grown := false
+		for _, def := range file.Defs {
+			if def.Pos().Offset >= regionEnd || def.End().Offset <= regionStart {
+				continue
+			}
+			selected = append(selected, def)
+			if def.Pos().Offset < regionStart {
+				regionStart, grown = def.Pos().Offset, true
+			}
+			if def.End().Offset > regionEnd {
+				regionEnd, grown = def.End().Offset, true
+			}
+		}
+		if !grown {
+			break
+		}
+	}
+	if len(selected) == 0 {
+		return src, nil
+	}
+
+	region := &File{Defs: selected}
+	for _, c := range file.Comments {
+		if c.Pos().Offset >= regionStart && c.Pos().Offset < regionEnd {
+			region.Comments = append(region.Comments, c)
+		}
+	}
+	printed, err := Print(region)
+	if err != nil {
+		return nil, err
+	}
+	printed = bytes.TrimLeft(printed, "\n")
+	printed = bytes.TrimRight(printed, "\n")
+
+	ret := make([]byte, 0, len(src))
+	ret = append(ret, src[:regionStart]...)
+	ret = append(ret, printed...)
+	ret = append(ret, src[regionEnd:]...)
+	return ret, nil
 }
 
 func PrintExpression(expression Expression) ([]byte, error) {
@@ -73,18 +561,175 @@ func PrintExpression(expression Expression) ([]byte, error) {
 	p := newPrinter(dummyFile)
 	p.printExpression(expression)
 	p.flush()
+	if p.err != nil {
+		return nil, p.err
+	}
 	return p.output, nil
 }
 
+// CompactString returns the expression as Blueprint source on a single line, ignoring positions
+// and comments, for example for logging.  Lists and maps are printed inline, like ["a", "b"] and
+// {name: "foo"}, and selects as select(arch(), {"arm": ["a"], default: []}).  Strings that
+// contain a newline are printed quoted even if they were raw.
+func CompactString(e Expression) string {
+	var b strings.Builder
+	writeCompact(&b, e)
+	return b.String()
+}
+
+func writeCompact(b *strings.Builder, e Expression) {
+	switch v := e.(type) {
+	case *Variable:
+		b.WriteString(v.Name)
+	case *InterpolatedString:
+		if literal := v.literal(); !strings.Contains(literal, "\n") {
+			b.WriteString(literal)
+		} else {
+			interpolated := *v
+			interpolated.Raw = false
+			b.WriteString(interpolated.literal())
+		}
+	case *MemberAccess:
+		writeCompact(b, v.Base)
+		b.WriteString("." + v.Name)
+	case *IndexAccess:
+		writeCompact(b, v.Base)
+		b.WriteString("[")
+		writeCompact(b, v.Index)
+		b.WriteString("]")
+	case *Operator:
+		writeCompact(b, v.Args[0])
+		b.WriteString(" " + string(v.Operator) + " ")
+		writeCompact(b, v.Args[1])
+	case *Comparison:
+		writeCompact(b, v.Args[0])
+		b.WriteString(" " + v.Operator + " ")
+		writeCompact(b, v.Args[1])
+	case *BoolOp:
+		if v.Args[0] != nil {
+			writeCompact(b, v.Args[0])
+			b.WriteString(" " + v.Operator + " ")
+		} else {
+			b.WriteString(v.Operator)
+		}
+		writeCompact(b, v.Args[1])
+	case *Conditional:
+		writeCompact(b, v.Cond)
+		b.WriteString(" ? ")
+		writeCompact(b, v.True)
+		b.WriteString(" : ")
+		writeCompact(b, v.False)
+	case *Bool:
+		b.WriteString(strconv.FormatBool(v.Value))
+	case *Int64:
+		if v.Token != "" {
+			b.WriteString(v.Token)
+		} else {
+			b.WriteString(strconv.FormatInt(v.Value, 10))
+		}
+	case *Float64:
+		b.WriteString(formatFloat(v))
+	case *String:
+		if v.Raw && !strings.ContainsAny(v.Value, "`\n") {
+			b.WriteString("`" + v.Value + "`")
+		} else {
+			b.WriteString(strconv.Quote(v.Value))
+		}
+	case *List:
+		b.WriteString("[")
+		for i, value := range v.Values {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeCompact(b, value)
+		}
+		b.WriteString("]")
+	case *Map:
+		b.WriteString("{")
+		for i, prop := range v.Properties {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(prop.Name + ": ")
+			writeCompact(b, prop.Value)
+		}
+		b.WriteString("}")
+	case *Select:
+		writeCompactSelect(b, v)
+	case UnsetProperty:
+		b.WriteString(v.String())
+	default:
+		b.WriteString(e.String())
+	}
+}
+
+func writeCompactSelect(b *strings.Builder, s *Select) {
+	if len(s.Conditions) == 0 && len(s.Cases) == 1 {
+		// A value that had a select added to it.
+		writeCompact(b, s.Cases[0].Value)
+	} else {
+		b.WriteString("select(")
+		if len(s.Conditions) > 1 {
+			b.WriteString("(")
+		}
+		for i, cond := range s.Conditions {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(cond.String())
+		}
+		if len(s.Conditions) > 1 {
+			b.WriteString(")")
+		}
+		b.WriteString(", {")
+		for i, c := range s.Cases {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if len(c.Patterns) > 1 {
+				b.WriteString("(")
+			}
+			for j, pattern := range c.Patterns {
+				if j > 0 {
+					b.WriteString(", ")
+				}
+				if isDefaultPattern(pattern) {
+					b.WriteString("default")
+				} else {
+					writeCompact(b, pattern)
+				}
+			}
+			if len(c.Patterns) > 1 {
+				b.WriteString(")")
+			}
+			b.WriteString(": ")
+			writeCompact(b, c.Value)
+		}
+		b.WriteString("})")
+	}
+	if s.Append != nil {
+		b.WriteString(" + ")
+		writeCompact(b, s.Append)
+	}
+}
+
 func (p *printer) Print() ([]byte, error) {
 	for _, def := range p.defs {
 		p.printDef(def)
 	}
 	p.flush()
+	if p.err != nil {
+		return nil, p.err
+	}
 	return p.output, nil
 }
 
 func (p *printer) printDef(def Definition) {
+	// Keep a blank line where the source had one, even if the definition has been moved or its
+	// positions have been cleared.
+	if len(p.output) > 0 && blankLinesBefore(def) > 0 {
+		p.requestDoubleNewline()
+	}
 	if assignment, ok := def.(*Assignment); ok {
 		p.printAssignment(assignment)
 	} else if module, ok := def.(*Module); ok {
@@ -94,6 +739,16 @@ func (p *printer) printDef(def Definition) {
 	}
 }
 
+func blankLinesBefore(def Definition) int {
+	switch def := def.(type) {
+	case *Assignment:
+		return def.BlankLinesBefore
+	case *Module:
+		return def.BlankLinesBefore
+	}
+	return 0
+}
+
 func (p *printer) printAssignment(assignment *Assignment) {
 	p.printToken(assignment.Name, assignment.NamePos)
 	p.requestSpace()
@@ -113,8 +768,47 @@ func (p *printer) printExpression(value Expression) {
 	switch v := value.(type) {
 	case *Variable:
 		p.printToken(v.Name, v.NamePos)
+	case *InterpolatedString:
+		literal := v.literal()
+		p.printToken(literal, v.LiteralPos)
+		p.pos.Line += strings.Count(literal, "\n")
+	case *MemberAccess:
+		p.printExpression(v.Base)
+		p.printToken(".", v.DotPos)
+		p.printToken(v.Name, v.NamePos)
+	case *IndexAccess:
+		p.printExpression(v.Base)
+		p.printToken("[", v.LBracketPos)
+		p.printExpression(v.Index)
+		p.printToken("]", v.RBracketPos)
 	case *Operator:
 		p.printOperator(v)
+	case *Comparison:
+		p.printExpression(v.Args[0])
+		p.requestSpace()
+		p.printToken(v.Operator, v.OperatorPos)
+		p.requestSpace()
+		p.printExpression(v.Args[1])
+	case *BoolOp:
+		if v.Args[0] != nil {
+			p.printExpression(v.Args[0])
+			p.requestSpace()
+			p.printToken(v.Operator, v.OperatorPos)
+			p.requestSpace()
+		} else {
+			p.printToken(v.Operator, v.OperatorPos)
+		}
+		p.printExpression(v.Args[1])
+	case *Conditional:
+		p.printExpression(v.Cond)
+		p.requestSpace()
+		p.printToken("?", v.QuestionPos)
+		p.requestSpace()
+		p.printExpression(v.True)
+		p.requestSpace()
+		p.printToken(":", v.ColonPos)
+		p.requestSpace()
+		p.printExpression(v.False)
 	case *Bool:
 		var s string
 		if v.Value {
@@ -124,15 +818,27 @@ func (p *printer) printExpression(value Expression) {
 		}
 		p.printToken(s, v.LiteralPos)
 	case *Int64:
-		p.printToken(strconv.FormatInt(v.Value, 10), v.LiteralPos)
+		if v.Token != "" {
+			p.printToken(v.Token, v.LiteralPos)
+		} else {
+			p.printToken(strconv.FormatInt(v.Value, 10), v.LiteralPos)
+		}
+	case *Float64:
+		p.printToken(formatFloat(v), v.LiteralPos)
 	case *String:
-		p.printToken(strconv.Quote(v.Value), v.LiteralPos)
+		p.printString(v)
 	case *List:
-		p.printList(v.Values, v.LBracePos, v.RBracePos)
+		p.printList(v)
 	case *Map:
 		p.printMap(v)
 	case *Select:
 		p.printSelect(v)
+	case *Placeholder:
+		// The source of the value was discarded when parsing with ParseOptions.MetadataOnly.
+		if p.err == nil {
+			p.err = fmt.Errorf("%s: cannot print the placeholder for a %s value of a file parsed with MetadataOnly",
+				v.Pos(), v.ValueType)
+		}
 	default:
 		panic(fmt.Errorf("bad property type: %s", value.Type()))
 	}
@@ -161,6 +867,9 @@ func (p *printer) printSelect(s *Select) {
 		}
 	}
 	for i, c := range s.Conditions {
+		if c.Negated {
+			p.printToken("!", c.position)
+		}
 		p.printToken(c.FunctionName, c.position)
 		p.printToken("(", c.position)
 		for i, arg := range c.Args {
@@ -199,7 +908,7 @@ func (p *printer) printSelect(s *Select) {
 			switch pat := pat.(type) {
 			case *String:
 				if pat.Value != default_select_branch_name {
-					p.printToken(strconv.Quote(pat.Value), pat.LiteralPos)
+					p.printString(pat)
 				} else {
 					p.printToken("default", pat.LiteralPos)
 				}
@@ -240,20 +949,24 @@ func (p *printer) printSelect(s *Select) {
 	}
 }
 
-func (p *printer) printList(list []Expression, pos, endPos scanner.Position) {
+func (p *printer) printList(list *List) {
+	pos, endPos := list.LBracePos, list.RBracePos
 	p.requestSpace()
 	p.printToken("[", pos)
-	if len(list) > 1 || pos.Line != endPos.Line || listHasMap(list) {
+	if len(list.Values) > 1 || pos.Line != endPos.Line || listHasMap(list.Values) {
 		p.requestNewline()
 		p.indent(p.curIndent() + 4)
-		for _, value := range list {
+		for i, value := range list.Values {
+			p.printAttachedComments(list.valueComments(i), value.Pos())
 			p.printExpression(value)
 			p.printToken(",", noPos)
 			p.requestNewline()
 		}
+		p.printAttachedComments(list.TrailingComments, endPos)
 		p.unindent(endPos)
 	} else {
-		for _, value := range list {
+		for i, value := range list.Values {
+			p.printAttachedComments(list.valueComments(i), value.Pos())
 			p.printExpression(value)
 		}
 	}
@@ -271,6 +984,7 @@ func (p *printer) printMap(m *Map) {
 			p.printToken(",", noPos)
 			p.requestNewline()
 		}
+		p.printAttachedComments(m.TrailingComments, m.RBracePos)
 		p.unindent(m.RBracePos)
 	}
 	p.printToken("}", m.RBracePos)
@@ -284,6 +998,11 @@ func (p *printer) printOperatorInternal(operator *Operator, allowIndent bool) {
 	p.printExpression(operator.Args[0])
 	p.requestSpace()
 	p.printToken(string(operator.Operator), operator.OperatorPos)
+	for _, c := range operator.Comments {
+		if !slices.Contains(p.comments, c) {
+			p.printComment(c)
+		}
+	}
 
 	indented := false
 	if operator.Args[0].End().Line == operator.Args[1].Pos().Line {
@@ -308,6 +1027,7 @@ func (p *printer) printOperatorInternal(operator *Operator, allowIndent bool) {
 }
 
 func (p *printer) printProperty(property *Property) {
+	p.printAttachedComments(property.Comments, property.Pos())
 	p.printToken(property.Name, property.NamePos)
 	p.printToken(":", property.ColonPos)
 	p.requestSpace()
@@ -337,6 +1057,18 @@ func (p *printer) printToken(s string, pos scanner.Position) {
 	p.pos = pos
 }
 
+// printString prints a string literal, keeping raw strings verbatim.
+func (p *printer) printString(s *String) {
+	if !s.Raw || strings.Contains(s.Value, "`") {
+		p.printToken(strconv.Quote(s.Value), s.LiteralPos)
+		return
+	}
+	p.printToken("`"+s.Value+"`", s.LiteralPos)
+	// A raw string can span lines, end it on its last line so the newlines that follow it are not
+	// counted as blank lines.
+	p.pos.Line += strings.Count(s.Value, "\n")
+}
+
 // Print any in-line (single line /* */) comments that appear _before_ pos
 func (p *printer) printInLineCommentsBefore(pos scanner.Position) {
 	for p.curComment < len(p.comments) && p.comments[p.curComment].Pos().Offset < pos.Offset {
@@ -452,6 +1184,24 @@ func (p *printer) printComment(cg *CommentGroup) {
 	}
 }
 
+// printAttachedComments prints the comments attached to a node before the token at pos that starts
+// it, the same way as they would have been printed from their position.
+func (p *printer) printAttachedComments(comments []*CommentGroup, pos scanner.Position) {
+	for _, cg := range comments {
+		if p.pendingNewline != 0 {
+			p.printEndOfLineCommentsBefore(cg.Pos())
+		}
+		p.printInLineCommentsBefore(cg.Pos())
+		p.printComment(cg)
+		if cg.Comments[0].Comment[0][0:2] == "//" || len(cg.Comments[0].Comment) > 1 ||
+			cg.End().Line < pos.Line {
+			p._requestNewline()
+		} else {
+			p.requestSpace()
+		}
+	}
+}
+
 // Print any comments that occur after the last token, and a trailing newline
 func (p *printer) flush() {
 	for _, c := range p.skippedComments {
@@ -507,3 +1257,16 @@ func listHasMap(list []Expression) bool {
 	}
 	return false
 }
+
+// formatFloat returns the original token of a Float64 if it has one, to preserve the way it was
+// written.  Otherwise it formats the value so that it always parses back as a float.
+func formatFloat(f *Float64) string {
+	if f.Token != "" {
+		return f.Token
+	}
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
@@ -16,6 +16,10 @@ package parser
 
 import (
 	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -30,6 +34,35 @@ foo {}
 `,
 		output: `
 foo {}
+`,
+	},
+	{
+		name: "Comment above sorted list values",
+		input: `
+foo {
+    srcs: [
+        // Core sources
+        "b.c",
+        "a.c",
+
+        // Extra sources
+        "d.c",
+        "c.c",
+    ],
+}
+`,
+		output: `
+foo {
+    srcs: [
+        // Core sources
+        "a.c",
+        "b.c",
+
+        // Extra sources
+        "c.c",
+        "d.c",
+    ],
+}
 `,
 	},
 	{
@@ -733,6 +766,231 @@ foo {
         default: [],
     }),
 }
+`,
+	},
+	{
+		name: "List of maps",
+		input: `
+foo {
+    list: [{name: "a", value: "x"}, {
+        name: "b",
+        value: "y",
+    }],
+    single: [{name: "c"}],
+}
+`,
+		output: `
+foo {
+    list: [
+        {
+            name: "a",
+            value: "x",
+        },
+        {
+            name: "b",
+            value: "y",
+        },
+    ],
+    single: [
+        {
+            name: "c",
+        },
+    ],
+}
+`,
+	},
+	{
+		name: "List of multi-line maps",
+		input: `
+foo {
+    list: [
+        // first
+        {
+            name: "a",
+            value: "x",
+        },
+        // second
+        {
+            name: "b",
+            value: "y",
+        },
+    ],
+}
+`,
+		output: `
+foo {
+    list: [
+        // first
+        {
+            name: "a",
+            value: "x",
+        },
+        // second
+        {
+            name: "b",
+            value: "y",
+        },
+    ],
+}
+`,
+	},
+	{
+		name: "List subtraction",
+		input: `
+foo {
+    srcs: ["a.c", "b.c"] -
+        ["b.c"],
+    cflags: ["-Wall"] + ["-Werror"] - ["-Wall"],
+}
+`,
+		output: `
+foo {
+    srcs: [
+        "a.c",
+        "b.c",
+    ] -
+        ["b.c"],
+    cflags: ["-Wall"] + ["-Werror"] - ["-Wall"],
+}
+`,
+	},
+	{
+		name: "Member and index access",
+		input: `
+foo {
+    srcs: config.arm.srcs + ["a.c"],
+    cflags: config.cflags,
+    first: srcs[0],
+    nested: configs[i + 1].name,
+}
+`,
+		output: `
+foo {
+    srcs: config.arm.srcs + ["a.c"],
+    cflags: config.cflags,
+    first: srcs[0],
+    nested: configs[i + 1].name,
+}
+`,
+	},
+	{
+		name: "Integer bases",
+		input: `
+foo {
+    mode: 0755,
+    mask: 0xFF,
+    offset: -0x10,
+    count: 12,
+}
+`,
+		output: `
+foo {
+    mode: 0755,
+    mask: 0xFF,
+    offset: -0x10,
+    count: 12,
+}
+`,
+	},
+	{
+		name: "Floats",
+		input: `
+foo {
+    compression_ratio: 0.80,
+    scale: -1.5e3,
+    weights: [0.5, 1.0],
+}
+`,
+		output: `
+foo {
+    compression_ratio: 0.80,
+    scale: -1.5e3,
+    weights: [
+        0.5,
+        1.0,
+    ],
+}
+`,
+	},
+	{
+		name: "Raw strings",
+		input: `
+foo {
+    script: ` + "`  leading spaces\n\tand a tab\n  `" + `,
+    name: "foo",
+}
+`,
+		output: `
+foo {
+    script: ` + "`  leading spaces\n\tand a tab\n  `" + `,
+    name: "foo",
+}
+`,
+	},
+	{
+		name: "Sorted multi-line raw strings",
+		input: `
+foo {
+    cmds: [
+        "z", // zed
+        ` + "`b1\nb2`" + `, // bee
+        "a",
+    ],
+}
+`,
+		output: `
+foo {
+    cmds: [
+        "a",
+        ` + "`b1\nb2`" + `, // bee
+        "z", // zed
+    ],
+}
+`,
+	},
+	{
+		name: "Comparisons",
+		input: `
+enabled = version>=3
+foo {
+    static: "a"+"b" != name,
+}
+`,
+		output: `
+enabled = version >= 3
+foo {
+    static: "a" + "b" != name,
+}
+`,
+	},
+	{
+		name: "Bool operators",
+		input: `
+foo {
+    enabled: a&&!b||c,
+    host: !   host_default && version>=3,
+}
+`,
+		output: `
+foo {
+    enabled: a && !b || c,
+    host: !host_default && version >= 3,
+}
+`,
+	},
+	{
+		name: "Conditionals",
+		input: `
+foo {
+    cflags: debug?["-O0"]:["-O2"],
+    stl: version >= 3 ? "c++" : "none",
+}
+`,
+		output: `
+foo {
+    cflags: debug ? ["-O0"] : ["-O2"],
+    stl: version >= 3 ? "c++" : "none",
+}
 `,
 	},
 }
@@ -771,3 +1029,616 @@ func TestPrinter(t *testing.T) {
 		})
 	}
 }
+
+func TestFprint(t *testing.T) {
+	for _, testCase := range validPrinterTestCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			file, errs := Parse("", bytes.NewBufferString(testCase.input[1:]), NewScope(nil))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			SortLists(file)
+
+			buf := &bytes.Buffer{}
+			if err := Fprint(buf, file); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if buf.String() != testCase.output[1:] {
+				t.Errorf("expected: %s\ngot: %s", testCase.output[1:], buf.String())
+			}
+
+			// Printing the printed output again must not change it.
+			reparsed, errs := Parse("", bytes.NewReader(buf.Bytes()), NewScope(nil))
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors reparsing: %v", errs)
+			}
+			reprinted := &bytes.Buffer{}
+			if err := Fprint(reprinted, reparsed); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if reprinted.String() != buf.String() {
+				t.Errorf("expected printing to be idempotent, got:\n%s\nthen:\n%s", buf.String(), reprinted.String())
+			}
+		})
+	}
+}
+
+func TestPrintModules(t *testing.T) {
+	input := `
+base = ["-Wall"]
+unused = ["-Wextra"]
+cflags = base + ["-Werror"]
+cflags += ["-O2"]
+
+// The bar module
+bar {
+    name: "bar",
+    cflags: unused,
+}
+
+// The foo module
+foo {
+    name: "foo",
+    cflags: cflags,
+}
+
+baz {
+    name: "baz",
+}
+`
+	expected := `
+base = ["-Wall"]
+
+cflags = base + ["-Werror"]
+cflags += ["-O2"]
+
+// The foo module
+foo {
+    name: "foo",
+    cflags: cflags,
+}
+
+baz {
+    name: "baz",
+}
+`
+	file := parseForTest(t, input)
+
+	got, err := PrintModules(file, []string{"baz", "foo"}, PrinterConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != expected[1:] {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected[1:], got)
+	}
+
+	_, err = PrintModules(file, []string{"foo", "missing"}, PrinterConfig{})
+	if err == nil || err.Error() != `module "missing" not found` {
+		t.Errorf("expected missing module error, got %v", err)
+	}
+}
+
+func TestPrintAttachedComments(t *testing.T) {
+	input := `
+foo {
+    deps: [
+        // why libc
+        "libc",
+        // why libz
+        "libz",
+        // why liblog
+        "liblog",
+        // more to come
+    ],
+    // the name
+    name: "foo",
+}
+`
+	file := parseForTest(t, input)
+	module := file.Defs[0].(*Module)
+	deps, _ := module.GetProperty("deps")
+	list := deps.Value.(*List)
+
+	// The comment of a removed value is removed with it.  The lines they were on are printed as a
+	// blank line, the same as for a value without comments.
+	list.RemoveMatching(func(e Expression) bool { return e.(*String).Value == "liblog" })
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `foo {
+    deps: [
+        // why libc
+        "libc",
+        // why libz
+        "libz",
+
+        // more to come
+    ],
+    // the name
+    name: "foo",
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// The comments of values are printed with them when the list is printed on its own.
+	list.Values[0], list.Values[1] = list.Values[1], list.Values[0]
+	list.ValueComments[0], list.ValueComments[1] = list.ValueComments[1], list.ValueComments[0]
+	got, err = PrintExpression(list)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !regexp.MustCompile(`(?s)// why libz\s*"libz",\s*// why libc\s*"libc",\s*// more to come\s*\]`).Match(got) {
+		t.Errorf("expected the comments to move with their values, got:\n%s", got)
+	}
+}
+
+func TestPrintStrippedComments(t *testing.T) {
+	file := parseForTest(t, `
+// Leading comment
+foo {
+    name: "foo", // end of line comment
+    /* block comment */ srcs: [
+        // list comment
+        "a.c",
+    ],
+}
+// Trailing comment
+`)
+	file.StripComments()
+
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `foo {
+    name: "foo",
+    srcs: [
+        "a.c",
+    ],
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestPrintNormalizedIntTokens(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    mode: 0755,
+    mask: [0xFF, -0x10],
+}
+`)
+	file.NormalizeIntTokens()
+
+	got, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `foo {
+    mode: 493,
+    mask: [
+        255,
+        -16,
+    ],
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestPrintWithHeaderAndFooter(t *testing.T) {
+	file := parseForTest(t, `
+// The foo module
+foo {
+    name: "foo",
+}
+`)
+
+	got, err := PrintWithConfig(file, PrinterConfig{
+		Header: "DO NOT EDIT\n\nThis file is generated by gen_foo.",
+		Footer: "End of generated file",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `// DO NOT EDIT
+//
+// This file is generated by gen_foo.
+
+// The foo module
+foo {
+    name: "foo",
+}
+
+// End of generated file
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	reparsed := parseForTest(t, string(got))
+	if equivalent, diff := FilesEquivalent(file, reparsed); !equivalent {
+		t.Errorf("expected the banners not to change the definitions, got difference at %s", diff)
+	}
+}
+
+func TestBlankLinesBetweenDefinitions(t *testing.T) {
+	file := parseForTest(t, `a = "1"
+// about b
+
+
+b = "2"
+
+/* about
+   c */
+c = "3"
+d = "4"
+`)
+	var got []int
+	for _, def := range file.Defs {
+		got = append(got, def.(*Assignment).BlankLinesBefore)
+	}
+	if expected := []int{0, 2, 1, 0}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected blank lines %v, got %v", expected, got)
+	}
+
+	// Definitions without positions, like ones that were created or moved, still get a blank line
+	// where the source had one.
+	stripped := &File{}
+	for _, def := range file.Defs {
+		assignment := stripDefinitionPositions(def).(*Assignment)
+		assignment.BlankLinesBefore = def.(*Assignment).BlankLinesBefore
+		stripped.Defs = append(stripped.Defs, assignment)
+	}
+	printed, err := Print(stripped)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `a = "1"
+
+b = "2"
+
+c = "3"
+d = "4"
+`
+	if string(printed) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, printed)
+	}
+}
+
+func TestPrintWithGroupBy(t *testing.T) {
+	input := `
+cc_library {
+    name: "libfoo",
+    // The sources
+    srcs: ["a.c"],
+    shared_libs: ["libc"], // for libc
+    cflags: ["-Wall"],
+    static_libs: [
+        "libz",
+    ],
+}
+
+// Another module
+cc_binary {
+    name: "bar",
+}
+`
+	file := parseForTest(t, input)
+
+	got, err := PrintWithConfig(file, PrinterConfig{
+		GroupBy: func(p *Property) string {
+			if strings.HasSuffix(p.Name, "_libs") {
+				return "deps"
+			}
+			return "other"
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `cc_library {
+    name: "libfoo",
+    // The sources
+    srcs: ["a.c"],
+    cflags: ["-Wall"],
+
+    shared_libs: ["libc"], // for libc
+    static_libs: [
+        "libz",
+    ],
+}
+
+// Another module
+cc_binary {
+    name: "bar",
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// The original file is not modified.
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(printed) != input[1:] {
+		t.Errorf("expected the original file to be unchanged, got:\n%s", printed)
+	}
+
+	// The comment after a property that moves earlier moves with it, out of the property before.
+	file = parseForTest(t, `
+foo {
+    name: "foo",
+    shared_libs: [
+        "libc", // libc
+    ],
+    cflags: ["-a"], // the flags
+}
+`)
+	got, err = PrintWithConfig(file, PrinterConfig{
+		GroupBy: func(p *Property) string {
+			if strings.HasSuffix(p.Name, "_libs") {
+				return "deps"
+			}
+			return "other"
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = `foo {
+    name: "foo",
+    cflags: ["-a"], // the flags
+
+    shared_libs: [
+        "libc", // libc
+    ],
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestPrintWithSortProperties(t *testing.T) {
+	input := `
+cc_library {
+    srcs: ["a.c"],
+    // The name
+    name: "libfoo",
+    shared_libs: ["libc"], // for libc
+    arch: {
+        x86: {
+            srcs: ["x86.c"],
+            cflags: ["-m32"],
+        },
+        arm: {
+            srcs: ["arm.c"],
+            // For arm
+            cflags: ["-marm"],
+        },
+    },
+    cflags: ["-Wall"],
+    // Trailing comment
+}
+
+defaults = {
+    b: 1,
+    a: 2,
+}
+`
+	file := parseForTest(t, input)
+
+	got, err := PrintWithConfig(file, PrinterConfig{SortProperties: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `cc_library {
+    // The name
+    name: "libfoo",
+    arch: {
+        arm: {
+            // For arm
+            cflags: ["-marm"],
+            srcs: ["arm.c"],
+        },
+        x86: {
+            cflags: ["-m32"],
+            srcs: ["x86.c"],
+        },
+    },
+    cflags: ["-Wall"],
+    shared_libs: ["libc"], // for libc
+    srcs: ["a.c"],
+    // Trailing comment
+}
+
+defaults = {
+    a: 2,
+    b: 1,
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// The original file is not modified.
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(printed) != input[1:] {
+		t.Errorf("expected the original file to be unchanged, got:\n%s", printed)
+	}
+
+	// A comment inside a property that moves later stays before the comments of the properties
+	// that move earlier.
+	file = parseForTest(t, `
+foo {
+    srcs: [
+        "a.c", // trailing a
+    ],
+    name: "x", // the name
+    cflags: ["-a"],
+}
+`)
+	got, err = PrintWithConfig(file, PrinterConfig{SortProperties: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = `foo {
+    name: "x", // the name
+    cflags: ["-a"],
+    srcs: [
+        "a.c", // trailing a
+    ],
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestFormatRegion(t *testing.T) {
+	src := `// Clean module
+foo {
+    name: "foo",
+}
+
+// Misformatted module
+bar {name:"bar",
+      srcs:["b.c","a.c"], // sources
+   }
+baz   =   [ "x" ]
+
+qux {
+    name: "qux",
+}
+`
+	start := strings.Index(src, "srcs")
+	got, err := FormatRegion([]byte(src), start, start+4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `// Clean module
+foo {
+    name: "foo",
+}
+
+// Misformatted module
+bar {
+    name: "bar",
+    srcs: [ // sources
+        "b.c",
+        "a.c",
+    ],
+}
+baz   =   [ "x" ]
+
+qux {
+    name: "qux",
+}
+`
+	if string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	start = strings.Index(src, "baz")
+	got, err = FormatRegion([]byte(src), start, start)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := strings.Replace(src, `baz   =   [ "x" ]`, `baz = ["x"]`, 1); string(got) != w {
+		t.Errorf("expected:\n%s\ngot:\n%s", w, got)
+	}
+
+	start = strings.Index(src, "\n\nqux")
+	if got, err := FormatRegion([]byte(src), start+1, start+1); err != nil || string(got) != src {
+		t.Errorf("expected a region with no definitions to be unchanged, got %q, %v", got, err)
+	}
+
+	for _, tt := range []struct{ start, end int }{
+		{-1, 4},
+		{4, 2},
+		{0, len(src) + 1},
+	} {
+		w := fmt.Sprintf("invalid region %d-%d of %d bytes", tt.start, tt.end, len(src))
+		if _, err := FormatRegion([]byte(src), tt.start, tt.end); err == nil || err.Error() != w {
+			t.Errorf("expected error %q, got %v", w, err)
+		}
+	}
+}
+
+func TestPrintOperatorComments(t *testing.T) {
+	input := `foo {
+    cflags: ["-a"] + /* debug */ ["-b"],
+    ldflags: ["-a"] + // why
+        ["-b"],
+}
+`
+	file := parseForTest(t, input)
+	module := file.Defs[0].(*Module)
+	cflags := module.Properties[0].Value.(*Operator)
+	if len(cflags.Comments) != 1 || cflags.Comments[0].Comments[0].Text() != " debug \n" {
+		t.Errorf("expected the comment to be attached to the operator, got %v", cflags.Comments)
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(printed) != input {
+		t.Errorf("expected:\n%s\ngot:\n%s", input, printed)
+	}
+
+	// PrintExpression doesn't have the comments of the file, so it prints the attached comments.
+	for _, tt := range []struct {
+		prop     int
+		expected string
+	}{
+		{0, "[\"-a\"] + /* debug */ [\"-b\"]\n"},
+		{1, "[\"-a\"] + // why\n    [\"-b\"]\n"},
+	} {
+		printed, err := PrintExpression(module.Properties[tt.prop].Value)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The expression isn't on the first line, so PrintExpression starts with newlines.
+		if got := strings.TrimLeft(string(printed), "\n"); got != tt.expected {
+			t.Errorf("expected:\n%q\ngot:\n%q", tt.expected, got)
+		}
+	}
+}
+
+func TestCompactString(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"[\n    \"a\",\n    \"b\",\n]", `["a", "b"]`},
+		{"[]", `[]`},
+		{"{\n    name: \"foo\",\n    arch: {\n        arm: {enabled: true},\n    },\n    count: 0x10,\n}", `{name: "foo", arch: {arm: {enabled: true}}, count: 0x10}`},
+		{"select(arch(), {\n    \"arm\": [\"arm.c\"],\n    default: unset,\n})", `select(arch(), {"arm": ["arm.c"], default: unset})`},
+		{
+			"[\"a.c\"] + select((os(), !release_flag(\"FOO\")), {\n    (\"linux\", true): [\"b.c\"],\n    (default, default): [],\n})",
+			`["a.c"] + select((os(), !release_flag("FOO")), {("linux", true): ["b.c"], (default, default): []})`,
+		},
+		{"x.y[1] == 2 ? `raw` : \"s\"", "x.y[1] == 2 ? `raw` : \"s\""},
+	}
+	for _, tt := range testCases {
+		value, errs := ParseExpression(strings.NewReader(tt.input))
+		if len(errs) != 0 {
+			t.Fatalf("%s: unexpected errors: %v", tt.input, errs)
+		}
+		if got := CompactString(value); got != tt.expected {
+			t.Errorf("expected %s, got %s", tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"text/scanner"
+)
+
+// ResolveFile returns a copy of the modules of f with every property set to the concrete value it
+// has for the conditions returned by condLookup.  The tree of f is evaluated the same way as
+// ParseAndEval evaluates it, with the variables assigned in f and those in scope, so f does not
+// need to have been evaluated and is not modified.  Variables are replaced by their values,
+// operators by their results and selects by the value of the case that matches.  condLookup is
+// called with each condition of a select without any negation, and returns false if the condition
+// is undefined.  Properties that resolve to unset are left out.  The result has no assignments,
+// comments or positions.  It returns an error for a file parsed with MetadataOnly.
+func ResolveFile(f *File, scope *Scope, condLookup func(ConfigurableCondition) (string, bool)) (*File, []error) {
+	e := &evaluator{
+		scope: scope,
+		vars:  make(map[string]Expression),
+	}
+	resolved := &File{Name: f.Name}
+	var errs []error
+	for _, def := range f.Defs {
+		switch def := def.(type) {
+		case *Assignment:
+			if err := e.assign(def); err != nil {
+				errs = append(errs, err)
+			}
+		case *Module:
+			m, err := e.eval(&def.Map)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			props, propErrs := resolveProperties(m.(*Map).Properties, condLookup)
+			errs = append(errs, propErrs...)
+			resolved.Defs = append(resolved.Defs, &Module{
+				Type: def.Type,
+				Map:  Map{Properties: props},
+			})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return resolved, nil
+}
+
+// evaluator evaluates the tree of a File after it has been parsed, with the same evaluation of
+// values as the parser.
+type evaluator struct {
+	scope *Scope
+
+	// vars holds the evaluated values of the variables assigned so far.
+	vars map[string]Expression
+}
+
+// assign evaluates the value of an assignment and records it as the value of its variable.
+func (e *evaluator) assign(a *Assignment) error {
+	value, err := e.eval(a.OrigValue)
+	if err != nil {
+		return err
+	}
+	if a.Assigner == "+=" {
+		old, err := e.variable(a.Name, a.NamePos)
+		if err != nil {
+			return err
+		}
+		if value, err = e.operator(old, value, '+', a.EqualsPos); err != nil {
+			return err
+		}
+	}
+	e.vars[a.Name] = value
+	return nil
+}
+
+// variable returns the evaluated value of the named variable.
+func (e *evaluator) variable(name string, pos scanner.Position) (Expression, error) {
+	if value, ok := e.vars[name]; ok {
+		return value, nil
+	}
+	if e.scope != nil {
+		if a, _ := e.scope.Get(name); a != nil {
+			return e.eval(a.Value)
+		}
+	}
+	return nil, &ParseError{Err: fmt.Errorf("variable %q is not set", name), Pos: pos}
+}
+
+// operator returns the result of an operator on two evaluated values.
+func (e *evaluator) operator(value1, value2 Expression, operator rune, pos scanner.Position) (Expression, error) {
+	result, err := operatorValue(value1, value2, operator, pos)
+	if err != nil {
+		return nil, positionedError(err, pos)
+	}
+	return result, nil
+}
+
+// positionedError returns err as a ParseError at pos, unless it already has a position.
+func positionedError(err error, pos scanner.Position) error {
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	return &ParseError{Err: err, Pos: pos}
+}
+
+// eval returns the value of an expression, which is a literal, a list, a map or a select whose
+// values are evaluated.  The expression is not modified.
+func (e *evaluator) eval(value Expression) (Expression, error) {
+	switch v := value.(type) {
+	case *String, *Int64, *Float64, *Bool, UnsetProperty:
+		return v, nil
+	case *Variable:
+		return e.variable(v.Name, v.NamePos)
+	case *Operator:
+		args, err := e.evalArgs(v.Args)
+		if err != nil {
+			return nil, err
+		}
+		return e.operator(args[0], args[1], v.Operator, v.OperatorPos)
+	case *Comparison:
+		args, err := e.evalArgs(v.Args)
+		if err != nil {
+			return nil, err
+		}
+		result, err := comparisonValue(args[0], args[1], v.Operator, v.OperatorPos)
+		if err != nil {
+			return nil, positionedError(err, v.OperatorPos)
+		}
+		return result, nil
+	case *BoolOp:
+		args, err := e.evalArgs(v.Args)
+		if err != nil {
+			return nil, err
+		}
+		return boolOpValue(args[0], args[1], v.Operator, v.OperatorPos)
+	case *Conditional:
+		cond, err := e.eval(v.Cond)
+		if err != nil {
+			return nil, err
+		}
+		branch, err := conditionalBranch(v, cond)
+		if err != nil {
+			return nil, err
+		}
+		return e.eval(branch)
+	case *MemberAccess:
+		base, err := e.eval(v.Base)
+		if err != nil {
+			return nil, err
+		}
+		value, err := memberValue(v, base)
+		if err != nil {
+			return nil, err
+		}
+		return value.Eval(), nil
+	case *IndexAccess:
+		base, err := e.eval(v.Base)
+		if err != nil {
+			return nil, err
+		}
+		index, err := e.eval(v.Index)
+		if err != nil {
+			return nil, err
+		}
+		return indexValue(v, base, index)
+	case *InterpolatedString:
+		parts := make([]Expression, len(v.Parts))
+		for i, part := range v.Parts {
+			var err error
+			if parts[i], err = e.eval(part); err != nil {
+				return nil, err
+			}
+		}
+		return interpolatedValue(v, parts)
+	case *List:
+		ret := &List{LBracePos: v.LBracePos, RBracePos: v.RBracePos}
+		for _, elem := range v.Values {
+			elem, err := e.eval(elem)
+			if err != nil {
+				return nil, err
+			}
+			ret.Values = append(ret.Values, elem)
+		}
+		return ret, nil
+	case *Map:
+		ret := &Map{LBracePos: v.LBracePos, RBracePos: v.RBracePos}
+		for _, prop := range v.Properties {
+			value, err := e.eval(prop.Value)
+			if err != nil {
+				return nil, err
+			}
+			newProp := *prop
+			newProp.Value = value
+			ret.Properties = append(ret.Properties, &newProp)
+		}
+		return ret, nil
+	case *Select:
+		ret := *v
+		ret.Cases = make([]*SelectCase, len(v.Cases))
+		for i, c := range v.Cases {
+			value, err := e.eval(c.Value)
+			if err != nil {
+				return nil, err
+			}
+			newCase := *c
+			newCase.Value = value
+			ret.Cases[i] = &newCase
+		}
+		if v.Append != nil {
+			var err error
+			if ret.Append, err = e.eval(v.Append); err != nil {
+				return nil, err
+			}
+		}
+		// The types of cases set to variables are only known once they are evaluated.
+		ty, err := checkSelectCases(ret.Cases)
+		if err != nil {
+			return nil, positionedError(err, v.KeywordPos)
+		}
+		ret.ExpressionType = ty
+		return &ret, nil
+	case *Placeholder:
+		return nil, &ParseError{
+			Err: fmt.Errorf("cannot resolve the placeholder for a %s value of a file parsed with MetadataOnly", v.Type()),
+			Pos: v.Pos(),
+		}
+	default:
+		return nil, &ParseError{
+			Err: fmt.Errorf("cannot evaluate %s of type %s", value, value.Type()),
+			Pos: value.Pos(),
+		}
+	}
+}
+
+// evalArgs evaluates the operands of an operator, leaving a missing operand nil.
+func (e *evaluator) evalArgs(args [2]Expression) ([2]Expression, error) {
+	var ret [2]Expression
+	for i, arg := range args {
+		if arg == nil {
+			continue
+		}
+		var err error
+		if ret[i], err = e.eval(arg); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func resolveProperties(props []*Property, condLookup func(ConfigurableCondition) (string, bool)) ([]*Property, []error) {
+	var ret []*Property
+	var errs []error
+	for _, prop := range props {
+		value, err := resolveValue(prop.Value, condLookup)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, unset := value.(UnsetProperty); !unset {
+			ret = append(ret, &Property{Name: prop.Name, Value: value})
+		}
+	}
+	return ret, errs
+}
+
+// resolveValue returns the literal value of an evaluated expression, resolving selects with
+// condLookup.
+func resolveValue(value Expression, condLookup func(ConfigurableCondition) (string, bool)) (Expression, error) {
+	switch v := value.Eval().(type) {
+	case *String:
+		return &String{Value: v.Value}, nil
+	case *Bool:
+		return &Bool{Value: v.Value}, nil
+	case *Int64:
+		return &Int64{Value: v.Value, Token: v.Token}, nil
+	case *Float64:
+		return &Float64{Value: v.Value, Token: v.Token}, nil
+	case *List:
+		ret := &List{}
+		for _, elem := range v.Values {
+			resolved, err := resolveValue(elem, condLookup)
+			if err != nil {
+				return nil, err
+			}
+			ret.Values = append(ret.Values, resolved)
+		}
+		return ret, nil
+	case *Map:
+		props, errs := resolveProperties(v.Properties, condLookup)
+		if len(errs) > 0 {
+			return nil, errs[0]
+		}
+		return &Map{Properties: props}, nil
+	case *Select:
+		values := make(map[string][]string)
+		collectConditionValues(v, condLookup, values)
+		result, err := v.Resolve(values)
+		if err != nil {
+			return nil, &ParseError{Err: err, Pos: v.Pos()}
+		}
+		return resolveValue(result, condLookup)
+	case UnsetProperty:
+		return UnsetProperty{}, nil
+	default:
+		return nil, &ParseError{
+			Err: fmt.Errorf("cannot resolve %s of type %s", value, value.Type()),
+			Pos: value.Pos(),
+		}
+	}
+}
+
+// collectConditionValues adds the values returned by condLookup for the conditions of every select
+// in an evaluated expression to values, in the form expected by Select.Resolve.
+func collectConditionValues(value Expression, condLookup func(ConfigurableCondition) (string, bool),
+	values map[string][]string) {
+
+	switch v := value.Eval().(type) {
+	case *List:
+		for _, elem := range v.Values {
+			collectConditionValues(elem, condLookup, values)
+		}
+	case *Map:
+		for _, prop := range v.Properties {
+			collectConditionValues(prop.Value, condLookup, values)
+		}
+	case *Select:
+		for _, cond := range v.Conditions {
+			cond.Negated = false
+			if value, ok := condLookup(cond); ok {
+				values[cond.String()] = []string{value}
+			}
+		}
+		for _, c := range v.Cases {
+			collectConditionValues(c.Value, condLookup, values)
+		}
+		if v.Append != nil {
+			collectConditionValues(v.Append, condLookup, values)
+		}
+	}
+}
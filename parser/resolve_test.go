@@ -0,0 +1,150 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResolveFile(t *testing.T) {
+	file := parseForTest(t, `
+common_srcs = ["common.c"]
+version = 2
+
+cc_library {
+    name: "lib" + "foo",
+    srcs: common_srcs + ["foo.c"] + select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+    version: version + 1,
+    debug: select(!release_flag("RELEASE_OPT"), {
+        true: true,
+        default: false,
+    }),
+    target: {
+        host: {
+            cflags: select(os(), {
+                "linux": ["-DLINUX"],
+                default: unset,
+            }),
+        },
+    },
+    unset_on_darwin: select(os(), {
+        "darwin": unset,
+        default: "set",
+    }),
+}
+`)
+	lookup := map[string]string{
+		"arch()":                      "arm",
+		"os()":                        "darwin",
+		`release_flag("RELEASE_OPT")`: "false",
+	}
+	resolved, errs := ResolveFile(file, NewScope(nil), func(cond ConfigurableCondition) (string, bool) {
+		value, ok := lookup[cond.String()]
+		return value, ok
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	Walk(resolved, func(n Node) bool {
+		switch n.(type) {
+		case *Variable, *Operator, *Select:
+			t.Errorf("expected a fully literal file, found %s", n)
+		}
+		return true
+	})
+
+	printed, err := Print(resolved)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `cc_library {
+    name: "libfoo",
+    srcs: [
+        "common.c",
+        "foo.c",
+        "arm.c",
+    ],
+    version: 3,
+    debug: true,
+    target: {
+        host: {},
+    },
+}
+`
+	if string(printed) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, printed)
+	}
+
+	// An undefined condition only matches default cases.
+	_, errs = ResolveFile(parseForTest(t, `foo {
+    name: select(os(), {
+        "linux": "linux",
+    }),
+}
+`), NewScope(nil), func(ConfigurableCondition) (string, bool) { return "", false })
+	if expected := `<input>:2:11: no select case matches os() = undefined`; len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, errs)
+	}
+
+	// The tree is resolved as it was parsed, so values that depend on the parse options resolve
+	// too, and variables can come from scope.
+	scope := NewScope(nil)
+	if _, errs := ParseAndEval("parent", bytes.NewBufferString(`prefix = "lib"`), scope); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	file, errs = ParseWithOptions("", bytes.NewBufferString(`name = prefix + "bar"
+foo {
+    name: "$(name)",
+    size: 42L,
+}
+`), NewScope(scope), ParseOptions{InterpolateStrings: true, AllowNumericSuffixes: []string{"L"}})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	resolved, errs = ResolveFile(file, scope, func(ConfigurableCondition) (string, bool) { return "", false })
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	printed, err = Print(resolved)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = `foo {
+    name: "libbar",
+    size: 42L,
+}
+`
+	if string(printed) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, printed)
+	}
+
+	// The values of a file parsed with MetadataOnly are not known.
+	file, errs = ParseWithOptions("", bytes.NewBufferString(`foo {
+    srcs: ["a.c"],
+}
+`), NewScope(nil), ParseOptions{MetadataOnly: true})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	_, errs = ResolveFile(file, NewScope(nil), func(ConfigurableCondition) (string, bool) { return "", false })
+	if expected := `<input>:2:11: cannot resolve the placeholder for a list value of a file parsed with MetadataOnly`; len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, errs)
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A SelectRef identifies a Select statement inside a module property.  Property is the innermost
+// property whose value contains the Select, which may be nested inside a map property of Module.
+type SelectRef struct {
+	Module   *Module
+	Property *Property
+	Select   *Select
+}
+
+// SelectsWithoutDefault returns every Select in a module property that does not have a case
+// where all patterns are default, in source order.
+func (f *File) SelectsWithoutDefault() []*SelectRef {
+	var ret []*SelectRef
+	for _, def := range f.Defs {
+		if module, ok := def.(*Module); ok {
+			var visit func(prop *Property)
+			visit = func(prop *Property) {
+				Walk(prop.Value, func(n Node) bool {
+					switch n := n.(type) {
+					case *Property:
+						// Selects inside a nested property are reported with that property.
+						visit(n)
+						return false
+					case *Select:
+						if n.defaultCase() == nil {
+							ret = append(ret, &SelectRef{Module: module, Property: prop, Select: n})
+						}
+					}
+					return true
+				})
+			}
+			for _, prop := range module.Properties {
+				visit(prop)
+			}
+		}
+	}
+	return ret
+}
+
+// RequiredConditions returns the conditions of every Select in the value of the property,
+// including selects in operators, lists, maps and the cases of other selects, that would need to
+// be resolved to evaluate it.  Each condition is returned once, in the order it is first found.
+func (p *Property) RequiredConditions() []ConfigurableCondition {
+	var ret []ConfigurableCondition
+	Walk(p.Value, func(n Node) bool {
+		if s, ok := n.(*Select); ok {
+			for _, cond := range s.Conditions {
+				if !slices.ContainsFunc(ret, func(c ConfigurableCondition) bool {
+					return conditionsEqual(c, cond)
+				}) {
+					ret = append(ret, cond)
+				}
+			}
+		}
+		return true
+	})
+	return ret
+}
+
+// Resolve returns the value of the select for the given values of its conditions.  values is
+// keyed by the condition as printed by ConfigurableCondition.String without any negation, like
+// arch() or soong_config_variable("ns", "var"), and holds the single value of the condition,
+// which is true or false for a boolean condition.  A condition that is missing from values, or
+// whose slice is empty, is undefined and only matches default patterns.  The value of the first
+// case whose patterns all match is returned, with any selects in it or appended to the select
+// resolved the same way.  An unset case resolves to UnsetProperty.
+func (s *Select) Resolve(values map[string][]string) (Expression, error) {
+	conditionValues := make([]*string, len(s.Conditions))
+	for i, cond := range s.Conditions {
+		key := cond
+		key.Negated = false
+		v := values[key.String()]
+		switch {
+		case len(v) > 1:
+			return nil, fmt.Errorf("condition %s has %d values, expected one", key.String(), len(v))
+		case len(v) == 1 && cond.Negated:
+			b, err := strconv.ParseBool(v[0])
+			if err != nil {
+				return nil, fmt.Errorf("cannot negate condition %s with non-bool value %q", key.String(), v[0])
+			}
+			negated := strconv.FormatBool(!b)
+			conditionValues[i] = &negated
+		case len(v) == 1:
+			conditionValues[i] = &v[0]
+		}
+	}
+
+	var result Expression
+	for _, c := range s.Cases {
+		if caseMatches(c, conditionValues) {
+			result = c.Value
+			break
+		}
+	}
+	if result == nil {
+		var printed []string
+		for i, cond := range s.Conditions {
+			value := "undefined"
+			if conditionValues[i] != nil {
+				value = strconv.Quote(*conditionValues[i])
+			}
+			printed = append(printed, cond.String()+" = "+value)
+		}
+		return nil, fmt.Errorf("no select case matches %s", strings.Join(printed, ", "))
+	}
+
+	result, err := resolveSelects(result, values)
+	if err != nil {
+		return nil, err
+	}
+	if s.Append == nil {
+		return result, nil
+	}
+	appended, err := resolveSelects(s.Append, values)
+	if err != nil {
+		return nil, err
+	}
+	return operatorValue(result, appended, '+', s.Append.Pos())
+}
+
+// resolveSelects resolves value if it evaluates to a select.
+func resolveSelects(value Expression, values map[string][]string) (Expression, error) {
+	if s, ok := value.Eval().(*Select); ok {
+		return s.Resolve(values)
+	}
+	return value, nil
+}
+
+// caseMatches returns true if every pattern of c matches the value of its condition, where a nil
+// value is an undefined condition that only matches a default pattern.
+func caseMatches(c *SelectCase, values []*string) bool {
+	for i, pattern := range c.Patterns {
+		if isDefaultPattern(pattern) {
+			continue
+		}
+		if values[i] == nil {
+			return false
+		}
+		switch pattern := pattern.(type) {
+		case *String:
+			if pattern.Value != *values[i] {
+				return false
+			}
+		case *Bool:
+			if strconv.FormatBool(pattern.Value) != *values[i] {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SelectsCompatible returns true if the two selects have the same conditions in the same order, so
+// their cases could be merged.
+func SelectsCompatible(a, b *Select) bool {
+	return slices.EqualFunc(a.Conditions, b.Conditions, func(c, d ConfigurableCondition) bool {
+		return c.Equals(d)
+	})
+}
+
+// MergeSelects returns a select whose value for any values of the conditions is the value of a
+// followed by the value of b.  The selects must be compatible, have list type, and have cases with
+// the same patterns; the value of each case of the result is the concatenation of the values of the
+// matching cases of a and b.  The result uses the positions and case order of a.
+func MergeSelects(a, b *Select) (*Select, error) {
+	if !SelectsCompatible(a, b) {
+		return nil, fmt.Errorf("cannot merge selects with different conditions %s and %s",
+			conditionsString(a.Conditions), conditionsString(b.Conditions))
+	}
+	for _, s := range []*Select{a, b} {
+		if s.ExpressionType != ListType {
+			return nil, fmt.Errorf("cannot merge selects of type %s, expected list", s.ExpressionType)
+		}
+		if s.Append != nil {
+			return nil, errors.New("cannot merge selects that are appended to other expressions")
+		}
+	}
+	if len(a.Cases) != len(b.Cases) {
+		return nil, fmt.Errorf("cannot merge selects with %d and %d cases", len(a.Cases), len(b.Cases))
+	}
+
+	ret := a.Copy().(*Select)
+	for i, c := range ret.Cases {
+		j := slices.IndexFunc(b.Cases, func(d *SelectCase) bool {
+			return patternListsEqual(c.Patterns, d.Patterns)
+		})
+		if j < 0 {
+			return nil, fmt.Errorf("cannot merge selects, case %d of the first select has no matching case in the second", i)
+		}
+		value, err := operatorValue(c.Value, b.Cases[j].Value.Copy(), '+', c.ColonPos)
+		if err != nil {
+			return nil, err
+		}
+		c.Value = value
+	}
+	return ret, nil
+}
+
+// conditionsString returns the conditions of a select as they are printed in it.
+func conditionsString(conditions []ConfigurableCondition) string {
+	printed := make([]string, len(conditions))
+	for i, cond := range conditions {
+		printed[i] = cond.String()
+	}
+	return "(" + strings.Join(printed, ", ") + ")"
+}
+
+// RedundantBranches returns the cases of the select, other than the default case, whose value is
+// the same as the value of the default case, so removing them would not change the result of the
+// select.  A case is not included if a later case could match the same values, since removing it
+// would let the later case match instead.
+func (s *Select) RedundantBranches() []*SelectCase {
+	def := s.defaultCase()
+	if def == nil {
+		return nil
+	}
+	var ret []*SelectCase
+	for i, c := range s.Cases {
+		if c == def {
+			continue
+		}
+		if same, _ := ExpressionsAreSame(c.Value, def.Value); !same {
+			continue
+		}
+		overlapped := false
+		for _, later := range s.Cases[i+1:] {
+			if later != def && casesOverlap(c, later) {
+				overlapped = true
+				break
+			}
+		}
+		if !overlapped {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// casesOverlap returns true if some set of condition values could match both cases.
+func casesOverlap(a, b *SelectCase) bool {
+	for i := range a.Patterns {
+		if isDefaultPattern(a.Patterns[i]) || isDefaultPattern(b.Patterns[i]) {
+			continue
+		}
+		if !patternsEqual(a.Patterns[i], b.Patterns[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDefaultPattern(pattern Expression) bool {
+	s, ok := pattern.(*String)
+	return ok && s.Value == default_select_branch_name
+}
+
+func patternsEqual(a, b Expression) bool {
+	switch a2 := a.(type) {
+	case *String:
+		if b2, ok := b.(*String); ok {
+			return a2.Value == b2.Value
+		} else {
+			return false
+		}
+	case *Bool:
+		if b2, ok := b.(*Bool); ok {
+			return a2.Value == b2.Value
+		} else {
+			return false
+		}
+	default:
+		// true so that we produce an error in this unexpected scenario
+		return true
+	}
+}
+
+func patternListsEqual(a, b []Expression) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !patternsEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSelectCases verifies that the cases of a select have no duplicate patterns, that only the
+// last case is all default, and that every case that isn't unset has the same type.  It returns
+// that type, or UnsetType if every case is unset.
+func checkSelectCases(cases []*SelectCase) (Type, error) {
+	for i, c := range cases {
+		// Check for duplicates
+		for _, d := range cases[i+1:] {
+			if patternListsEqual(c.Patterns, d.Patterns) {
+				return UnsetType, fmt.Errorf("Found duplicate select patterns: %v", c.Patterns)
+			}
+		}
+		// Check that the only all-default cases is the last one
+		if i < len(cases)-1 && c.isDefault() {
+			return UnsetType, fmt.Errorf("Found a default select branch at index %d, expected it to be last (index %d)", i, len(cases)-1)
+		}
+	}
+
+	ty := UnsetType
+	for _, c := range cases {
+		otherTy := c.Value.Type()
+		// Any other type can override UnsetType
+		if ty == UnsetType {
+			ty = otherTy
+		}
+		if otherTy != UnsetType && otherTy != ty {
+			return UnsetType, fmt.Errorf("Found select statement with differing types %q and %q in its cases", ty.String(), otherTy.String())
+		}
+	}
+	return ty, nil
+}
+
+var (
+	selectFunctionsLock sync.Mutex
+	selectFunctions     map[string]int
+)
+
+// RegisterSelectFunction adds a function that can be used as a select condition, with the number
+// of arguments it takes.  Once any function has been registered the parser rejects conditions that
+// call an unregistered function or pass the wrong number of arguments; until then any function is
+// accepted.
+func RegisterSelectFunction(name string, arity int) {
+	selectFunctionsLock.Lock()
+	defer selectFunctionsLock.Unlock()
+	if selectFunctions == nil {
+		selectFunctions = make(map[string]int)
+	}
+	selectFunctions[name] = arity
+}
+
+// checkSelectFunction returns an error if the condition calls a function that has not been
+// registered with RegisterSelectFunction, or passes it the wrong number of arguments.
+func checkSelectFunction(cond ConfigurableCondition) error {
+	selectFunctionsLock.Lock()
+	defer selectFunctionsLock.Unlock()
+	if selectFunctions == nil {
+		return nil
+	}
+	arity, ok := selectFunctions[cond.FunctionName]
+	if !ok {
+		return fmt.Errorf("unknown select function %q", cond.FunctionName)
+	}
+	if len(cond.Args) != arity {
+		return fmt.Errorf("select function %s takes %d arguments, found %d", cond.FunctionName, arity, len(cond.Args))
+	}
+	return nil
+}
+
+// A SelectBuilder constructs a Select statement from conditions and cases, validating them the
+// same way the parser does.  The zero value is ready to use.
+type SelectBuilder struct {
+	conditions   []ConfigurableCondition
+	cases        []*SelectCase
+	defaultValue Expression
+	errs         []error
+}
+
+// AddCondition adds a condition to the select.  Every case must have one pattern per condition.
+func (b *SelectBuilder) AddCondition(cond ConfigurableCondition) {
+	b.conditions = append(b.conditions, cond)
+}
+
+// AddCase adds a case with the given patterns, one per condition.  A pattern of "default" matches
+// any value of its condition.  The case where every pattern is default must be set with
+// SetDefault instead.
+func (b *SelectBuilder) AddCase(patterns []string, value Expression) {
+	c := &SelectCase{Value: value}
+	allDefault := true
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "__soong") {
+			b.errs = append(b.errs, errors.New("select branch conditions starting with __soong are reserved for internal use"))
+		}
+		if pattern == "default" {
+			pattern = default_select_branch_name
+		} else {
+			allDefault = false
+		}
+		c.Patterns = append(c.Patterns, &String{Value: pattern})
+	}
+	if allDefault {
+		b.errs = append(b.errs, errors.New("use SetDefault to add a case where every pattern is default"))
+	}
+	b.cases = append(b.cases, c)
+}
+
+// SetDefault sets the value of the case that matches when no other case does.  It is always the
+// last case of the built select.
+func (b *SelectBuilder) SetDefault(value Expression) {
+	b.defaultValue = value
+}
+
+// Build returns the Select, or an error if the conditions and cases do not form a valid select
+// statement.
+func (b *SelectBuilder) Build() (*Select, error) {
+	if len(b.errs) > 0 {
+		return nil, b.errs[0]
+	}
+	if len(b.conditions) == 0 {
+		return nil, errors.New("select statement has no conditions")
+	}
+	for i, c := range b.conditions {
+		for _, d := range b.conditions[i+1:] {
+			if c.Equals(d) {
+				return nil, fmt.Errorf("Duplicate select condition found: %s", c.String())
+			}
+		}
+	}
+
+	cases := append([]*SelectCase(nil), b.cases...)
+	if b.defaultValue != nil {
+		c := &SelectCase{Value: b.defaultValue}
+		for range b.conditions {
+			c.Patterns = append(c.Patterns, &String{Value: default_select_branch_name})
+		}
+		cases = append(cases, c)
+	}
+	if len(cases) == 0 {
+		return nil, errors.New("select statement has no cases")
+	}
+	for i, c := range cases {
+		if len(c.Patterns) != len(b.conditions) {
+			return nil, fmt.Errorf("select case %d has %d patterns, expected one for each of the %d conditions",
+				i, len(c.Patterns), len(b.conditions))
+		}
+	}
+
+	ty, err := checkSelectCases(cases)
+	if err != nil {
+		return nil, err
+	}
+	if ty == UnsetType {
+		return nil, errors.New("This select statement is empty, remove it")
+	}
+
+	return &Select{
+		Conditions:     append([]ConfigurableCondition(nil), b.conditions...),
+		Cases:          cases,
+		ExpressionType: ty,
+	}, nil
+}
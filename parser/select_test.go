@@ -0,0 +1,513 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectsWithoutDefault(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    name: "foo",
+    with_default: select(arch(), {
+        "arm": "a",
+        default: "b",
+    }),
+    arch: {
+        arm: {
+            without_default: ["x"] + select(os(), {
+                "linux": ["y"],
+            }),
+        },
+    },
+    conditional: enabled ? select(os(), {
+        "android": ["z"],
+    }) : [],
+}
+`)
+
+	refs := file.SelectsWithoutDefault()
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 selects without a default, got %d", len(refs))
+	}
+	if g, w := refs[0].Property.Name, "without_default"; g != w {
+		t.Errorf("expected property %q, got %q", w, g)
+	}
+	if g, w := refs[0].Module.Name(), "foo"; g != w {
+		t.Errorf("expected module %q, got %q", w, g)
+	}
+	if g, w := refs[0].Select.Conditions[0].FunctionName, "os"; g != w {
+		t.Errorf("expected select on %q, got %q", w, g)
+	}
+	if g, w := refs[1].Property.Name, "conditional"; g != w {
+		t.Errorf("expected property %q, got %q", w, g)
+	}
+}
+
+func TestSelectBuilder(t *testing.T) {
+	arch := ConfigurableCondition{FunctionName: "arch"}
+	os := ConfigurableCondition{FunctionName: "os"}
+	list := func(s string) Expression {
+		return &List{Values: []Expression{&String{Value: s}}}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		var b SelectBuilder
+		b.AddCondition(arch)
+		b.AddCondition(os)
+		b.AddCase([]string{"arm", "linux"}, list("a"))
+		b.AddCase([]string{"x86", "default"}, UnsetProperty{})
+		b.SetDefault(list("b"))
+
+		s, err := b.Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g, w := s.Type(), ListType; g != w {
+			t.Errorf("expected type %s, got %s", w, g)
+		}
+		if g, w := len(s.Cases), 3; g != w {
+			t.Fatalf("expected %d cases, got %d", w, g)
+		}
+		if !s.Cases[2].isDefault() {
+			t.Errorf("expected the last case to be the default")
+		}
+
+		got, err := PrintExpression(s)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expected := `select((arch(), os()), {
+    ("arm", "linux"): ["a"],
+    ("x86", default): unset,
+    (default, default): ["b"],
+})
+`
+		if string(got) != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+		}
+	})
+
+	errorCases := []struct {
+		name  string
+		build func(b *SelectBuilder)
+		err   string
+	}{
+		{
+			name: "wrong arity",
+			build: func(b *SelectBuilder) {
+				b.AddCondition(arch)
+				b.AddCondition(os)
+				b.AddCase([]string{"arm"}, list("a"))
+			},
+			err: "select case 0 has 1 patterns, expected one for each of the 2 conditions",
+		},
+		{
+			name: "duplicate patterns",
+			build: func(b *SelectBuilder) {
+				b.AddCondition(arch)
+				b.AddCase([]string{"arm"}, list("a"))
+				b.AddCase([]string{"arm"}, list("b"))
+			},
+			err: "Found duplicate select patterns",
+		},
+		{
+			name: "mismatched types",
+			build: func(b *SelectBuilder) {
+				b.AddCondition(arch)
+				b.AddCase([]string{"arm"}, list("a"))
+				b.SetDefault(&String{Value: "b"})
+			},
+			err: `Found select statement with differing types "list" and "string" in its cases`,
+		},
+		{
+			name: "default case",
+			build: func(b *SelectBuilder) {
+				b.AddCondition(arch)
+				b.AddCase([]string{"default"}, list("a"))
+			},
+			err: "use SetDefault",
+		},
+		{
+			name: "no conditions",
+			build: func(b *SelectBuilder) {
+				b.SetDefault(list("a"))
+			},
+			err: "select statement has no conditions",
+		},
+	}
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b SelectBuilder
+			tt.build(&b)
+			_, err := b.Build()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRedundantBranches(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    single: select(arch(), {
+        "arm": ["a"],
+        "x86": ["b"],
+        default: ["a"],
+    }),
+    multiple: select((arch(), os()), {
+        ("arm", default): "a",
+        (default, "linux"): "b",
+        ("x86", "linux"): "a",
+        (default, default): "a",
+    }),
+    no_default: select(arch(), {
+        "arm": "a",
+    }),
+}
+`)
+	module := file.Defs[0].(*Module)
+	patterns := func(prop string) []string {
+		p, _ := module.GetProperty(prop)
+		var ret []string
+		for _, c := range p.Value.(*Select).RedundantBranches() {
+			var s []string
+			for _, pattern := range c.Patterns {
+				s = append(s, pattern.(*String).Value)
+			}
+			ret = append(ret, strings.Join(s, ","))
+		}
+		return ret
+	}
+
+	if got, w := patterns("single"), []string{"arm"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected redundant branches %q, got %q", w, got)
+	}
+	// ("arm", default) is not redundant because ("arm", "linux") would then match
+	// (default, "linux").
+	if got, w := patterns("multiple"), []string{"x86,linux"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected redundant branches %q, got %q", w, got)
+	}
+	if got := patterns("no_default"); len(got) != 0 {
+		t.Errorf("expected no redundant branches without a default, got %q", got)
+	}
+}
+
+func TestRequiredConditions(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    srcs: base + select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }) + select((arch(), soong_config_variable("my_ns", "feature")), {
+        ("x86", "true"): select(os(), {
+            "linux": ["linux.c"],
+            default: [],
+        }),
+        (default, default): [],
+    }),
+    target: {
+        android: {
+            cflags: select(release_flag("RELEASE_FOO"), {
+                true: ["-DFOO"],
+                default: [],
+            }),
+        },
+    },
+    name: "foo",
+}
+`)
+	module := file.Defs[0].(*Module)
+	conditions := func(prop string) []string {
+		p, _ := module.GetProperty(prop)
+		var ret []string
+		for _, c := range p.RequiredConditions() {
+			ret = append(ret, c.String())
+		}
+		return ret
+	}
+
+	want := []string{`arch()`, `soong_config_variable("my_ns", "feature")`, `os()`}
+	if got := conditions("srcs"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected conditions %q, got %q", want, got)
+	}
+	if got, w := conditions("target"), []string{`release_flag("RELEASE_FOO")`}; !reflect.DeepEqual(got, w) {
+		t.Errorf("expected conditions %q, got %q", w, got)
+	}
+	if got := conditions("name"); len(got) != 0 {
+		t.Errorf("expected no conditions, got %q", got)
+	}
+}
+
+func TestNegatedConditions(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    a: select(!soong_config_variable("ns", "flag"), {
+        true: "a",
+        default: "b",
+    }),
+    b: select(not release_flag("RELEASE_FOO"), {
+        true: "a",
+        default: "b",
+    }),
+    c: select((arch(), !arch()), {
+        ("arm", true): "a",
+        (default, default): "b",
+    }),
+}
+`)
+	module := file.Defs[0].(*Module)
+	var got []string
+	for _, prop := range module.Properties {
+		for _, c := range prop.Value.(*Select).Conditions {
+			got = append(got, c.String())
+		}
+	}
+	want := []string{`!soong_config_variable("ns", "flag")`, `!release_flag("RELEASE_FOO")`, `arch()`, `!arch()`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected conditions %q, got %q", want, got)
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(printed), `b: select(!release_flag("RELEASE_FOO"), {`) {
+		t.Errorf("expected not to be printed as !, got:\n%s", printed)
+	}
+	if err := CheckRoundTrip("Android.bp", printed); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// not is still a condition when it is called.
+	file = parseForTest(t, `
+foo {
+    a: select(not(), {
+        "x": "a",
+        default: "b",
+    }),
+}
+`)
+	if c := file.Defs[0].(*Module).Properties[0].Value.(*Select).Conditions[0]; c.Negated || c.FunctionName != "not" {
+		t.Errorf("expected a condition named not, got %s", c.String())
+	}
+
+	_, errs := Parse("", strings.NewReader(`
+foo {
+    a: select((!arch(), not arch()), {
+        (true, true): "a",
+        (default, default): "b",
+    }),
+}
+`), NewScope(nil))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Duplicate select condition found: !arch()") {
+		t.Errorf("expected a duplicate condition error, got %v", errs)
+	}
+}
+
+func TestSelectResolve(t *testing.T) {
+	scope := NewScope(nil)
+	file, errs := ParseAndEval("", strings.NewReader(`
+foo {
+    single: select(arch(), {
+        "arm": ["arm.c"],
+        "x86": unset,
+        default: ["generic.c"],
+    }),
+    multiple: select((arch(), soong_config_variable("ns", "flag")), {
+        ("arm", true): "arm_flag",
+        (default, true): "flag",
+        (default, default): "none",
+    }),
+    appended: ["a.c"] + select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }) + select(!release_flag("RELEASE_FOO"), {
+        true: ["no_foo.c"],
+        default: [],
+    }),
+    no_default: select(os(), {
+        "linux": "linux",
+    }),
+}
+`), scope)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	module := file.Defs[0].(*Module)
+	resolve := func(prop string, values map[string][]string) (string, error) {
+		p, _ := module.GetProperty(prop)
+		value, err := p.Value.Eval().(*Select).Resolve(values)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := value.(UnsetProperty); ok {
+			return "unset", nil
+		}
+		return valueString(stripPositions(value)), nil
+	}
+
+	flag := `soong_config_variable("ns", "flag")`
+	testCases := []struct {
+		prop     string
+		values   map[string][]string
+		expected string
+		err      string
+	}{
+		{prop: "single", values: map[string][]string{"arch()": {"arm"}}, expected: `["arm.c"]`},
+		{prop: "single", values: map[string][]string{"arch()": {"x86"}}, expected: "unset"},
+		{prop: "single", values: map[string][]string{"arch()": {"riscv64"}}, expected: `["generic.c"]`},
+		{prop: "single", values: nil, expected: `["generic.c"]`},
+		{prop: "multiple", values: map[string][]string{"arch()": {"arm"}, flag: {"true"}}, expected: `"arm_flag"`},
+		{prop: "multiple", values: map[string][]string{"arch()": {"x86"}, flag: {"true"}}, expected: `"flag"`},
+		{prop: "multiple", values: map[string][]string{"arch()": {"arm"}}, expected: `"none"`},
+		{
+			prop:     "appended",
+			values:   map[string][]string{"arch()": {"arm"}, `release_flag("RELEASE_FOO")`: {"false"}},
+			expected: "[\n    \"a.c\",\n    \"arm.c\",\n    \"no_foo.c\",\n]",
+		},
+		{
+			prop:     "appended",
+			values:   map[string][]string{"arch()": {"x86"}, `release_flag("RELEASE_FOO")`: {"true"}},
+			expected: `["a.c"]`,
+		},
+		{prop: "no_default", values: map[string][]string{"os()": {"darwin"}}, err: `no select case matches os() = "darwin"`},
+		{prop: "single", values: map[string][]string{"arch()": {"arm", "x86"}}, err: "condition arch() has 2 values, expected one"},
+	}
+	for _, tt := range testCases {
+		got, err := resolve(tt.prop, tt.values)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s %v: expected error %q, got %v", tt.prop, tt.values, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: unexpected error: %s", tt.prop, tt.values, err)
+		} else if got != tt.expected {
+			t.Errorf("%s %v: expected %s, got %s", tt.prop, tt.values, tt.expected, got)
+		}
+	}
+}
+
+func TestMergeSelects(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    a: select(arch(), {
+        "arm": ["a_arm.c"],
+        "x86": unset,
+        default: ["a.c"],
+    }),
+    b: select(arch(), {
+        "x86": ["b_x86.c"],
+        "arm": ["b_arm.c"],
+        default: ["b.c"],
+    }),
+    other: select(os(), {
+        "linux": ["linux.c"],
+        default: [],
+    }),
+}
+`)
+	module := file.Defs[0].(*Module)
+	getSelect := func(name string) *Select {
+		p, _ := module.GetProperty(name)
+		return p.Value.(*Select)
+	}
+	a, b, other := getSelect("a"), getSelect("b"), getSelect("other")
+
+	if !SelectsCompatible(a, b) {
+		t.Errorf("expected selects on the same condition to be compatible")
+	}
+	if SelectsCompatible(a, other) {
+		t.Errorf("expected selects on different conditions to be incompatible")
+	}
+
+	merged, err := MergeSelects(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `select(arch(), {
+    "arm": [
+        "a_arm.c",
+        "b_arm.c",
+    ],
+    "x86": ["b_x86.c"],
+    default: [
+        "a.c",
+        "b.c",
+    ],
+})`
+	if got := valueString(stripPositions(merged)); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+	if got := valueString(stripPositions(a)); !strings.Contains(got, `"x86": unset`) {
+		t.Errorf("expected the merged select not to be modified, got:\n%s", got)
+	}
+
+	_, err = MergeSelects(a, other)
+	if expected := "cannot merge selects with different conditions (arch()) and (os())"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestRegisterSelectFunction(t *testing.T) {
+	defer func(saved map[string]int) { selectFunctions = saved }(selectFunctions)
+	selectFunctions = nil
+
+	testCases := []struct {
+		input string
+		err   string
+	}{
+		{input: `select(arch(), {default: [],})`},
+		{
+			input: `select(soong_config_variable("ns"), {default: [],})`,
+			err:   `<input>:2:18: select function soong_config_variable takes 2 arguments, found 1`,
+		},
+		{
+			input: `select((arch(), !releas_flag("RELEASE_FOO")), {(default, default): [],})`,
+			err:   `<input>:2:28: unknown select function "releas_flag"`,
+		},
+	}
+	parse := func(input string) []error {
+		_, errs := Parse("", strings.NewReader("foo {\n    srcs: "+input+",\n}\n"), NewScope(nil))
+		return errs
+	}
+
+	// With no functions registered any function is accepted.
+	for _, tt := range testCases {
+		if errs := parse(tt.input); len(errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.input, errs)
+		}
+	}
+
+	RegisterSelectFunction("arch", 0)
+	RegisterSelectFunction("soong_config_variable", 2)
+	RegisterSelectFunction("release_flag", 1)
+	for _, tt := range testCases {
+		errs := parse(tt.input)
+		if tt.err == "" {
+			if len(errs) != 0 {
+				t.Errorf("%s: unexpected errors: %v", tt.input, errs)
+			}
+		} else if len(errs) != 1 || errs[0].Error() != tt.err {
+			t.Errorf("%s: expected error %q, got %v", tt.input, tt.err, errs)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/scanner"
 )
 
@@ -127,40 +128,90 @@ func SortLists(file *File) {
 	sort.Sort(commentsByOffset(file.Comments))
 }
 
+// SortList sorts the string literals of a list, comparing runs of digits by their numeric value.
+// Values on contiguous lines are sorted together, and the comments of file are kept with the
+// values they follow.  Lists that contain anything other than string literals are left alone.
 func SortList(file *File, list *List) {
-	if !isListOfPrimitives(list.Values) {
+	if !isListOfStrings(list) {
 		return
 	}
 	for i := 0; i < len(list.Values); i++ {
 		// Find a set of values on contiguous lines
-		line := list.Values[i].Pos().Line
+		line := list.Values[i].End().Line
 		var j int
 		for j = i + 1; j < len(list.Values); j++ {
 			if list.Values[j].Pos().Line > line+1 {
 				break
 			}
-			line = list.Values[j].Pos().Line
+			line = list.Values[j].End().Line
 		}
 
+		// The comments attached to the next value, or before the closing bracket, stay where
+		// they are, so the last value of the set ends before them.
 		nextPos := list.End()
+		nextComments := list.TrailingComments
 		if j < len(list.Values) {
 			nextPos = list.Values[j].Pos()
+			nextComments = list.valueComments(j)
+		}
+		if len(nextComments) > 0 {
+			nextPos = nextComments[0].Pos()
 		}
 		sortSubList(list.Values[i:j], nextPos, file)
 		i = j - 1
 	}
 }
 
+var (
+	orderedListPropertiesLock sync.Mutex
+	orderedListProperties     = make(map[string]bool)
+)
+
+// RegisterOrderedListProperty records that the order of the values of lists in properties with
+// the given name is significant, like the arguments of a command, so they must not be sorted.
+func RegisterOrderedListProperty(name string) {
+	orderedListPropertiesLock.Lock()
+	defer orderedListPropertiesLock.Unlock()
+	orderedListProperties[name] = true
+}
+
+// UnorderedLists returns the properties of modules, including properties of nested maps, whose
+// values are lists of string literals that SortList can sort, leaving out properties registered
+// with RegisterOrderedListProperty.  The properties are returned in source order.
+func (f *File) UnorderedLists() []Node {
+	orderedListPropertiesLock.Lock()
+	defer orderedListPropertiesLock.Unlock()
+	var ret []Node
+	Walk(f, func(n Node) bool {
+		switch n := n.(type) {
+		case *Assignment:
+			return false
+		case *Property:
+			if list, ok := n.Value.(*List); ok && isListOfStrings(list) && !orderedListProperties[n.Name] {
+				ret = append(ret, n)
+			}
+		}
+		return true
+	})
+	return ret
+}
+
+// ListIsSorted returns true if each set of values on contiguous lines of list is in the order
+// SortList would put it in.  It returns false for a list that contains anything other than string
+// literals, which SortList can't sort.
 func ListIsSorted(list *List) bool {
+	if !isListOfStrings(list) {
+		return false
+	}
 	for i := 0; i < len(list.Values); i++ {
 		// Find a set of values on contiguous lines
-		line := list.Values[i].Pos().Line
+		line := list.Values[i].End().Line
 		var j int
 		for j = i + 1; j < len(list.Values); j++ {
 			if list.Values[j].Pos().Line > line+1 {
 				break
 			}
-			line = list.Values[j].Pos().Line
+			line = list.Values[j].End().Line
 		}
 
 		if !subListIsSorted(list.Values[i:j]) {
@@ -224,17 +275,21 @@ func sortSubList(values []Expression, nextPos scanner.Position, file *File) {
 	curPos := values[0].Pos()
 	for i, e := range l {
 		values[i] = copyValues[e.i]
-		values[i].(*String).LiteralPos = curPos
+		s := values[i].(*String)
+		// A raw string can span lines, the next value starts after its last line and after the
+		// comments that follow it.
+		lastLine := s.End().Line - e.pos.Line
+		s.LiteralPos = curPos
 		for j, c := range copyComments {
 			if c.Pos().Offset > e.pos.Offset && c.Pos().Offset < e.nextPos.Offset {
 				file.Comments[j].Comments[0].Slash.Line = curPos.Line + c.Pos().Line - e.pos.Line
-				curPos.Line += c.Pos().Line - e.pos.Line
+				lastLine = max(lastLine, c.Pos().Line-e.pos.Line)
 				file.Comments[j].Comments[0].Slash.Offset += values[i].Pos().Offset - e.pos.Offset
 			}
 		}
 
 		curPos.Offset += e.nextPos.Offset - e.pos.Offset
-		curPos.Line++
+		curPos.Line += lastLine + 1
 	}
 }
 
@@ -14,7 +14,10 @@
 
 package parser
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func Test_numericStringLess(t *testing.T) {
 	type args struct {
@@ -94,3 +97,81 @@ func Test_numericStringLess(t *testing.T) {
 		})
 	}
 }
+
+func TestSortList(t *testing.T) {
+	file := parseForTest(t, `
+foo {
+    srcs: ["b.c", "a10.c", "a9.c"],
+    ints: [3, 1, 2],
+}
+`)
+	module := file.Defs[0].(*Module)
+	srcs := module.Properties[0].Value.(*List)
+	ints := module.Properties[1].Value.(*List)
+
+	if ListIsSorted(srcs) {
+		t.Errorf("expected %s not to be sorted", srcs)
+	}
+	SortList(file, srcs)
+	if !ListIsSorted(srcs) {
+		t.Errorf("expected %s to be sorted", srcs)
+	}
+	// Lists that aren't all strings are left alone, and are never sorted.
+	SortList(file, ints)
+	if ListIsSorted(ints) {
+		t.Errorf("expected %s not to be sorted", ints)
+	}
+
+	printed, err := Print(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `foo {
+    srcs: [
+        "a9.c",
+        "a10.c",
+        "b.c",
+    ],
+    ints: [
+        3,
+        1,
+        2,
+    ],
+}
+`
+	if string(printed) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, printed)
+	}
+}
+
+func TestUnorderedLists(t *testing.T) {
+	defer func(saved map[string]bool) { orderedListProperties = saved }(orderedListProperties)
+	orderedListProperties = make(map[string]bool)
+
+	file := parseForTest(t, `
+common = ["b", "a"]
+
+genrule {
+    name: "gen",
+    srcs: ["b.c", "a.c"],
+    cmd: ["$(location tool)", "--out", "$(out)"],
+    tools: [tool_name],
+    arch: {
+        arm: {
+            cmd: ["--arm"],
+            srcs: ["arm.c"],
+        },
+    },
+}
+`)
+	RegisterOrderedListProperty("cmd")
+
+	var got []string
+	for _, n := range file.UnorderedLists() {
+		got = append(got, n.(*Property).Name+"@"+n.Pos().String())
+	}
+	want := []string{"srcs@<input>:6:5", "srcs@<input>:12:13"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"slices"
+	"text/scanner"
+)
+
+// Walk traverses the tree rooted at node in depth-first source order, calling visitor for each
+// node.  If visitor returns false, the children of that node are not visited.
+//
+// Walk follows the tree as it was written in the source: it descends into the original value of
+// an Assignment, the arguments of an Operator and the base and index of a MemberAccess or
+// IndexAccess, but not into the value they refer to, the value a Variable refers to or the
+// evaluated value of an Operator.  It descends into the arguments of the conditions of a Select,
+// the patterns and value of each SelectCase and the expression appended to the Select.  Patterns
+// are visited as a *String or *Bool, except for default patterns, which are not visited.
+func Walk(node Node, visitor func(Node) bool) {
+	if node == nil || !visitor(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *File:
+		for _, def := range n.Defs {
+			Walk(def, visitor)
+		}
+	case *Assignment:
+		Walk(n.OrigValue, visitor)
+	case *Module:
+		for _, prop := range n.Properties {
+			Walk(prop, visitor)
+		}
+	case *Property:
+		Walk(n.Value, visitor)
+	case *Operator:
+		Walk(n.Args[0], visitor)
+		Walk(n.Args[1], visitor)
+	case *Comparison:
+		Walk(n.Args[0], visitor)
+		Walk(n.Args[1], visitor)
+	case *BoolOp:
+		if n.Args[0] != nil {
+			Walk(n.Args[0], visitor)
+		}
+		Walk(n.Args[1], visitor)
+	case *Conditional:
+		Walk(n.Cond, visitor)
+		Walk(n.True, visitor)
+		Walk(n.False, visitor)
+	case *InterpolatedString:
+		for _, part := range n.Parts {
+			Walk(part, visitor)
+		}
+	case *MemberAccess:
+		Walk(n.Base, visitor)
+	case *IndexAccess:
+		Walk(n.Base, visitor)
+		Walk(n.Index, visitor)
+	case *List:
+		for _, value := range n.Values {
+			Walk(value, visitor)
+		}
+	case *Map:
+		for _, prop := range n.Properties {
+			Walk(prop, visitor)
+		}
+	case *Select:
+		for i := range n.Conditions {
+			for j := range n.Conditions[i].Args {
+				Walk(&n.Conditions[i].Args[j], visitor)
+			}
+		}
+		for _, c := range n.Cases {
+			Walk(c, visitor)
+		}
+		if n.Append != nil {
+			Walk(n.Append, visitor)
+		}
+	case *SelectCase:
+		for _, pattern := range n.Patterns {
+			if !isDefaultPattern(pattern) {
+				Walk(pattern, visitor)
+			}
+		}
+		Walk(n.Value, visitor)
+	}
+}
+
+// Prune removes every property of a module or map, and every element of a list, for which keep
+// returns false, anywhere in the File.  The values of removed nodes are not visited, and the
+// values of kept nodes are pruned the same way.  Evaluated values, like the value of an Operator
+// or of an Assignment that differs from its original value, are not updated.
+func (f *File) Prune(keep func(n Node) bool) {
+	keepProperties := func(props []*Property) []*Property {
+		return slices.DeleteFunc(props, func(p *Property) bool { return !keep(p) })
+	}
+	Walk(f, func(n Node) bool {
+		switch n := n.(type) {
+		case *Module:
+			n.Properties = keepProperties(n.Properties)
+		case *Map:
+			n.Properties = keepProperties(n.Properties)
+		case *List:
+			n.deleteValuesFunc(func(e Expression) bool { return !keep(e) })
+		}
+		return true
+	})
+}
+
+// EnclosingMap returns the innermost map in the File, including the map of a module, whose braces
+// contain the position of target.  A map does not enclose itself.
+func (f *File) EnclosingMap(target Node) (*Map, bool) {
+	start, end := target.Pos().Offset, target.End().Offset
+	var enclosing *Map
+	Walk(f, func(n Node) bool {
+		var m *Map
+		switch n := n.(type) {
+		case *Module:
+			m = &n.Map
+		case *Map:
+			m = n
+		default:
+			return true
+		}
+		if m == target || n == target {
+			return false
+		}
+		if m.Pos().Offset <= start && end <= m.End().Offset {
+			// Walk visits enclosing maps before the maps inside them.
+			enclosing = m
+			return true
+		}
+		return false
+	})
+	return enclosing, enclosing != nil
+}
+
+// NodeAt returns the innermost node in the File whose range, from Pos up to but not including End,
+// contains the offset of pos, or nil if pos is not inside any definition.  Between the tokens of a
+// node it returns the node itself, like the Property for a position between a property name and
+// its value.
+func (f *File) NodeAt(pos scanner.Position) Node {
+	contains := func(n Node) bool {
+		return n.Pos().Offset <= pos.Offset && pos.Offset < n.End().Offset
+	}
+	var found Node
+	Walk(f, func(n Node) bool {
+		if _, ok := n.(*File); ok {
+			return true
+		}
+		if !contains(n) {
+			return false
+		}
+		// Walk visits nodes before the nodes inside them.
+		found = n
+		return true
+	})
+	return found
+}
+
+// remapPositions replaces every valid position in the tree rooted at node with the result of
+// calling remap on it.
+func remapPositions(node Node, remap func(scanner.Position) scanner.Position) {
+	update := func(pos *scanner.Position) {
+		if pos.IsValid() {
+			*pos = remap(*pos)
+		}
+	}
+	Walk(node, func(n Node) bool {
+		switch n := n.(type) {
+		case *Assignment:
+			update(&n.NamePos)
+			update(&n.EqualsPos)
+		case *Module:
+			update(&n.TypePos)
+			update(&n.LBracePos)
+			update(&n.RBracePos)
+		case *Property:
+			update(&n.NamePos)
+			update(&n.ColonPos)
+		case *Operator:
+			update(&n.OperatorPos)
+		case *Comparison:
+			update(&n.OperatorPos)
+		case *BoolOp:
+			update(&n.OperatorPos)
+		case *Conditional:
+			update(&n.QuestionPos)
+			update(&n.ColonPos)
+		case *Variable:
+			update(&n.NamePos)
+		case *InterpolatedString:
+			update(&n.LiteralPos)
+		case *MemberAccess:
+			update(&n.DotPos)
+			update(&n.NamePos)
+		case *IndexAccess:
+			update(&n.LBracketPos)
+			update(&n.RBracketPos)
+		case *Map:
+			update(&n.LBracePos)
+			update(&n.RBracePos)
+		case *List:
+			update(&n.LBracePos)
+			update(&n.RBracePos)
+		case *Placeholder:
+			update(&n.StartPos)
+			update(&n.EndPos)
+		case *String:
+			update(&n.LiteralPos)
+		case *Int64:
+			update(&n.LiteralPos)
+		case *Float64:
+			update(&n.LiteralPos)
+		case *Bool:
+			update(&n.LiteralPos)
+		case *Select:
+			update(&n.KeywordPos)
+			update(&n.LBracePos)
+			update(&n.RBracePos)
+			for i := range n.Conditions {
+				update(&n.Conditions[i].position)
+			}
+		case *SelectCase:
+			update(&n.ColonPos)
+			// Walk doesn't visit default patterns, but the printer still needs their positions.
+			for _, pattern := range n.Patterns {
+				if isDefaultPattern(pattern) {
+					update(&pattern.(*String).LiteralPos)
+				}
+			}
+			if unset, ok := n.Value.(UnsetProperty); ok {
+				update(&unset.Position)
+				n.Value = unset
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,266 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"text/scanner"
+)
+
+func TestWalk(t *testing.T) {
+	file := parseForTest(t, `
+cflags = ["-Wall"] + extra
+foo {
+    name: "foo",
+    srcs: select(arch(), {
+        "arm": ["arm.c"],
+        default: [],
+    }),
+    arch: {
+        x86: {
+            srcs: ["x86.c"],
+        },
+    },
+}
+`)
+
+	var strs []string
+	var selects, variables int
+	Walk(file, func(n Node) bool {
+		switch n := n.(type) {
+		case *String:
+			strs = append(strs, n.Value)
+		case *Select:
+			selects++
+		case *Variable:
+			variables++
+		}
+		return true
+	})
+
+	if w := []string{"-Wall", "foo", "arm", "arm.c", "x86.c"}; !reflect.DeepEqual(strs, w) {
+		t.Errorf("expected strings %q, got %q", w, strs)
+	}
+	if selects != 1 {
+		t.Errorf("expected 1 select, got %d", selects)
+	}
+	if variables != 1 {
+		t.Errorf("expected 1 variable, got %d", variables)
+	}
+
+	// Stop descending into the arch property.
+	strs = nil
+	Walk(file, func(n Node) bool {
+		if prop, ok := n.(*Property); ok && prop.Name == "arch" {
+			return false
+		}
+		if s, ok := n.(*String); ok {
+			strs = append(strs, s.Value)
+		}
+		return true
+	})
+	if w := []string{"-Wall", "foo", "arm", "arm.c"}; !reflect.DeepEqual(strs, w) {
+		t.Errorf("expected strings %q, got %q", w, strs)
+	}
+}
+
+func TestWalkSelect(t *testing.T) {
+	// Values are only appended to a select when it is evaluated.
+	file, errs := ParseAndEval("", bytes.NewBufferString(`
+foo {
+    srcs: select((soong_config_variable("ns", "var"), os()), {
+        (true, "linux"): ["linux.c"],
+        (default, default): [],
+    }) + ["x"],
+}
+`), NewScope(nil))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	srcs, _ := file.Defs[0].(*Module).GetProperty("srcs")
+	sel, ok := srcs.Value.(*Operator).Value.(*Select)
+	if !ok || sel.Append == nil {
+		t.Fatalf("expected the evaluated value to be a select with an appended value, got %s", srcs.Value)
+	}
+
+	var nodes []string
+	Walk(sel, func(n Node) bool {
+		switch n := n.(type) {
+		case *String:
+			nodes = append(nodes, strconv.Quote(n.Value))
+		case *Bool:
+			nodes = append(nodes, strconv.FormatBool(n.Value))
+		case *List:
+			nodes = append(nodes, "list")
+		}
+		return true
+	})
+	w := []string{
+		`"ns"`, `"var"`,
+		"true", `"linux"`, "list", `"linux.c"`,
+		"list",
+		"list", `"x"`,
+	}
+	if !reflect.DeepEqual(nodes, w) {
+		t.Errorf("expected nodes %q, got %q", w, nodes)
+	}
+}
+
+func TestEnclosingMap(t *testing.T) {
+	file := parseForTest(t, `
+cflags = ["-Wall"]
+foo {
+    name: "foo",
+    arch: {
+        x86: {
+            srcs: ["x86.c"],
+        },
+    },
+}
+`)
+	module := file.Defs[1].(*Module)
+	arch, _ := module.GetProperty("arch")
+	x86, _ := arch.Value.(*Map).GetProperty("x86")
+	x86Map := x86.Value.(*Map)
+	srcs, _ := x86Map.GetProperty("srcs")
+	str := srcs.Value.(*List).Values[0]
+
+	if m, found := file.EnclosingMap(str); !found || m != x86Map {
+		t.Errorf("expected the string to be in the x86 map, got %v", m)
+	}
+	if m, found := file.EnclosingMap(x86Map); !found || m != arch.Value {
+		t.Errorf("expected the x86 map to be in the arch map, got %v", m)
+	}
+	name, _ := module.GetProperty("name")
+	if m, found := file.EnclosingMap(name); !found || m != &module.Map {
+		t.Errorf("expected the name property to be in the module's map, got %v", m)
+	}
+	if m, found := file.EnclosingMap(file.Defs[0]); found {
+		t.Errorf("expected the assignment not to be in a map, got %v", m)
+	}
+	if m, found := file.EnclosingMap(module); found {
+		t.Errorf("expected the module not to be in a map, got %v", m)
+	}
+}
+
+func TestNodeAt(t *testing.T) {
+	input := `
+cflags = ["-Wall"]
+foo {
+    name: "foo",
+    arch: {
+        x86: {
+            srcs: ["x86.c"] + select(os(), {
+                "linux": ["linux.c"],
+                default: [],
+            }),
+        },
+    },
+}
+`
+	file := parseForTest(t, input)
+	at := func(s string, skip int) Node {
+		t.Helper()
+		offset := strings.Index(input, s)
+		if offset < 0 {
+			t.Fatalf("%q not found", s)
+		}
+		return file.NodeAt(scanner.Position{Offset: offset + skip})
+	}
+
+	module := file.Defs[1].(*Module)
+	arch, _ := module.GetProperty("arch")
+	x86, _ := arch.Value.(*Map).GetProperty("x86")
+	srcs, _ := x86.Value.(*Map).GetProperty("srcs")
+	operator := srcs.Value.(*Operator)
+	sel := operator.Args[1].(*Select)
+
+	testCases := []struct {
+		name     string
+		node     Node
+		expected Node
+	}{
+		{"assignment list", at(`"-Wall"`, 1), file.Defs[0].(*Assignment).Value.(*List).Values[0]},
+		{"module type", at("foo {", 0), module},
+		{"property name", at("name:", 0), module.Properties[0]},
+		{"between name and value", at(`: "foo"`, 1), module.Properties[0]},
+		{"nested string", at(`"x86.c"`, 0), operator.Args[0].(*List).Values[0]},
+		{"operator", at(`+ select`, 0), operator},
+		{"select keyword", at("select", 2), sel},
+		{"select pattern", at(`"linux"`, 2), sel.Cases[0].Patterns[0]},
+		{"select case value", at(`"linux.c"`, 0), sel.Cases[0].Value.(*List).Values[0]},
+		{"nested map", at("x86: {", 5), x86.Value},
+		{"outside definitions", file.NodeAt(scanner.Position{Offset: 0}), nil},
+	}
+	for _, tt := range testCases {
+		if tt.node != tt.expected {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.expected, tt.node)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	file := parseForTest(t, `
+cflags = ["-Wall", "-Wdeprecated-flag"]
+
+cc_library {
+    name: "libfoo",
+    test_only: true,
+    cflags: cflags + ["-Wdeprecated-flag", "-O2"],
+    arch: {
+        arm: {
+            test_only: false,
+            cflags: select(os(), {
+                "linux": ["-Wdeprecated-flag"],
+                default: [],
+            }),
+        },
+    },
+}
+`)
+	file.Prune(func(n Node) bool {
+		switch n := n.(type) {
+		case *Property:
+			return n.Name != "test_only"
+		case *String:
+			return n.Value != "-Wdeprecated-flag"
+		}
+		return true
+	})
+
+	expected := parseForTest(t, `
+cflags = ["-Wall"]
+
+cc_library {
+    name: "libfoo",
+    cflags: cflags + ["-O2"],
+    arch: {
+        arm: {
+            cflags: select(os(), {
+                "linux": [],
+                default: [],
+            }),
+        },
+    },
+}
+`)
+	if equivalent, diff := FilesEquivalent(file, expected); !equivalent {
+		t.Errorf("expected pruned file to match, got difference at %s", diff)
+	}
+}
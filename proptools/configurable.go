@@ -75,6 +75,9 @@ var configurableMarkerType reflect.Type = reflect.TypeOf((*configurableMarker)(n
 type ConfigurableCondition struct {
 	functionName string
 	args         []string
+	// negated inverts the value of a boolean condition, it is set by a ! or not prefix on the
+	// condition in a select statement.
+	negated bool
 }
 
 func NewConfigurableCondition(functionName string, args []string) ConfigurableCondition {
@@ -96,8 +99,17 @@ func (c ConfigurableCondition) Arg(i int) string {
 	return c.args[i]
 }
 
+// Negated returns true if the value of the condition is inverted before it is matched against
+// the select branches.  The evaluator should evaluate the condition the same way regardless.
+func (c ConfigurableCondition) Negated() bool {
+	return c.negated
+}
+
 func (c *ConfigurableCondition) String() string {
 	var sb strings.Builder
+	if c.negated {
+		sb.WriteRune('!')
+	}
 	sb.WriteString(c.functionName)
 	sb.WriteRune('(')
 	for i, arg := range c.args {
@@ -481,6 +493,15 @@ func (c *singleConfigurable[T]) evaluateNonTransitive(propertyName string, evalu
 	values := make([]ConfigurableValue, len(c.conditions))
 	for i, condition := range c.conditions {
 		values[i] = evaluator.EvaluateConfiguration(condition, propertyName)
+		if condition.negated {
+			switch values[i].typ {
+			case configurableValueTypeBool:
+				values[i].boolValue = !values[i].boolValue
+			case configurableValueTypeString:
+				evaluator.PropertyErrorf(propertyName, "Cannot negate condition %s with a string value", condition.String())
+				return nil
+			}
+		}
 	}
 	foundMatch := false
 	nonMatchingIndex := 0
@@ -428,9 +428,27 @@ func (ctx *unpackContext) unpackToConfigurable(propertyName string, property *pa
 	case *parser.Operator:
 		property.Value = v.Value.Eval()
 		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
+	case *parser.Comparison:
+		property.Value = v.Value.Eval()
+		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
+	case *parser.BoolOp:
+		property.Value = v.Value.Eval()
+		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
+	case *parser.Conditional:
+		property.Value = v.Value.Eval()
+		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
 	case *parser.Variable:
 		property.Value = v.Value.Eval()
 		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
+	case *parser.InterpolatedString:
+		property.Value = v.Value.Eval()
+		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
+	case *parser.MemberAccess:
+		property.Value = v.Value.Eval()
+		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
+	case *parser.IndexAccess:
+		property.Value = v.Value.Eval()
+		return ctx.unpackToConfigurable(propertyName, property, configurableType, configuredType)
 	case *parser.Select:
 		resultPtr := reflect.New(configurableType)
 		result := resultPtr.Elem()
@@ -443,6 +461,7 @@ func (ctx *unpackContext) unpackToConfigurable(propertyName string, property *pa
 			conditions[i] = ConfigurableCondition{
 				functionName: cond.FunctionName,
 				args:         args,
+				negated:      cond.Negated,
 			}
 		}
 
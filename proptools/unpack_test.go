@@ -745,6 +745,56 @@ var validUnpackTestCases = []struct {
 			},
 		},
 	},
+	{
+		name: "String configurable property from a map member",
+		input: `
+			m = {a: "bar"}
+			n {
+				foo: m.a,
+			}
+		`,
+		output: []interface{}{
+			&struct {
+				Foo Configurable[string]
+			}{
+				Foo: Configurable[string]{
+					propertyName: "foo",
+					inner: &configurableInner[string]{
+						single: singleConfigurable[string]{
+							cases: []ConfigurableCase[string]{{
+								value: StringPtr("bar"),
+							}},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		name: "String configurable property from a list element",
+		input: `
+			l = ["bar", "baz"]
+			n {
+				foo: l[0],
+			}
+		`,
+		output: []interface{}{
+			&struct {
+				Foo Configurable[string]
+			}{
+				Foo: Configurable[string]{
+					propertyName: "foo",
+					inner: &configurableInner[string]{
+						single: singleConfigurable[string]{
+							cases: []ConfigurableCase[string]{{
+								value: StringPtr("bar"),
+							}},
+						},
+					},
+				},
+			},
+		},
+	},
 	{
 		name: "Bool configurable property that isn't configured",
 		input: `
@@ -847,6 +897,53 @@ var validUnpackTestCases = []struct {
 			},
 		},
 	},
+	{
+		name: "Configurable property with a negated condition",
+		input: `
+			m {
+				foo: select(!soong_config_variable("my_namespace", "my_variable"), {
+					true: "a2",
+					default: "c2",
+				})
+			}
+		`,
+		output: []interface{}{
+			&struct {
+				Foo Configurable[string]
+			}{
+				Foo: Configurable[string]{
+					propertyName: "foo",
+					inner: &configurableInner[string]{
+						single: singleConfigurable[string]{
+							conditions: []ConfigurableCondition{{
+								functionName: "soong_config_variable",
+								args: []string{
+									"my_namespace",
+									"my_variable",
+								},
+								negated: true,
+							}},
+							cases: []ConfigurableCase[string]{
+								{
+									patterns: []ConfigurablePattern{{
+										typ:       configurablePatternTypeBool,
+										boolValue: true,
+									}},
+									value: StringPtr("a2"),
+								},
+								{
+									patterns: []ConfigurablePattern{{
+										typ: configurablePatternTypeDefault,
+									}},
+									value: StringPtr("c2"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
 	{
 		name: "Configurable property appending",
 		input: `
@@ -1252,7 +1349,9 @@ func TestUnpackErrors(t *testing.T) {
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
 			r := bytes.NewBufferString(testCase.input)
-			file, errs := parser.ParseAndEval("", r, parser.NewScope(nil))
+			// Duplicate properties are parse errors by default, allow them to test Unpack's own check.
+			file, errs := parser.ParseWithOptions("", r, parser.NewScope(nil),
+				parser.ParseOptions{Eval: true, MaxErrors: 1, AllowDuplicateProperties: true})
 			if len(errs) != 0 {
 				t.Errorf("test case: %s", testCase.input)
 				t.Errorf("unexpected parse errors:")